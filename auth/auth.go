@@ -1,43 +1,58 @@
 package auth
 
 import (
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
-	"math/rand"
+	"math"
+	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/gomail.v2"
 )
 
 var tpl *template.Template
-var secretKey = []byte("mysecretkey")
-
-var collection *mongo.Collection
-
-type User struct {
-	ID               string `bson:"_id,omitempty"`
-	Email            string `bson:"email"`
-	Username         string `bson:"username"`
-	Password         string `bson:"password"`
-	Role             string `bson:"role"`
-	Verified         bool   `bson:"verified"`
-	VerificationCode string `bson:"verificationCode"`
-}
+var secretKey []byte
+
+var store *db.Store
+
+var (
+	codeTTL         time.Duration
+	codeMaxAttempts int
+	resendCooldown  time.Duration
+)
 
 type PageData struct {
 	ErrorMessage string
+	// Message is shown when an action succeeded.
+	Message string
+	// Token carries the reset token from the link into the reset form.
+	Token string
+
+	// Two-factor setup: the secret being enrolled, the URI to scan and its
+	// QR code, the recovery codes to show once, and whether it is already
+	// on.
+	Secret          string
+	ProvisioningURI string
+	QRCode          template.URL
+	RecoveryCodes   []string
+	TOTPEnabled     bool
 }
 
 type CustomClaims struct {
@@ -46,10 +61,16 @@ type CustomClaims struct {
 	Role     string `json:"role"`
 	Email    string `json:"email"`
 	Verified bool   `json:"verified"`
+	// SessionID ties the token to a row in the sessions collection.
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func init() {
+// Init prepares templates and logging and wires the store. It must be
+// called before any handler of this package is served.
+func Init(cfg *config.Config, s *db.Store) {
+	Configure(cfg, s)
+
 	// Get absolute paths
 	basePath, err := filepath.Abs(".")
 	if err != nil {
@@ -76,37 +97,38 @@ func init() {
 	// Optional: Customize log flags (e.g., include timestamps)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	log.Println("Logging to file:", logFilePath)
+}
 
-	// MongoDB connection setup
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
+// Configure wires the signing secret and the store without touching
+// templates or logging, which is all the middleware needs.
+func Configure(cfg *config.Config, s *db.Store) {
+	store = s
+	secretKey = []byte(cfg.JWT.Secret)
+	accessTTL = cfg.JWT.AccessTTL.Std()
+	refreshTTL = cfg.JWT.RefreshTTL.Std()
+	resetTTL = cfg.Auth.ResetTTL.Std()
+	codeTTL = cfg.Auth.CodeTTL.Std()
+	codeMaxAttempts = cfg.Auth.CodeMaxAttempts
+	resendCooldown = cfg.Auth.ResendCooldown.Std()
+	requireAdminTOTP = cfg.Auth.RequireAdminTOTP
+	publicURL = strings.TrimSuffix(cfg.Server.PublicURL, "/")
+}
 
-	err = client.Ping(context.TODO(), nil)
+func generateVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
 	if err != nil {
-		log.Fatalf("MongoDB connection failed: %v", err)
+		return "", err
 	}
-
-	collection = client.Database("cheeseMarket").Collection("users")
-	log.Println("Connected to MongoDB!")
-}
-
-func generateVerificationCode() string {
-	rand.Seed(time.Now().UnixNano())
-	return fmt.Sprintf("%06d", rand.Intn(1000000))
+	return fmt.Sprintf("%06d", n.Int64()), nil
 }
 
-func sendEmail(recipient, code string) error {
-	mailer := gomail.NewMessage()
-	mailer.SetHeader("From", "230047@astanait.edu.kz")
-	mailer.SetHeader("To", recipient)
-	mailer.SetHeader("Subject", "Email Verification Code")
-	mailer.SetBody("text/plain", fmt.Sprintf("Your verification code is: %s", code))
-
-	dialer := gomail.NewDialer("smtp.office365.com", 587, "230047@astanait.edu.kz", "aRBmKl1O0G0kw")
-	return dialer.DialAndSend(mailer)
+// enqueueVerificationEmail queues the code for delivery by the outbox worker.
+func enqueueVerificationEmail(ctx context.Context, recipient, code string) error {
+	return outbox.Enqueue(ctx, store.Outbox, mailer.Message{
+		To:      []string{recipient},
+		Subject: "Email Verification Code",
+		Text:    fmt.Sprintf("Your verification code is: %s\n\nIt expires in %s.", code, codeTTL),
+	})
 }
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
@@ -119,14 +141,13 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("Attempt to register user: %s", username)
 
-		var existingUser User
-		err := collection.FindOne(context.TODO(), bson.M{"username": username}).Decode(&existingUser)
+		_, err := store.Users.FindByUsername(r.Context(), username)
 		if err == nil {
 			data.ErrorMessage = "User with such login already exists"
 			tpl.ExecuteTemplate(w, "register.html", data)
 			log.Printf("Registration failed: User %s already exists", username)
 			return
-		} else if err != mongo.ErrNoDocuments {
+		} else if !errors.Is(err, db.ErrNotFound) {
 			data.ErrorMessage = "Error checking user presence"
 			tpl.ExecuteTemplate(w, "register.html", data)
 			log.Printf("Error checking user presence for %s: %v", username, err)
@@ -142,33 +163,41 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		role := "user"
-		count, _ := collection.CountDocuments(context.TODO(), bson.M{})
+		count, _ := store.Users.Count(r.Context())
 		if count == 0 {
 			role = "admin"
 		}
 
-		verificationCode := generateVerificationCode()
-		user := User{
-			Email:            email,
-			Username:         username,
-			Password:         string(hashedPassword),
-			Role:             role,
-			VerificationCode: verificationCode,
-			Verified:         false,
-		}
-		_, err = collection.InsertOne(context.TODO(), user)
+		verificationCode, err := generateVerificationCode()
 		if err != nil {
 			data.ErrorMessage = "Registration error"
 			tpl.ExecuteTemplate(w, "register.html", data)
-			log.Printf("Registration error for user %s: %v", username, err)
+			log.Printf("Generating verification code for %s failed: %v", username, err)
 			return
 		}
-
-		err = sendEmail(email, verificationCode)
+		now := time.Now()
+		user := models.User{
+			Email:                 email,
+			Username:              username,
+			Password:              string(hashedPassword),
+			Role:                  role,
+			VerificationCode:      verificationCode,
+			VerificationSentAt:    now,
+			VerificationExpiresAt: now.Add(codeTTL),
+			Verified:              false,
+		}
+		// The account and its verification email are stored together, so a
+		// user is never left waiting for a code that was never queued.
+		err = store.WithTransaction(r.Context(), func(ctx context.Context) error {
+			if err := store.Users.Create(ctx, &user); err != nil {
+				return err
+			}
+			return enqueueVerificationEmail(ctx, email, verificationCode)
+		})
 		if err != nil {
-			data.ErrorMessage = "Failed to send verification email"
+			data.ErrorMessage = "Registration error"
 			tpl.ExecuteTemplate(w, "register.html", data)
-			log.Printf("Failed to send verification email to %s: %v", email, err)
+			log.Printf("Registration error for user %s: %v", username, err)
 			return
 		}
 
@@ -198,12 +227,53 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		})
 
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
-		log.Printf("User %s registered successfully with role %s. Verification email sent.", username, role)
+		log.Printf("User %s registered successfully with role %s. Verification email queued.", username, role)
 		return
 	}
 	tpl.ExecuteTemplate(w, "register.html", data)
 }
 
+// verifyError is the JSON body verify.html renders when verification fails.
+// Error is a machine-readable state; Message is shown to the user.
+type verifyError struct {
+	Error        string `json:"error"`
+	Message      string `json:"message"`
+	AttemptsLeft *int   `json:"attempts_left,omitempty"`
+	RetryAfter   int    `json:"retry_after,omitempty"`
+}
+
+func writeVerifyError(w http.ResponseWriter, status int, body verifyError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// registeredEmail returns the email address from the register-token cookie
+// set by RegisterHandler.
+func registeredEmail(r *http.Request) (string, error) {
+	tokenCookie, err := r.Cookie("register-token")
+	if err != nil {
+		return "", errors.New("register token not found in cookies")
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenCookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return secretKey, nil
+	})
+	if err != nil || !token.Valid {
+		return "", fmt.Errorf("invalid register token: %v", err)
+	}
+
+	email, ok := claims["email"].(string)
+	if !ok || email == "" {
+		return "", errors.New("register token has no email claim")
+	}
+	return email, nil
+}
+
 func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 	data := PageData{}
 
@@ -219,110 +289,157 @@ func VerifyHandler(w http.ResponseWriter, r *http.Request) {
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			log.Printf("Error decoding request body: %v", err)
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			writeVerifyError(w, http.StatusBadRequest, verifyError{Error: "invalid_request", Message: "Invalid request."})
 			return
 		}
 
-		log.Printf("Received verification code: %s", reqBody.VerificationCode)
-
-		tokenCookie, err := r.Cookie("register-token")
+		email, err := registeredEmail(r)
 		if err != nil {
-			log.Printf("Error retrieving token cookie: %v", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Printf("Verification without a valid register token: %v", err)
+			writeVerifyError(w, http.StatusUnauthorized, verifyError{Error: "not_registered", Message: "Your registration has expired. Please register again."})
 			return
 		}
 
-		tokenString := tokenCookie.Value
-		claims := jwt.MapClaims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return secretKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			log.Printf("Error parsing token or token invalid: %v", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		user, err := store.Users.FindByEmail(r.Context(), email)
+		if err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			writeVerifyError(w, http.StatusUnauthorized, verifyError{Error: "not_registered", Message: "Your registration has expired. Please register again."})
 			return
 		}
 
-		log.Printf("Token claims: %+v", claims)
-
-		emailClaim, ok := claims["email"]
-		if !ok || emailClaim == nil {
-			log.Printf("Missing or invalid email claim in token")
-			http.Error(w, "Invalid token: missing email claim", http.StatusUnauthorized)
+		if user.Verified {
+			writeVerifyError(w, http.StatusConflict, verifyError{Error: "already_verified", Message: "Your email is already verified. Please log in."})
 			return
 		}
-
-		email, ok := emailClaim.(string)
-		if !ok {
-			log.Printf("Email claim is not a string")
-			http.Error(w, "Invalid token: email claim is not a string", http.StatusUnauthorized)
+		if user.VerificationAttempts >= codeMaxAttempts {
+			writeVerifyError(w, http.StatusTooManyRequests, verifyError{Error: "too_many_attempts", Message: "Too many wrong codes. Request a new code."})
+			return
+		}
+		if !time.Now().Before(user.VerificationExpiresAt) {
+			writeVerifyError(w, http.StatusGone, verifyError{Error: "code_expired", Message: "This code has expired. Request a new code."})
 			return
 		}
 
-		log.Printf("Email from token: %s", email)
-
-		var user User
-		err = collection.FindOne(context.TODO(), bson.M{"email": email}).Decode(&user)
+		// Count the guess before comparing so that parallel requests cannot
+		// get around the limit.
+		attempts, err := store.Users.AddVerificationAttempt(r.Context(), email)
 		if err != nil {
-			log.Printf("Error finding user in database: %v", err)
-			http.Error(w, "Invalid email or code", http.StatusUnauthorized)
+			log.Printf("Error recording verification attempt for %s: %v", email, err)
+			writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Verification failed, please try again."})
+			return
+		}
+		if attempts > codeMaxAttempts {
+			writeVerifyError(w, http.StatusTooManyRequests, verifyError{Error: "too_many_attempts", Message: "Too many wrong codes. Request a new code."})
 			return
 		}
 
-		if user.VerificationCode != reqBody.VerificationCode {
-			log.Printf("Verification failed for email %s: invalid code", email)
-			http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		if subtle.ConstantTimeCompare([]byte(user.VerificationCode), []byte(reqBody.VerificationCode)) != 1 {
+			left := codeMaxAttempts - attempts
+			log.Printf("Verification failed for email %s: invalid code, %d attempt(s) left", email, left)
+			if left == 0 {
+				writeVerifyError(w, http.StatusTooManyRequests, verifyError{Error: "too_many_attempts", Message: "Too many wrong codes. Request a new code."})
+				return
+			}
+			writeVerifyError(w, http.StatusUnauthorized, verifyError{
+				Error:        "invalid_code",
+				Message:      fmt.Sprintf("Invalid code. %d attempt(s) left.", left),
+				AttemptsLeft: &left,
+			})
 			return
 		}
 
-		updateResult, err := collection.UpdateOne(context.TODO(),
-			bson.M{"email": email},
-			bson.M{"$set": bson.M{"verified": true, "verificationCode": ""}},
-		)
+		err = store.Users.MarkVerified(r.Context(), email)
 		if err != nil {
 			log.Printf("Error updating user verification status: %v", err)
-			http.Error(w, "Verification update failed", http.StatusInternalServerError)
+			writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Verification failed, please try again."})
 			return
 		}
 
-		if updateResult.ModifiedCount == 0 {
-			log.Printf("No document was updated for email %s", email)
-			http.Error(w, "No document updated", http.StatusInternalServerError)
+		// Verification signs the user in, unless they must first enroll
+		// in two-factor authentication.
+		user.Verified = true
+		if needsSecondStep(user) == mfaEnroll {
+			if err := setMFACookie(w, user, mfaEnroll); err != nil {
+				log.Printf("MFA token error for user %s: %v", user.Username, err)
+				writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Verified, but signing in failed. Please log in."})
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"redirect": "/2fa/setup"})
+			log.Printf("User %s verified, two-factor enrollment required", user.Username)
 			return
 		}
-
-		// Update token to include verified claim
-		newClaims := CustomClaims{
-			Username: user.Username,
-			Role:     user.Role,
-			Email:    user.Email,
-			Verified: true,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			},
-		}
-		newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims)
-		newTokenString, err := newToken.SignedString(secretKey)
-		if err != nil {
-			log.Printf("Error generating new token: %v", err)
-			http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		if _, err := startSession(w, r, user); err != nil {
+			log.Printf("Error starting session: %v", err)
+			writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Verified, but signing in failed. Please log in."})
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    newTokenString,
-			Expires:  time.Now().Add(24 * time.Hour),
-			HttpOnly: true,
-		})
-
 		w.WriteHeader(http.StatusOK)
 		log.Printf("User %s verified successfully", user.Username)
 	}
 }
 
+// ResendCodeHandler emails a fresh verification code to the user who holds
+// the register-token cookie, at most once per resend cooldown.
+func ResendCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email, err := registeredEmail(r)
+	if err != nil {
+		log.Printf("Resend without a valid register token: %v", err)
+		writeVerifyError(w, http.StatusUnauthorized, verifyError{Error: "not_registered", Message: "Your registration has expired. Please register again."})
+		return
+	}
+	user, err := store.Users.FindByEmail(r.Context(), email)
+	if err != nil {
+		log.Printf("Error finding user %s for resend: %v", email, err)
+		writeVerifyError(w, http.StatusUnauthorized, verifyError{Error: "not_registered", Message: "Your registration has expired. Please register again."})
+		return
+	}
+	if user.Verified {
+		writeVerifyError(w, http.StatusConflict, verifyError{Error: "already_verified", Message: "Your email is already verified. Please log in."})
+		return
+	}
+
+	now := time.Now()
+	if wait := user.VerificationSentAt.Add(resendCooldown).Sub(now); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeVerifyError(w, http.StatusTooManyRequests, verifyError{
+			Error:      "resend_too_soon",
+			Message:    fmt.Sprintf("Please wait %d second(s) before requesting another code.", seconds),
+			RetryAfter: seconds,
+		})
+		return
+	}
+
+	code, err := generateVerificationCode()
+	if err != nil {
+		log.Printf("Generating verification code for %s failed: %v", email, err)
+		writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Could not send a new code, please try again."})
+		return
+	}
+	err = store.WithTransaction(r.Context(), func(ctx context.Context) error {
+		if err := store.Users.SetVerificationCode(ctx, email, code, now, now.Add(codeTTL)); err != nil {
+			return err
+		}
+		return enqueueVerificationEmail(ctx, email, code)
+	})
+	if err != nil {
+		log.Printf("Resending verification code to %s failed: %v", email, err)
+		writeVerifyError(w, http.StatusInternalServerError, verifyError{Error: "internal", Message: "Could not send a new code, please try again."})
+		return
+	}
+
+	log.Printf("Verification code resent to %s", email)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "A new code is on its way."})
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	data := PageData{}
 	if r.Method == http.MethodPost {
@@ -332,8 +449,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("Attempt to login user: %s", username)
 
-		var user User
-		err := collection.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+		user, err := store.Users.FindByUsername(r.Context(), username)
 		if err != nil {
 			data.ErrorMessage = "Incorrect login or password"
 			tpl.ExecuteTemplate(w, "login.html", data)
@@ -349,45 +465,28 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		claims := CustomClaims{
-			ID:       user.ID,
-			Username: username,
-			Role:     user.Role,
-			Email:    user.Email,
-			Verified: user.Verified,
-			RegisteredClaims: jwt.RegisteredClaims{
-				Issuer:    "cheese",                                      // Issuer of the token
-				Subject:   username,                                      // Subject (usually the user's ID or username)
-				Audience:  []string{"cheese"},                            // Audience
-				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)), // Expiration time
-				IssuedAt:  jwt.NewNumericDate(time.Now()),                // Issued at
-				NotBefore: jwt.NewNumericDate(time.Now()),                // Not valid before
-			},
+		if step := needsSecondStep(user); step != "" {
+			if err := setMFACookie(w, user, step); err != nil {
+				data.ErrorMessage = "Generation token error"
+				tpl.ExecuteTemplate(w, "login.html", data)
+				log.Printf("MFA token error for user %s: %v", username, err)
+				return
+			}
+			target := "/login/2fa"
+			if step == mfaEnroll {
+				target = "/2fa/setup"
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			log.Printf("User %s passed the password check, second step: %s", username, step)
+			return
 		}
 
-		// Create a new token with the claims
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-		tokenString, err := token.SignedString(secretKey)
-		if err != nil {
+		if _, err := startSession(w, r, user); err != nil {
 			data.ErrorMessage = "Generation token error"
 			tpl.ExecuteTemplate(w, "login.html", data)
-			log.Printf("Token generation error for user %s: %v", username, err)
+			log.Printf("Session creation error for user %s: %v", username, err)
 			return
 		}
-		log.Printf("Generated token: %s", tokenString)
-
-		w.Header().Set("Authorization", "Bearer "+tokenString)
-		w.Header().Set("Access-Control-Expose-Headers", "Authorization") // Чтобы JS мог его прочитать
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    tokenString,
-			Path:     "/",
-			HttpOnly: false, // Отключаем HttpOnly, если хотим использовать document.cookie
-			Secure:   false, // Поставь true, если HTTPS
-			SameSite: http.SameSiteLaxMode,
-		})
 		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, proxy-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
@@ -399,41 +498,15 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	tpl.ExecuteTemplate(w, "login.html", data)
 }
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "token",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
-	log.Println("User logged out successfully")
-}
-
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
-	tokenCookie, err := r.Cookie("token")
-	if err != nil {
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		log.Println("Unauthorized access attempt to dashboard")
 		return
 	}
 
-	tokenString := tokenCookie.Value
-	claims := jwt.MapClaims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		log.Println("Unauthorized access attempt to dashboard with invalid token")
-		return
-	}
-
-	role := claims["role"].(string)
-
-	if role == "admin" {
+	if claims.Role == "admin" {
 		http.Redirect(w, r, "/admin", http.StatusSeeOther)
 		log.Println("Admin user redirected to admin dashboard")
 	} else {
@@ -448,7 +521,7 @@ func (c CustomClaims) Valid() error {
 
 func VerifyJWTToken(r *http.Request) (*CustomClaims, error) {
 	// Get the token from cookies
-	tokenCookie, err := r.Cookie("token")
+	tokenCookie, err := r.Cookie(accessCookie)
 	if err != nil {
 		return nil, errors.New("token not found in cookies")
 	}
@@ -484,9 +557,10 @@ func VerifyJWTToken(r *http.Request) (*CustomClaims, error) {
 }
 
 // AuthMiddleware verifies the token and provides authenticated access to subsequent handlers.
+// An expired access token is renewed from the refresh cookie on the way through.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims, err := VerifyJWTToken(r)
+		claims, err := authenticate(w, r)
 		if err != nil {
 			log.Printf("Unauthorized access attempt: %v", err)
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -494,7 +568,7 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		log.Printf("Authenticated user: %s with role: %s", claims.Username, claims.Role)
-		defer next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
 	})
 }
 
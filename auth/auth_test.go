@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTest wires the package to an in-memory store and returns the
+// capturing mailer that codeSentTo delivers the outbox to, so no database or
+// SMTP server is needed.
+func setupTest(t *testing.T) *mailer.CaptureMailer {
+	t.Helper()
+
+	tpl = template.Must(template.ParseGlob("../templates/*.html"))
+	cfg := config.Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	Configure(cfg, db.NewMemoryStore())
+	mfaLimiter = newFailureLimiter(mfaLimiter.limit, mfaLimiter.burst)
+
+	return mailer.NewCapture("shop@example.com")
+}
+
+// deliverOutbox sends everything queued so far to sent.
+func deliverOutbox(t *testing.T, sent *mailer.CaptureMailer) {
+	t.Helper()
+
+	_, err := outbox.NewWorker(store.Outbox, sent, config.Default().Outbox).ProcessDue(context.Background())
+	require.NoError(t, err)
+}
+
+var codePattern = regexp.MustCompile(`\b\d{6}\b`)
+
+// codeSentTo extracts the latest verification code emailed to recipient.
+func codeSentTo(t *testing.T, sent *mailer.CaptureMailer, recipient string) string {
+	t.Helper()
+
+	deliverOutbox(t, sent)
+	messages := sent.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To[0] == recipient {
+			code := codePattern.FindString(messages[i].Text)
+			require.NotEmpty(t, code, "no code in %q", messages[i].Text)
+			return code
+		}
+	}
+	t.Fatalf("no email sent to %s", recipient)
+	return ""
+}
+
+func postForm(handler http.HandlerFunc, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func cookieNamed(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func register(t *testing.T, username, email string) *http.Cookie {
+	t.Helper()
+
+	rec := postForm(RegisterHandler, "/register", url.Values{
+		"email":    {email},
+		"username": {username},
+		"password": {"Secret123"},
+	})
+	require.Equal(t, http.StatusSeeOther, rec.Code, rec.Body.String())
+	assert.Equal(t, "/verify", rec.Header().Get("Location"))
+
+	cookie := cookieNamed(rec, "register-token")
+	require.NotNil(t, cookie)
+	return cookie
+}
+
+func TestRegisterHandler(t *testing.T) {
+	sent := setupTest(t)
+
+	register(t, "ann", "ann@example.com")
+	assert.Len(t, codeSentTo(t, sent, "ann@example.com"), 6)
+
+	first, err := store.Users.FindByUsername(context.Background(), "ann")
+	require.NoError(t, err)
+	assert.Equal(t, "admin", first.Role, "the first account becomes the administrator")
+	assert.NotEqual(t, "Secret123", first.Password)
+
+	register(t, "bob", "bob@example.com")
+	second, err := store.Users.FindByUsername(context.Background(), "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "user", second.Role)
+
+	rec := postForm(RegisterHandler, "/register", url.Values{
+		"email": {"other@example.com"}, "username": {"bob"}, "password": {"x"},
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "User with such login already exists")
+}
+
+func TestVerifyHandler(t *testing.T) {
+	sent := setupTest(t)
+	registerCookie := register(t, "ann", "ann@example.com")
+
+	verify := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(`{"verificationCode":"`+code+`"}`))
+		req.AddCookie(registerCookie)
+		rec := httptest.NewRecorder()
+		VerifyHandler(rec, req)
+		return rec
+	}
+
+	rec := verify("000000x")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = verify(codeSentTo(t, sent, "ann@example.com"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NotNil(t, cookieNamed(rec, "token"))
+
+	user, err := store.Users.FindByEmail(context.Background(), "ann@example.com")
+	require.NoError(t, err)
+	assert.True(t, user.Verified)
+	assert.Empty(t, user.VerificationCode)
+}
+
+func TestLoginAndMiddleware(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+
+	rec := postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"wrong"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Incorrect login or password")
+
+	rec = postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/dashboard", rec.Header().Get("Location"))
+	token := cookieNamed(rec, "token")
+	require.NotNil(t, token)
+
+	protected := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	rec = httptest.NewRecorder()
+	protected.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+
+	req = httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.AddCookie(token)
+	rec = httptest.NewRecorder()
+	protected.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	claims, err := VerifyJWTToken(req)
+	require.NoError(t, err)
+	assert.Equal(t, "ann", claims.Username)
+	assert.Equal(t, "admin", claims.Role)
+}
+
+func TestLogoutHandler(t *testing.T) {
+	setupTest(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	rec := httptest.NewRecorder()
+	LogoutHandler(rec, req)
+
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	cookie := cookieNamed(rec, "token")
+	require.NotNil(t, cookie)
+	assert.Empty(t, cookie.Value)
+	assert.Negative(t, cookie.MaxAge)
+}
+
+func TestRegisterSucceedsWhileMailIsDown(t *testing.T) {
+	sent := setupTest(t)
+	sent.SetErr(errors.New("smtp: connection refused"))
+
+	register(t, "ann", "ann@example.com")
+	deliverOutbox(t, sent)
+	assert.Empty(t, sent.Messages())
+
+	counts, err := store.Outbox.CountByStatus(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, counts[models.OutboxPending], "the failed email is scheduled for a retry")
+}
+
+func TestRequireRole(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com") // the first account is the admin
+	register(t, "bob", "bob@example.com")
+
+	login := func(username string) *http.Cookie {
+		rec := postForm(LoginHandler, "/login", url.Values{"username": {username}, "password": {"Secret123"}})
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		return cookieNamed(rec, "token")
+	}
+	admin, user := login("ann"), login("bob")
+
+	var seen *CustomClaims
+	protected := RequireRole("admin", http.MethodPost)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = ClaimsFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(method, accept string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/products", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code, "unrestricted methods pass through")
+	assert.Nil(t, seen)
+
+	rec = serve(http.MethodPost, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.JSONEq(t, `{"error":"authentication required"}`, rec.Body.String())
+
+	rec = serve(http.MethodPost, "text/html,application/xhtml+xml", nil)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+
+	rec = serve(http.MethodPost, "", user)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	rec = serve(http.MethodPost, "", admin)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	require.NotNil(t, seen)
+	assert.Equal(t, "ann", seen.Username)
+}
+
+func postVerify(registerCookie *http.Cookie, code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(`{"verificationCode":"`+code+`"}`))
+	req.AddCookie(registerCookie)
+	rec := httptest.NewRecorder()
+	VerifyHandler(rec, req)
+	return rec
+}
+
+func decodeVerifyError(t *testing.T, rec *httptest.ResponseRecorder) verifyError {
+	t.Helper()
+
+	var body verifyError
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body), rec.Body.String())
+	return body
+}
+
+func TestVerifyLocksAfterMaxAttempts(t *testing.T) {
+	sent := setupTest(t)
+	registerCookie := register(t, "ann", "ann@example.com")
+	code := codeSentTo(t, sent, "ann@example.com")
+
+	for left := codeMaxAttempts - 1; left > 0; left-- {
+		rec := postVerify(registerCookie, "wrong")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		body := decodeVerifyError(t, rec)
+		assert.Equal(t, "invalid_code", body.Error)
+		require.NotNil(t, body.AttemptsLeft)
+		assert.Equal(t, left, *body.AttemptsLeft)
+	}
+
+	rec := postVerify(registerCookie, "wrong")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "too_many_attempts", decodeVerifyError(t, rec).Error)
+
+	rec = postVerify(registerCookie, code)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the right code is refused once the code is locked")
+}
+
+func TestVerifyRejectsExpiredCode(t *testing.T) {
+	sent := setupTest(t)
+	registerCookie := register(t, "ann", "ann@example.com")
+	code := codeSentTo(t, sent, "ann@example.com")
+
+	require.NoError(t, store.Users.SetVerificationCode(context.Background(), "ann@example.com", code,
+		time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)))
+
+	rec := postVerify(registerCookie, code)
+	require.Equal(t, http.StatusGone, rec.Code)
+	assert.Equal(t, "code_expired", decodeVerifyError(t, rec).Error)
+}
+
+func TestResendCode(t *testing.T) {
+	sent := setupTest(t)
+	registerCookie := register(t, "ann", "ann@example.com")
+	first := codeSentTo(t, sent, "ann@example.com")
+
+	resend := func() *httptest.ResponseRecorder {
+		return postForm(ResendCodeHandler, "/resend-code", nil, registerCookie)
+	}
+
+	rec := resend()
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, "resend_too_soon", decodeVerifyError(t, rec).Error)
+
+	// Pretend the first code went out long enough ago, and lock it.
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, store.Users.SetVerificationCode(context.Background(), "ann@example.com", first, past, time.Now().Add(time.Minute)))
+	for i := 0; i < codeMaxAttempts; i++ {
+		postVerify(registerCookie, "wrong")
+	}
+
+	rec = resend()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	second := codeSentTo(t, sent, "ann@example.com")
+	assert.Len(t, sent.Messages(), 2)
+
+	rec = postVerify(registerCookie, second)
+	require.Equal(t, http.StatusOK, rec.Code, "a new code resets the attempt counter")
+
+	rec = resend()
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestVerificationCodesAreRandom(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		code, err := generateVerificationCode()
+		require.NoError(t, err)
+		require.Regexp(t, `^\d{6}$`, code)
+		seen[code] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims AuthMiddleware or RequireRole stored
+// for the request, or nil if the request did not pass through either.
+func ClaimsFromContext(ctx context.Context) *CustomClaims {
+	claims, _ := ctx.Value(claimsKey{}).(*CustomClaims)
+	return claims
+}
+
+// RequireRole only lets callers whose token carries role through to the
+// handler. When methods are given, only requests with one of those methods
+// are checked, so a single route can be public for GET and admin-only for
+// writes. Browsers asking for a page are redirected to /login (or, if they
+// are signed in with another role, to /dashboard); API clients get a JSON 401
+// or 403.
+func RequireRole(role string, methods ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := authenticate(w, r)
+			if err != nil {
+				log.Printf("Unauthorized %s %s: %v", r.Method, r.URL.Path, err)
+				if wantsHTML(r) {
+					http.Redirect(w, r, "/login", http.StatusSeeOther)
+					return
+				}
+				writeJSONError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+
+			if role != "" && claims.Role != role {
+				log.Printf("Forbidden %s %s for user %s with role %s", r.Method, r.URL.Path, claims.Username, claims.Role)
+				if wantsHTML(r) {
+					// The dashboard sends the user to the page for their role.
+					http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+					return
+				}
+				writeJSONError(w, http.StatusForbidden, "requires role "+role)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// RequireUser lets any signed-in user through, answering like RequireRole
+// otherwise.
+func RequireUser(next http.Handler) http.Handler {
+	return RequireRole("")(next)
+}
+
+// wantsHTML reports whether the request comes from a browser navigating to a
+// page rather than from fetch or another API client.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
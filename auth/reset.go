@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	resetTTL  time.Duration
+	publicURL string
+)
+
+const minPasswordLength = 8
+
+// ForgotPasswordHandler emails a password reset link. It answers the same
+// way whether or not the address belongs to an account, so it cannot be used
+// to find out who is registered.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{}
+	if r.Method != http.MethodPost {
+		tpl.ExecuteTemplate(w, "forgot_password.html", data)
+		return
+	}
+
+	r.ParseForm()
+	email := r.FormValue("email")
+	log.Printf("Password reset requested for %s", email)
+
+	user, err := store.Users.FindByEmail(r.Context(), email)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		log.Printf("Password reset for unknown email %s ignored", email)
+	case err != nil:
+		data.ErrorMessage = "Could not process the request, please try again"
+		tpl.ExecuteTemplate(w, "forgot_password.html", data)
+		log.Printf("Error looking up %s for password reset: %v", email, err)
+		return
+	default:
+		if err := sendResetLink(r.Context(), user); err != nil {
+			data.ErrorMessage = "Could not process the request, please try again"
+			tpl.ExecuteTemplate(w, "forgot_password.html", data)
+			log.Printf("Error creating password reset for %s: %v", email, err)
+			return
+		}
+	}
+
+	data.Message = "If an account uses this address, we have emailed it a link to reset the password."
+	tpl.ExecuteTemplate(w, "forgot_password.html", data)
+}
+
+// sendResetLink stores a new reset token for user and queues the email
+// carrying it in the same transaction.
+func sendResetLink(ctx context.Context, user *models.User) error {
+	token, err := newRefreshSecret()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	reset := models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(resetTTL),
+	}
+	link := publicURL + "/reset-password?token=" + url.QueryEscape(token)
+
+	return store.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := store.Resets.Create(ctx, &reset); err != nil {
+			return err
+		}
+		return outbox.Enqueue(ctx, store.Outbox, mailer.Message{
+			To:      []string{user.Email},
+			Subject: "Reset your Cheese Market password",
+			Text: fmt.Sprintf("Hello %s,\n\nOpen this link to choose a new password:\n%s\n\n"+
+				"The link works once and expires in %s. If you did not ask for it, ignore this email.",
+				user.Username, link, resetTTL),
+		})
+	})
+}
+
+// ResetPasswordHandler shows the new password form for the token in the link
+// and, on submit, spends the token, stores the new password and signs the
+// user out everywhere.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{Token: r.URL.Query().Get("token")}
+	if r.Method != http.MethodPost {
+		if data.Token == "" {
+			data.ErrorMessage = "The reset link is incomplete"
+		}
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		return
+	}
+
+	r.ParseForm()
+	data.Token = r.FormValue("token")
+	password := r.FormValue("password")
+
+	if len(password) < minPasswordLength {
+		data.ErrorMessage = fmt.Sprintf("The password must be at least %d characters long", minPasswordLength)
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		return
+	}
+	if password != r.FormValue("confirm_password") {
+		data.ErrorMessage = "The passwords do not match"
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		data.ErrorMessage = "Hashing password error"
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		log.Printf("Hashing password error during reset: %v", err)
+		return
+	}
+
+	// Consume spends the token in one conditional update before anything
+	// else, so a link can set at most one password even when two requests
+	// race. With mongo.transactions on, a later failure also rolls the token
+	// back and the link stays usable; without transactions the token is
+	// already spent and the user has to request a new link.
+	var userID string
+	err = store.WithTransaction(r.Context(), func(ctx context.Context) error {
+		reset, err := store.Resets.Consume(ctx, hashToken(data.Token), time.Now())
+		if err != nil {
+			return err
+		}
+		userID = reset.UserID
+		if err := store.Users.UpdatePassword(ctx, reset.UserID, string(hashedPassword)); err != nil {
+			return err
+		}
+		return RevokeUserSessions(ctx, reset.UserID)
+	})
+	if errors.Is(err, db.ErrNotFound) && userID == "" {
+		data.ErrorMessage = "This reset link is invalid, expired or was already used"
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		log.Printf("Rejected password reset with unknown or spent token")
+		return
+	} else if err != nil {
+		data.ErrorMessage = "Could not reset the password, please try again or request a new link"
+		tpl.ExecuteTemplate(w, "reset_password.html", data)
+		log.Printf("Error resetting password: %v", err)
+		return
+	}
+
+	log.Printf("Password of user %s reset", userID)
+	tpl.ExecuteTemplate(w, "login.html", PageData{Message: "Your password was changed. Please log in."})
+}
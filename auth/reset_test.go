@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var resetLinkPattern = regexp.MustCompile(`http://localhost:8080/reset-password\?token=(\S+)`)
+
+func requestReset(t *testing.T, sent *mailer.CaptureMailer, email string) string {
+	t.Helper()
+
+	rec := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {email}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "we have emailed it a link")
+
+	deliverOutbox(t, sent)
+	last := sent.Last()
+	require.NotNil(t, last)
+	require.Equal(t, []string{email}, last.To)
+	match := resetLinkPattern.FindStringSubmatch(last.Text)
+	require.NotNil(t, match, "no reset link in %q", last.Text)
+	token, err := url.QueryUnescape(match[1])
+	require.NoError(t, err)
+	return token
+}
+
+func resetPassword(token, password, confirm string) *httptest.ResponseRecorder {
+	return postForm(ResetPasswordHandler, "/reset-password", url.Values{
+		"token": {token}, "password": {password}, "confirm_password": {confirm},
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	sent := setupTest(t)
+	register(t, "ann", "ann@example.com")
+	access, _ := login(t, "ann")
+
+	token := requestReset(t, sent, "ann@example.com")
+
+	req := httptest.NewRequest(http.MethodGet, "/reset-password?token="+url.QueryEscape(token), nil)
+	rec := httptest.NewRecorder()
+	ResetPasswordHandler(rec, req)
+	assert.Contains(t, rec.Body.String(), `name="token" value="`+token+`"`)
+
+	rec = resetPassword(token, "NewSecret456", "Different789")
+	assert.Contains(t, rec.Body.String(), "The passwords do not match")
+	rec = resetPassword(token, "short", "short")
+	assert.Contains(t, rec.Body.String(), "at least 8 characters")
+
+	rec = resetPassword(token, "NewSecret456", "NewSecret456")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Your password was changed")
+
+	assert.Equal(t, http.StatusUnauthorized, me(access).Code, "existing sessions end with the reset")
+
+	rec = postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	assert.Contains(t, rec.Body.String(), "Incorrect login or password")
+	rec = postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"NewSecret456"}})
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+
+	rec = resetPassword(token, "Another789x", "Another789x")
+	assert.Contains(t, rec.Body.String(), "already used", "links work once")
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	sent := setupTest(t)
+
+	rec := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"nobody@example.com"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "we have emailed it a link", "the answer does not reveal whether the account exists")
+
+	deliverOutbox(t, sent)
+	assert.Empty(t, sent.Messages())
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+	user, err := store.Users.FindByUsername(context.Background(), "ann")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Resets.Create(context.Background(), &models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken("stale-token"),
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+		ExpiresAt: time.Now().Add(-time.Hour),
+	}))
+
+	rec := resetPassword("stale-token", "NewSecret456", "NewSecret456")
+	assert.Contains(t, rec.Body.String(), "invalid, expired or was already used")
+}
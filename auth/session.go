@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"cheese_market/db"
+	"cheese_market/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	accessCookie  = "token"
+	refreshCookie = "refresh_token"
+)
+
+var (
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+)
+
+var errSessionEnded = errors.New("session revoked or expired")
+
+// startSession records a new session for user and sets the access and
+// refresh cookies.
+func startSession(w http.ResponseWriter, r *http.Request, user *models.User) (*CustomClaims, error) {
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:      user.ID,
+		RefreshHash: hashToken(secret),
+		UserAgent:   r.UserAgent(),
+		IP:          clientIP(r),
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(refreshTTL),
+	}
+	if err := store.Sessions.Create(r.Context(), &session); err != nil {
+		return nil, err
+	}
+
+	setRefreshCookie(w, session.ID+"."+secret)
+	return issueAccessToken(w, user, session.ID)
+}
+
+// issueAccessToken signs a short-lived token for the session and sets it as
+// the access cookie.
+func issueAccessToken(w http.ResponseWriter, user *models.User, sessionID string) (*CustomClaims, error) {
+	now := time.Now()
+	claims := CustomClaims{
+		ID:        user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		Email:     user.Email,
+		Verified:  user.Verified,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "cheese",
+			Subject:   user.Username,
+			Audience:  []string{"cheese"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookie,
+		Value:    tokenString,
+		Path:     "/",
+		Expires:  now.Add(accessTTL),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return &claims, nil
+}
+
+func setRefreshCookie(w http.ResponseWriter, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(refreshTTL),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{accessCookie, refreshCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+}
+
+// refreshSession trades the refresh cookie for a new refresh token and a new
+// access token. Presenting a refresh token that was already rotated away
+// means it was copied, so the whole session is revoked.
+func refreshSession(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	cookie, err := r.Cookie(refreshCookie)
+	if err != nil {
+		return nil, errors.New("refresh token not found in cookies")
+	}
+	sessionID, secret, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return nil, errors.New("malformed refresh token")
+	}
+
+	newSecret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = store.Sessions.Rotate(r.Context(), sessionID, hashToken(secret), hashToken(newSecret), now, now.Add(refreshTTL))
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+		if revokeErr := store.Sessions.Revoke(r.Context(), sessionID, now); revokeErr == nil {
+			log.Printf("Refresh token reuse detected, revoked session %s", sessionID)
+		}
+		return nil, errSessionEnded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := store.Sessions.Get(r.Context(), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := store.Users.FindByID(r.Context(), session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	setRefreshCookie(w, sessionID+"."+newSecret)
+	return issueAccessToken(w, user, sessionID)
+}
+
+// authenticate returns the caller's claims. A valid access token is checked
+// against its session so revocation takes effect immediately; a missing or
+// expired one is replaced using the refresh cookie.
+func authenticate(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	claims, err := VerifyJWTToken(r)
+	if err != nil {
+		if _, refreshErr := r.Cookie(refreshCookie); refreshErr != nil {
+			return nil, err
+		}
+		return refreshSession(w, r)
+	}
+
+	if claims.SessionID == "" {
+		return nil, errors.New("token has no session")
+	}
+	session, err := store.Sessions.Get(r.Context(), claims.SessionID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !session.Active(time.Now())) {
+		return nil, errSessionEnded
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// RevokeUserSessions logs userID out on every device.
+func RevokeUserSessions(ctx context.Context, userID string) error {
+	n, err := store.Sessions.RevokeAllForUser(ctx, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked %d session(s) of user %s", n, userID)
+	return nil
+}
+
+// RefreshHandler lets scripts renew the access token before calling an API.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := refreshSession(w, r); err != nil {
+		log.Printf("Refresh failed: %v", err)
+		clearSessionCookies(w)
+		writeJSONError(w, http.StatusUnauthorized, "session expired")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutHandler ends the current session and clears its cookies.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if sessionID := currentSessionID(r); sessionID != "" {
+		if err := store.Sessions.Revoke(r.Context(), sessionID, time.Now()); err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Failed to revoke session %s: %v", sessionID, err)
+		}
+	}
+
+	clearSessionCookies(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	log.Println("User logged out successfully")
+}
+
+// LogoutAllHandler ends every session of the signed-in user.
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := authenticate(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if err := RevokeUserSessions(r.Context(), claims.ID); err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", claims.Username, err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookies(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// MeHandler describes the signed-in user to page scripts, which cannot read
+// the HttpOnly token cookie.
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := authenticate(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":  claims.ID,
+		"username": claims.Username,
+		"role":     claims.Role,
+		"email":    claims.Email,
+		"verified": claims.Verified,
+	})
+}
+
+// currentSessionID finds the session from the access token or, if that has
+// expired, from the refresh cookie.
+func currentSessionID(r *http.Request) string {
+	if claims, err := VerifyJWTToken(r); err == nil && claims.SessionID != "" {
+		return claims.SessionID
+	}
+	if cookie, err := r.Cookie(refreshCookie); err == nil {
+		sessionID, _, _ := strings.Cut(cookie.Value, ".")
+		return sessionID
+	}
+	return ""
+}
+
+func newRefreshSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
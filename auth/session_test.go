@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// login signs in and returns the access and refresh cookies.
+func login(t *testing.T, username string) (access, refresh *http.Cookie) {
+	t.Helper()
+
+	rec := postForm(LoginHandler, "/login", url.Values{"username": {username}, "password": {"Secret123"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	access, refresh = cookieNamed(rec, accessCookie), cookieNamed(rec, refreshCookie)
+	require.NotNil(t, access)
+	require.NotNil(t, refresh)
+	assert.True(t, access.HttpOnly)
+	assert.True(t, refresh.HttpOnly)
+	return access, refresh
+}
+
+func me(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	MeHandler(rec, req)
+	return rec
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+	_, refresh := login(t, "ann")
+
+	rec := postForm(RefreshHandler, "/refresh", nil, refresh)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rotated := cookieNamed(rec, refreshCookie)
+	require.NotNil(t, rotated)
+	assert.NotEqual(t, refresh.Value, rotated.Value)
+	require.NotNil(t, cookieNamed(rec, accessCookie))
+
+	// Replaying the old refresh token looks like theft: it fails and ends
+	// the session, so the rotated token stops working too.
+	rec = postForm(RefreshHandler, "/refresh", nil, refresh)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = postForm(RefreshHandler, "/refresh", nil, rotated)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestMiddlewareRefreshesExpiredAccessToken(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+	_, refresh := login(t, "ann")
+
+	// Only the refresh cookie is left once the access cookie has expired.
+	rec := me(refresh)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"username":"ann"`)
+	assert.NotNil(t, cookieNamed(rec, accessCookie))
+	assert.NotNil(t, cookieNamed(rec, refreshCookie))
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+	access, refresh := login(t, "ann")
+	require.Equal(t, http.StatusOK, me(access).Code)
+
+	rec := postForm(LogoutHandler, "/logout", nil, access, refresh)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, me(access).Code, "the old access token is rejected before it expires")
+	assert.Equal(t, http.StatusUnauthorized, me(refresh).Code)
+}
+
+func TestLogoutAllRevokesEveryDevice(t *testing.T) {
+	setupTest(t)
+	register(t, "ann", "ann@example.com")
+	laptop, _ := login(t, "ann")
+	phone, _ := login(t, "ann")
+
+	rec := postForm(LogoutAllHandler, "/logout-all", nil, laptop)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, me(laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, me(phone).Code)
+}
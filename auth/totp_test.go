@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"bytes"
+	"cheese_market/config"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixClock pins the two-factor clock to at for the rest of the test.
+func fixClock(t *testing.T, at time.Time) *time.Time {
+	now := at
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+	return &now
+}
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B (SHA-1), last six digits.
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := totpCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "t=%d", unix)
+	}
+}
+
+func TestValidateTOTPAllowsOneStepOfDrift(t *testing.T) {
+	secret, err := newTOTPSecret()
+	require.NoError(t, err)
+	at := time.Unix(1700000000, 0)
+
+	code, err := totpCode(secret, at.Add(-totpPeriod))
+	require.NoError(t, err)
+	step, ok := validateTOTP(secret, code, at)
+	assert.True(t, ok)
+	assert.Equal(t, totpCounter(at)-1, step)
+
+	code, err = totpCode(secret, at.Add(-3*totpPeriod))
+	require.NoError(t, err)
+	_, ok = validateTOTP(secret, code, at)
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(provisioningURI("JBSWY3DPEHPK3PXP", "ann@example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Cheese Market:ann@example.com", uri.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	assert.Equal(t, "Cheese Market", uri.Query().Get("issuer"))
+}
+
+func TestQRCode(t *testing.T) {
+	qr, err := qrCode(provisioningURI("JBSWY3DPEHPK3PXP", "ann@example.com"))
+	require.NoError(t, err)
+	data, ok := strings.CutPrefix(string(qr), "data:image/png;base64,")
+	require.True(t, ok, qr)
+	png, err := base64.StdEncoding.DecodeString(data)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(png, []byte("\x89PNG")))
+}
+
+var secretPattern = regexp.MustCompile(`Key: <code>([A-Z2-7]+)</code>`)
+var recoveryPattern = regexp.MustCompile(`<code>([a-z2-7]{5}-[a-z2-7]{5})</code>`)
+
+func get(handler http.HandlerFunc, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// enroll runs the setup pages with cookies and returns the secret and the
+// recovery codes.
+func enroll(t *testing.T, now time.Time, cookies ...*http.Cookie) (string, []string, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	rec := get(TOTPSetupHandler, "/2fa/setup", cookies...)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `src="data:image/png;base64,`, "the page shows a QR code to scan")
+	match := secretPattern.FindStringSubmatch(rec.Body.String())
+	require.NotNil(t, match, rec.Body.String())
+	secret := match[1]
+
+	code, err := totpCode(secret, now)
+	require.NoError(t, err)
+	rec = postForm(TOTPSetupHandler, "/2fa/setup", url.Values{"code": {code}}, cookies...)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var codes []string
+	for _, m := range recoveryPattern.FindAllStringSubmatch(rec.Body.String(), -1) {
+		codes = append(codes, m[1])
+	}
+	require.Len(t, codes, recoveryCodeCount)
+	return secret, codes, rec
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	setupTest(t)
+	now := fixClock(t, time.Unix(1700000000, 0))
+	register(t, "ann", "ann@example.com")
+	access, _ := login(t, "ann")
+
+	secret, recovery, _ := enroll(t, *now, access)
+	*now = now.Add(totpPeriod)
+
+	rec := postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/login/2fa", rec.Header().Get("Location"))
+	assert.Nil(t, cookieNamed(rec, accessCookie), "no session before the second step")
+	mfa := cookieNamed(rec, mfaCookie)
+	require.NotNil(t, mfa)
+
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {"000000"}}, mfa)
+	assert.Contains(t, rec.Body.String(), "Invalid code")
+
+	code, err := totpCode(secret, *now)
+	require.NoError(t, err)
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {code}}, mfa)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/dashboard", rec.Header().Get("Location"))
+	require.NotNil(t, cookieNamed(rec, accessCookie))
+
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {code}}, mfa)
+	assert.Contains(t, rec.Body.String(), "Invalid code", "a code cannot be replayed")
+
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {strings.ToUpper(recovery[0])}}, mfa)
+	require.Equal(t, http.StatusSeeOther, rec.Code, "recovery codes work in place of a code")
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {recovery[0]}}, mfa)
+	assert.Contains(t, rec.Body.String(), "Invalid code", "each recovery code works once")
+}
+
+func TestSecondFactorIsRateLimited(t *testing.T) {
+	setupTest(t)
+	now := fixClock(t, time.Unix(1700000000, 0))
+	register(t, "ann", "ann@example.com")
+	access, _ := login(t, "ann")
+	enroll(t, *now, access)
+
+	rec := postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	mfa := cookieNamed(rec, mfaCookie)
+
+	for i := 0; i < 5; i++ {
+		postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {"000000"}}, mfa)
+	}
+	rec = postForm(SecondFactorHandler, "/login/2fa", url.Values{"code": {"000000"}}, mfa)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestAdminMustEnrollWhenRequired(t *testing.T) {
+	setupTest(t)
+	cfg := config.Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Auth.RequireAdminTOTP = true
+	Configure(cfg, store)
+	now := fixClock(t, time.Unix(1700000000, 0))
+
+	register(t, "ann", "ann@example.com") // the first account is the admin
+	register(t, "bob", "bob@example.com")
+
+	rec := postForm(LoginHandler, "/login", url.Values{"username": {"bob"}, "password": {"Secret123"}})
+	assert.Equal(t, "/dashboard", rec.Header().Get("Location"), "only admins are forced to enroll")
+
+	rec = postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/2fa/setup", rec.Header().Get("Location"))
+	assert.Nil(t, cookieNamed(rec, accessCookie))
+	mfa := cookieNamed(rec, mfaCookie)
+
+	// A login mfa token is not good for enrollment and vice versa.
+	rec = get(SecondFactorHandler, "/login/2fa", mfa)
+	assert.Equal(t, "/login", rec.Header().Get("Location"))
+
+	secret, _, rec := enroll(t, *now, mfa)
+	access := cookieNamed(rec, accessCookie)
+	require.NotNil(t, access, "enrolling completes the login")
+
+	user, err := store.Users.FindByUsername(context.Background(), "ann")
+	require.NoError(t, err)
+	assert.True(t, user.TOTP.Enabled)
+
+	*now = now.Add(totpPeriod)
+	code, err := totpCode(secret, *now)
+	require.NoError(t, err)
+	rec = postForm(TOTPDisableHandler, "/2fa/disable", url.Values{"code": {code}}, access)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "admins cannot opt out while it is required")
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	setupTest(t)
+	now := fixClock(t, time.Unix(1700000000, 0))
+	register(t, "ann", "ann@example.com")
+	access, _ := login(t, "ann")
+	secret, _, _ := enroll(t, *now, access)
+
+	*now = now.Add(totpPeriod)
+	code, err := totpCode(secret, *now)
+	require.NoError(t, err)
+	rec := postForm(TOTPDisableHandler, "/2fa/disable", url.Values{"code": {code}}, access)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Two-factor authentication is off.")
+
+	rec = postForm(LoginHandler, "/login", url.Values{"username": {"ann"}, "password": {"Secret123"}})
+	assert.Equal(t, "/dashboard", rec.Header().Get("Location"))
+}
@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"cheese_market/db"
+	"cheese_market/models"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/time/rate"
+)
+
+// The mfa-token cookie carries a user who passed the password check on to
+// the second step. Its purpose says which step that is.
+const (
+	mfaCookie   = "mfa-token"
+	mfaAudience = "cheese-mfa"
+	mfaTTL      = 5 * time.Minute
+
+	mfaLogin  = "login"
+	mfaEnroll = "enroll"
+
+	recoveryCodeCount = 10
+)
+
+var requireAdminTOTP bool
+
+// mfaLimiter throttles wrong second-factor guesses per user, so the
+// password alone is not enough to brute-force a six-digit code.
+var mfaLimiter = newFailureLimiter(rate.Every(12*time.Second), 5)
+
+type mfaClaims struct {
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// failureLimiter allows each key burst failures, refilled at limit. Only
+// failures are counted, so successful logins never lock a user out.
+type failureLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	limit    rate.Limit
+	burst    int
+}
+
+func newFailureLimiter(limit rate.Limit, burst int) *failureLimiter {
+	return &failureLimiter{limiters: map[string]*rate.Limiter{}, limit: limit, burst: burst}
+}
+
+func (k *failureLimiter) get(key string) *rate.Limiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, ok := k.limiters[key]
+	if !ok {
+		l = rate.NewLimiter(k.limit, k.burst)
+		k.limiters[key] = l
+	}
+	return l
+}
+
+// Blocked reports whether key has used up its failures for now.
+func (k *failureLimiter) Blocked(key string) bool {
+	return k.get(key).Tokens() < 1
+}
+
+// Fail spends one of key's failures.
+func (k *failureLimiter) Fail(key string) {
+	k.get(key).Allow()
+}
+
+// needsSecondStep reports which second step, if any, user must complete
+// before a session is issued.
+func needsSecondStep(user *models.User) string {
+	switch {
+	case user.TOTP.Enabled:
+		return mfaLogin
+	case requireAdminTOTP && user.Role == "admin":
+		return mfaEnroll
+	default:
+		return ""
+	}
+}
+
+func setMFACookie(w http.ResponseWriter, user *models.User, purpose string) error {
+	now := time.Now()
+	claims := mfaClaims{
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID,
+			Audience:  []string{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaCookie,
+		Value:    tokenString,
+		Path:     "/",
+		Expires:  now.Add(mfaTTL),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearMFACookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: mfaCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+// mfaUser loads the user named by a valid mfa-token cookie issued for purpose.
+func mfaUser(r *http.Request, purpose string) (*models.User, error) {
+	cookie, err := r.Cookie(mfaCookie)
+	if err != nil {
+		return nil, errors.New("mfa token not found in cookies")
+	}
+
+	var claims mfaClaims
+	token, err := jwt.ParseWithClaims(cookie.Value, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return secretKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid mfa token")
+	}
+	if !claims.VerifyAudience(mfaAudience, true) || claims.Purpose != purpose {
+		return nil, errors.New("mfa token issued for another step")
+	}
+	return store.Users.FindByID(r.Context(), claims.Subject)
+}
+
+// checkSecondFactor accepts either a current authenticator code or one of
+// the user's recovery codes, and spends it.
+func checkSecondFactor(r *http.Request, user *models.User, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	if strings.Contains(code, "-") {
+		err := store.Users.UseRecoveryCode(r.Context(), user.ID, hashToken(code))
+		if err == nil {
+			log.Printf("User %s signed in with a recovery code", user.Username)
+		}
+		return err == nil
+	}
+
+	step, ok := validateTOTP(user.TOTP.Secret, code, clock())
+	if !ok {
+		return false
+	}
+	// Refuse a code that was already used, even within its time window.
+	return store.Users.UseTOTPCounter(r.Context(), user.ID, step) == nil
+}
+
+// SecondFactorHandler is the second login step for users with two-factor
+// authentication enabled.
+func SecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{}
+
+	user, err := mfaUser(r, mfaLogin)
+	if err != nil {
+		log.Printf("Second factor without a valid mfa token: %v", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		tpl.ExecuteTemplate(w, "login_2fa.html", data)
+		return
+	}
+
+	if mfaLimiter.Blocked(user.ID) {
+		data.ErrorMessage = "Too many attempts. Wait a minute and try again."
+		w.WriteHeader(http.StatusTooManyRequests)
+		tpl.ExecuteTemplate(w, "login_2fa.html", data)
+		return
+	}
+
+	r.ParseForm()
+	if !checkSecondFactor(r, user, r.FormValue("code")) {
+		mfaLimiter.Fail(user.ID)
+		data.ErrorMessage = "Invalid code"
+		tpl.ExecuteTemplate(w, "login_2fa.html", data)
+		log.Printf("Second factor failed for user %s", user.Username)
+		return
+	}
+
+	clearMFACookie(w)
+	if _, err := startSession(w, r, user); err != nil {
+		data.ErrorMessage = "Generation token error"
+		tpl.ExecuteTemplate(w, "login_2fa.html", data)
+		log.Printf("Session creation error for user %s: %v", user.Username, err)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	log.Printf("User %s logged in successfully with a second factor", user.Username)
+}
+
+// enrollingUser finds who is setting up two-factor authentication: a
+// signed-in user, or an admin who must enroll before their login completes.
+func enrollingUser(w http.ResponseWriter, r *http.Request) (user *models.User, viaLogin bool, err error) {
+	if claims, err := authenticate(w, r); err == nil {
+		user, err := store.Users.FindByID(r.Context(), claims.ID)
+		return user, false, err
+	}
+	user, err = mfaUser(r, mfaEnroll)
+	return user, true, err
+}
+
+// TOTPSetupHandler enrolls an authenticator app. GET shows a new secret and
+// its provisioning URI; POST confirms it with a code from the app, enables
+// two-factor authentication and shows the recovery codes once.
+func TOTPSetupHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{}
+
+	user, viaLogin, err := enrollingUser(w, r)
+	if err != nil {
+		log.Printf("Two-factor setup without a session: %v", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if viaLogin {
+		data.Message = "Your account requires two-factor authentication. Set it up to finish logging in."
+	}
+
+	if user.TOTP.Enabled {
+		data.TOTPEnabled = true
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		secret, err := newTOTPSecret()
+		if err == nil {
+			err = store.Users.SetTOTP(r.Context(), user.ID, models.TOTP{PendingSecret: secret})
+		}
+		if err != nil {
+			data.ErrorMessage = "Could not start the setup, please try again"
+			tpl.ExecuteTemplate(w, "totp_setup.html", data)
+			log.Printf("Starting two-factor setup for %s failed: %v", user.Username, err)
+			return
+		}
+		showEnrollment(&data, secret, user.Email)
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	if mfaLimiter.Blocked(user.ID) {
+		data.ErrorMessage = "Too many attempts. Wait a minute and try again."
+		w.WriteHeader(http.StatusTooManyRequests)
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	r.ParseForm()
+	secret := user.TOTP.PendingSecret
+	step, ok := validateTOTP(secret, strings.TrimSpace(r.FormValue("code")), clock())
+	if secret == "" || !ok {
+		mfaLimiter.Fail(user.ID)
+		data.ErrorMessage = "The code does not match. Check the time on your phone and try again."
+		showEnrollment(&data, secret, user.Email)
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = store.Users.SetTOTP(r.Context(), user.ID, models.TOTP{
+			Enabled:       true,
+			Secret:        secret,
+			RecoveryCodes: hashes,
+			LastCounter:   step,
+		})
+	}
+	if err != nil {
+		data.ErrorMessage = "Could not enable two-factor authentication, please try again"
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		log.Printf("Enabling two-factor authentication for %s failed: %v", user.Username, err)
+		return
+	}
+	log.Printf("User %s enabled two-factor authentication", user.Username)
+
+	if viaLogin {
+		clearMFACookie(w)
+		if _, err := startSession(w, r, user); err != nil {
+			log.Printf("Session creation error for user %s: %v", user.Username, err)
+		}
+	}
+
+	data.Message = "Two-factor authentication is on. Store these recovery codes somewhere safe; each works once and they are not shown again."
+	data.RecoveryCodes = codes
+	tpl.ExecuteTemplate(w, "totp_setup.html", data)
+}
+
+// showEnrollment fills in what the setup page needs to add secret to an
+// authenticator app. Without a QR code the page still shows the URI and the
+// key to type in.
+func showEnrollment(data *PageData, secret, account string) {
+	data.Secret = secret
+	data.ProvisioningURI = provisioningURI(secret, account)
+	qr, err := qrCode(data.ProvisioningURI)
+	if err != nil {
+		log.Printf("Rendering the two-factor QR code failed: %v", err)
+	}
+	data.QRCode = qr
+}
+
+// TOTPDisableHandler turns two-factor authentication off after checking a
+// current code. Admins cannot turn it off while it is required for them.
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data := PageData{TOTPEnabled: true}
+
+	claims, err := authenticate(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	user, err := store.Users.FindByID(r.Context(), claims.ID)
+	if err != nil {
+		log.Printf("Loading user %s failed: %v", claims.Username, err)
+		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		return
+	}
+	if !user.TOTP.Enabled {
+		http.Redirect(w, r, "/2fa/setup", http.StatusSeeOther)
+		return
+	}
+	if requireAdminTOTP && user.Role == "admin" {
+		data.ErrorMessage = "Two-factor authentication is required for administrators"
+		w.WriteHeader(http.StatusForbidden)
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+	if mfaLimiter.Blocked(user.ID) {
+		data.ErrorMessage = "Too many attempts. Wait a minute and try again."
+		w.WriteHeader(http.StatusTooManyRequests)
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	r.ParseForm()
+	if !checkSecondFactor(r, user, r.FormValue("code")) {
+		mfaLimiter.Fail(user.ID)
+		data.ErrorMessage = "Invalid code"
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+
+	if err := store.Users.SetTOTP(r.Context(), user.ID, models.TOTP{}); err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Disabling two-factor authentication for %s failed: %v", user.Username, err)
+		}
+		data.ErrorMessage = "Could not disable two-factor authentication, please try again"
+		tpl.ExecuteTemplate(w, "totp_setup.html", data)
+		return
+	}
+	log.Printf("User %s disabled two-factor authentication", user.Username)
+
+	data = PageData{Message: "Two-factor authentication is off."}
+	tpl.ExecuteTemplate(w, "totp_setup.html", data)
+}
@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+)
+
+// Policies for handing new chats to admins automatically. With
+// AssignManual chats wait in the queue until an admin claims them.
+const (
+	AssignManual      = ""
+	AssignRoundRobin  = "round_robin"
+	AssignLeastLoaded = "least_loaded"
+)
+
+// Assigner picks the admin a new chat goes to.
+type Assigner struct {
+	policy string
+
+	mu   sync.Mutex
+	last string // admin that got the previous chat
+}
+
+func NewAssigner(policy string) *Assigner {
+	return &Assigner{policy: policy}
+}
+
+// Pick chooses one of the online admins for a new chat. load holds the
+// number of open chats each admin has. It reports false if chats are
+// assigned manually or no admin is online.
+//
+// Round robin takes the admins in turn; least loaded takes the admin with
+// the fewest open chats, in turn among equals.
+func (a *Assigner) Pick(online []Identity, load map[string]int) (Identity, bool) {
+	if a.policy == AssignManual || len(online) == 0 {
+		return Identity{}, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Start the turn right after whoever got the previous chat.
+	admins := append([]Identity(nil), online...)
+	sort.Slice(admins, func(i, j int) bool { return admins[i].ID < admins[j].ID })
+	start := sort.Search(len(admins), func(i int) bool { return admins[i].ID > a.last })
+	admins = append(admins[start:], admins[:start]...)
+
+	picked := admins[0]
+	if a.policy == AssignLeastLoaded {
+		for _, admin := range admins[1:] {
+			if load[admin.ID] < load[picked.ID] {
+				picked = admin
+			}
+		}
+	}
+	a.last = picked.ID
+	return picked, true
+}
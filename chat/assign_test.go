@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var admins = []Identity{{ID: "c", Role: "admin"}, {ID: "a", Role: "admin"}, {ID: "b", Role: "admin"}}
+
+func picks(a *Assigner, n int, load map[string]int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		admin, ok := a.Pick(admins, load)
+		if !ok {
+			return ids
+		}
+		ids = append(ids, admin.ID)
+		if load != nil {
+			load[admin.ID]++
+		}
+	}
+	return ids
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := NewAssigner(AssignRoundRobin)
+	assert.Equal(t, []string{"a", "b", "c", "a", "b"}, picks(a, 5, nil))
+}
+
+func TestLeastLoaded(t *testing.T) {
+	a := NewAssigner(AssignLeastLoaded)
+	load := map[string]int{"a": 3, "b": 1}
+	// c has nothing, then c and b are level, then everyone but a is.
+	assert.Equal(t, []string{"c", "b", "c", "b", "c"}, picks(a, 5, load))
+}
+
+func TestManualAndNobodyOnline(t *testing.T) {
+	_, ok := NewAssigner(AssignManual).Pick(admins, nil)
+	assert.False(t, ok)
+
+	_, ok = NewAssigner(AssignRoundRobin).Pick(nil, nil)
+	assert.False(t, ok)
+}
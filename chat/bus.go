@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"context"
+	"sync"
+)
+
+// Bus carries published events between the hubs of every server instance,
+// so a message sent through one replica reaches members connected to
+// another. Every hub subscribes, including the one that published.
+type Bus interface {
+	// Publish sends msg, already encoded, to the subscribers of room.
+	Publish(ctx context.Context, room string, msg []byte) error
+	// PublishStored sends msg, the event for a chat message the caller has
+	// just stored, to the subscribers of room. A bus that follows stored
+	// messages itself may deliver it from there instead.
+	PublishStored(ctx context.Context, room string, msg []byte) error
+	// Subscribe calls deliver for every event published from the time it
+	// returns until ctx is done. deliver is called from one goroutine at a
+	// time, in publishing order.
+	Subscribe(ctx context.Context, deliver func(room string, msg []byte)) error
+}
+
+// LocalBus connects the hubs of a single process. It is enough when only
+// one instance of the server runs.
+type LocalBus struct {
+	mu   sync.Mutex
+	subs map[*localSub]bool
+}
+
+type localSub struct {
+	// mu serialises deliveries to one subscriber.
+	mu      sync.Mutex
+	deliver func(room string, msg []byte)
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{subs: map[*localSub]bool{}}
+}
+
+func (b *LocalBus) Publish(ctx context.Context, room string, msg []byte) error {
+	b.mu.Lock()
+	subs := make([]*localSub, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.mu.Lock()
+		s.deliver(room, msg)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *LocalBus) PublishStored(ctx context.Context, room string, msg []byte) error {
+	return b.Publish(ctx, room, msg)
+}
+
+func (b *LocalBus) Subscribe(ctx context.Context, deliver func(room string, msg []byte)) error {
+	s := &localSub{deliver: deliver}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}()
+	return nil
+}
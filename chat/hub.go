@@ -0,0 +1,377 @@
+// Package chat runs the support chat over WebSockets. A single Hub goroutine
+// owns the set of connected clients and the rooms they have joined; every
+// connection has its own write pump fed by a buffered queue, so no two
+// goroutines ever write to the same *websocket.Conn and a slow reader cannot
+// stall everybody else. Published events travel over a Bus, so hubs in
+// different server instances can serve the same rooms.
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendQueue is how many outgoing messages a client may have pending
+	// before it is considered too slow and disconnected.
+	sendQueue = 64
+	// writeWait bounds a single write to the peer.
+	writeWait = 10 * time.Second
+	// maxMessageSize bounds a single message from the peer.
+	maxMessageSize = 16 << 10
+	// pongWait is how long a client may stay silent, not even answering a
+	// ping, before it is considered gone. Pings go out a little more often.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+)
+
+// Lobby is the room admins join to hear about chats being opened and
+// closed. Chat rooms are named by chat ID, which never collides with it.
+const Lobby = "lobby"
+
+// Handler is called for every message a client sends. It runs on the
+// client's read goroutine, so messages from one client are handled in order.
+type Handler func(c *Client, msg map[string]string)
+
+// Hub tracks connected clients and the rooms they have joined, and fans
+// messages out to the members of a room.
+type Hub struct {
+	register   chan *Client
+	unregister chan *Client
+	membership chan membership
+	members    chan membersQuery
+	publish    chan envelope
+	done       chan struct{}
+
+	// clients maps every connected client to the rooms it has joined.
+	clients map[*Client]map[string]bool
+	rooms   map[string]map[*Client]bool
+
+	bus                  Bus
+	pongWait, pingPeriod time.Duration
+}
+
+type membership struct {
+	client *Client
+	room   string
+	join   bool
+}
+
+type membersQuery struct {
+	room  string
+	reply chan []Identity
+}
+
+type envelope struct {
+	room string
+	msg  []byte
+}
+
+func NewHub(bus Bus) *Hub {
+	return &Hub{
+		bus:        bus,
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		membership: make(chan membership),
+		members:    make(chan membersQuery),
+		publish:    make(chan envelope, sendQueue),
+		done:       make(chan struct{}),
+		clients:    map[*Client]map[string]bool{},
+		rooms:      map[string]map[*Client]bool{},
+		pongWait:   pongWait,
+		pingPeriod: pingPeriod,
+	}
+}
+
+// Start subscribes the hub to its bus and then runs it in the background
+// until ctx is cancelled. Every event, local ones included, arrives through
+// the bus, so a hub that cannot subscribe would deliver nothing; Start
+// returns the error instead of running it.
+func (h *Hub) Start(ctx context.Context) error {
+	if err := h.bus.Subscribe(ctx, h.deliver); err != nil {
+		return fmt.Errorf("chat: could not subscribe to the bus: %w", err)
+	}
+	go h.run(ctx)
+	return nil
+}
+
+// run owns the client set until ctx is cancelled, then disconnects everyone.
+// Events from the bus are delivered to the members of their room here.
+func (h *Hub) run(ctx context.Context) {
+	defer close(h.done)
+	for {
+		select {
+		case <-ctx.Done():
+			for c := range h.clients {
+				h.remove(c)
+			}
+			return
+		case c := <-h.register:
+			h.clients[c] = map[string]bool{}
+		case c := <-h.unregister:
+			h.remove(c)
+		case m := <-h.membership:
+			if m.join {
+				h.join(m.client, m.room)
+			} else {
+				h.leave(m.client, m.room)
+			}
+		case q := <-h.members:
+			q.reply <- h.identities(q.room)
+		case e := <-h.publish:
+			for c := range h.rooms[e.room] {
+				if !c.enqueue(e.msg) {
+					log.Printf("chat: dropping slow client %s", c.conn.RemoteAddr())
+					h.remove(c)
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) join(c *Client, room string) {
+	rooms, ok := h.clients[c]
+	if !ok {
+		return
+	}
+	rooms[room] = true
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*Client]bool{}
+	}
+	h.rooms[room][c] = true
+}
+
+func (h *Hub) leave(c *Client, room string) {
+	delete(h.clients[c], room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// identities lists the users in room, once each however many connections
+// they have open.
+func (h *Hub) identities(room string) []Identity {
+	seen := map[string]bool{}
+	var users []Identity
+	for c := range h.rooms[room] {
+		if !seen[c.User.ID] {
+			seen[c.User.ID] = true
+			users = append(users, c.User)
+		}
+	}
+	return users
+}
+
+func (h *Hub) remove(c *Client) {
+	rooms, ok := h.clients[c]
+	if !ok {
+		return
+	}
+	for room := range rooms {
+		h.leave(c, room)
+	}
+	delete(h.clients, c)
+	c.close()
+}
+
+// Join subscribes c to room. Messages published after Join returns reach c.
+func (h *Hub) Join(c *Client, room string) {
+	h.changeMembership(membership{client: c, room: room, join: true})
+}
+
+// Leave unsubscribes c from room.
+func (h *Hub) Leave(c *Client, room string) {
+	h.changeMembership(membership{client: c, room: room})
+}
+
+func (h *Hub) changeMembership(m membership) {
+	select {
+	case h.membership <- m:
+	case <-h.done:
+	}
+}
+
+// Members returns the users connected to this hub who are in room.
+func (h *Hub) Members(room string) []Identity {
+	q := membersQuery{room: room, reply: make(chan []Identity, 1)}
+	select {
+	case h.members <- q:
+		return <-q.reply
+	case <-h.done:
+		return nil
+	}
+}
+
+// Publish sends v as JSON to every member of room, on this hub and every
+// other hub on the bus.
+func (h *Hub) Publish(room string, v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.bus.Publish(context.Background(), room, msg)
+}
+
+// PublishStored is Publish for the event announcing a chat message that has
+// already been stored.
+func (h *Hub) PublishStored(room string, v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.bus.PublishStored(context.Background(), room, msg)
+}
+
+// deliver hands an event from the bus to Run.
+func (h *Hub) deliver(room string, msg []byte) {
+	select {
+	case h.publish <- envelope{room: room, msg: msg}:
+	case <-h.done:
+	}
+}
+
+// Serve registers conn, authenticated as user, with the hub and reads from
+// it until the peer goes away, passing every message to handle. It closes
+// conn before returning.
+func (h *Hub) Serve(conn *websocket.Conn, user Identity, handle Handler) {
+	c := &Client{User: user, hub: h, conn: conn, send: make(chan []byte, sendQueue)}
+	select {
+	case h.register <- c:
+	case <-h.done:
+		conn.Close()
+		return
+	}
+
+	go c.writePump()
+	c.readPump(handle)
+}
+
+// Identity is the user a connection was authenticated as when it was
+// upgraded. Handlers trust it instead of anything the client sends.
+type Identity struct {
+	ID       string
+	Username string
+	Role     string
+}
+
+func (i Identity) IsAdmin() bool {
+	return i.Role == "admin"
+}
+
+// Client is one WebSocket connection.
+type Client struct {
+	User Identity
+
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+
+	// mu guards closed so that send is never written after it is closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Send queues v as JSON for this client only. A client whose queue is full
+// is disconnected rather than allowed to block the caller.
+func (c *Client) Send(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue(msg) {
+		c.disconnect()
+	}
+	return nil
+}
+
+func (c *Client) enqueue(msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the write pump. Only the hub calls it.
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+func (c *Client) disconnect() {
+	select {
+	case c.hub.unregister <- c:
+	case <-c.hub.done:
+	}
+}
+
+func (c *Client) readPump(handle Handler) {
+	defer func() {
+		c.disconnect()
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+	})
+
+	for {
+		var msg map[string]string
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("chat: read error: %v", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+		handle(c, msg)
+	}
+}
+
+// writePump is the only goroutine that writes to conn. Besides the queued
+// messages it sends the heartbeat pings; a peer that stops answering them
+// times out in readPump.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the queue: say goodbye and hang up.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
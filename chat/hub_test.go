@@ -0,0 +1,316 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startHub serves a hub at a test server. handle gets every client message.
+func startHub(t *testing.T, handle Handler) (*Hub, string) {
+	t.Helper()
+	return serveHub(t, NewHub(NewLocalBus()), handle)
+}
+
+func serveHub(t *testing.T, hub *Hub, handle Handler) (*Hub, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, hub.Start(ctx))
+
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		hub.Serve(conn, Identity{ID: "u1", Username: "tester", Role: "user"}, handle)
+	}))
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+	})
+	return hub, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// hello waits until the server has registered conn.
+func hello(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "hello"}))
+	var reply map[string]string
+	require.NoError(t, conn.ReadJSON(&reply))
+	require.Equal(t, "ready", reply["type"])
+}
+
+func TestConcurrentBroadcast(t *testing.T) {
+	var hub *Hub
+	hub, url := startHub(t, func(c *Client, msg map[string]string) {
+		if msg["type"] == "hello" {
+			hub.Join(c, "room")
+			c.Send(map[string]string{"type": "ready"})
+			return
+		}
+		hub.Publish("room", msg)
+	})
+
+	const n = 20
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		conns[i] = dial(t, url)
+		hello(t, conns[i])
+	}
+
+	// Every client talks at once; everyone must hear everyone.
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			assert.NoError(t, conn.WriteJSON(map[string]string{"type": "say"}))
+
+			for j := 0; j < n; j++ {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				var msg map[string]string
+				if !assert.NoError(t, conn.ReadJSON(&msg), "client %d message %d", i, j) {
+					return
+				}
+				assert.Equal(t, "say", msg["type"])
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+}
+
+func TestSlowClientIsEvicted(t *testing.T) {
+	var hub *Hub
+	clients := make(chan *Client, 2)
+	hub, url := startHub(t, func(c *Client, msg map[string]string) {
+		hub.Join(c, "room")
+		clients <- c
+		c.Send(map[string]string{"type": "ready"})
+	})
+
+	slow := dial(t, url)
+	hello(t, slow)
+	slowClient := <-clients
+
+	fast := dial(t, url)
+	hello(t, fast)
+	<-clients
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for {
+			fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var msg map[string]string
+			if err := fast.ReadJSON(&msg); err != nil || msg["type"] == "last" {
+				received <- count
+				return
+			}
+			count++
+		}
+	}()
+
+	// The slow client never reads, so its socket buffers and then its
+	// queue fill up, and the hub must let it go.
+	payload := strings.Repeat("x", 64<<10)
+	sent := 0
+	for ; sent < 4000 && !isClosed(slowClient); sent++ {
+		require.NoError(t, hub.Publish("room", map[string]string{"type": "bulk", "content": payload}))
+		time.Sleep(200 * time.Microsecond)
+	}
+	require.True(t, isClosed(slowClient), "slow client was not evicted after %d messages", sent)
+
+	// The fast client is unaffected and got every message.
+	require.NoError(t, hub.Publish("room", map[string]string{"type": "last"}))
+	assert.Equal(t, sent, <-received)
+}
+
+func TestPublishOnlyReachesRoomMembers(t *testing.T) {
+	var hub *Hub
+	hub, url := startHub(t, func(c *Client, msg map[string]string) {
+		switch msg["type"] {
+		case "join":
+			hub.Join(c, msg["room"])
+		case "leave":
+			hub.Leave(c, msg["room"])
+		case "say":
+			hub.Publish(msg["room"], msg)
+			return
+		}
+		c.Send(map[string]string{"type": "ready"})
+	})
+
+	join := func(conn *websocket.Conn, typ, room string) {
+		t.Helper()
+		require.NoError(t, conn.WriteJSON(map[string]string{"type": typ, "room": room}))
+		var reply map[string]string
+		require.NoError(t, conn.ReadJSON(&reply))
+	}
+	alice, bob, admin := dial(t, url), dial(t, url), dial(t, url)
+	join(alice, "join", "a")
+	join(bob, "join", "b")
+	join(admin, "join", "a")
+	join(admin, "join", "b")
+
+	require.NoError(t, alice.WriteJSON(map[string]string{"type": "say", "room": "a", "content": "for a"}))
+	require.NoError(t, bob.WriteJSON(map[string]string{"type": "say", "room": "b", "content": "for b"}))
+
+	read := func(conn *websocket.Conn) string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg map[string]string
+		require.NoError(t, conn.ReadJSON(&msg))
+		return msg["content"]
+	}
+	assert.Equal(t, "for a", read(alice))
+	assert.Equal(t, "for b", read(bob))
+	assert.ElementsMatch(t, []string{"for a", "for b"}, []string{read(admin), read(admin)})
+
+	// After leaving, the admin no longer hears room a. Each client's next
+	// message shows what it did not receive in between.
+	join(admin, "leave", "a")
+	require.NoError(t, alice.WriteJSON(map[string]string{"type": "say", "room": "a", "content": "again"}))
+	require.NoError(t, bob.WriteJSON(map[string]string{"type": "say", "room": "b", "content": "marker"}))
+	assert.Equal(t, "again", read(alice), "alice must not hear room b")
+	assert.Equal(t, "marker", read(admin))
+}
+
+func isClosed(c *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestSendAfterCloseDoesNotPanic(t *testing.T) {
+	clients := make(chan *Client, 1)
+	_, url := startHub(t, func(c *Client, msg map[string]string) {
+		clients <- c
+		c.Send(map[string]string{"type": "ready"})
+	})
+
+	conn := dial(t, url)
+	hello(t, conn)
+	c := <-clients
+	conn.Close()
+
+	require.Eventually(t, func() bool { return isClosed(c) }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, c.Send(map[string]string{"type": "late"}))
+}
+
+func TestMembersListsEachUserOnce(t *testing.T) {
+	var hub *Hub
+	hub, url := startHub(t, func(c *Client, msg map[string]string) {
+		hub.Join(c, "lobby")
+		c.Send(map[string]string{"type": "ready"})
+	})
+	assert.Empty(t, hub.Members("lobby"))
+
+	// Two tabs of the same user.
+	hello(t, dial(t, url))
+	hello(t, dial(t, url))
+	members := hub.Members("lobby")
+	require.Len(t, members, 1)
+	assert.Equal(t, "u1", members[0].ID)
+}
+
+func TestHeartbeatDropsSilentClients(t *testing.T) {
+	hub := NewHub(NewLocalBus())
+	hub.pongWait, hub.pingPeriod = 300*time.Millisecond, 100*time.Millisecond
+
+	clients := make(chan *Client, 2)
+	_, url := serveHub(t, hub, func(c *Client, msg map[string]string) {
+		clients <- c
+		c.Send(map[string]string{"type": "ready"})
+	})
+
+	// The live client keeps reading, which answers the pings for it.
+	live := dial(t, url)
+	hello(t, live)
+	liveClient := <-clients
+	pings := make(chan struct{}, 16)
+	live.SetPingHandler(func(data string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return live.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := live.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The dead client stops reading, as if its network had gone away.
+	dead := dial(t, url)
+	hello(t, dead)
+	deadClient := <-clients
+
+	require.Eventually(t, func() bool { return isClosed(deadClient) }, 2*time.Second, 20*time.Millisecond)
+	assert.NotEmpty(t, pings, "the server pings its clients")
+	assert.False(t, isClosed(liveClient), "a client that answers pings stays connected")
+}
+
+func TestHubsShareRoomsOverTheBus(t *testing.T) {
+	// Two server instances on one bus.
+	bus := NewLocalBus()
+	handle := func(hub **Hub) Handler {
+		return func(c *Client, msg map[string]string) {
+			if msg["type"] == "hello" {
+				(*hub).Join(c, "room")
+				c.Send(map[string]string{"type": "ready"})
+				return
+			}
+			(*hub).Publish("room", msg)
+		}
+	}
+	var first, second *Hub
+	first, firstURL := serveHub(t, NewHub(bus), handle(&first))
+	second, secondURL := serveHub(t, NewHub(bus), handle(&second))
+
+	alice := dial(t, firstURL)
+	hello(t, alice)
+	bob := dial(t, secondURL)
+	hello(t, bob)
+
+	require.NoError(t, alice.WriteJSON(map[string]string{"type": "say", "content": "hi bob"}))
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg map[string]string
+		require.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "hi bob", msg["content"])
+	}
+}
+
+// deafBus is a bus whose subscription never works, like a MongoBus on a
+// server that is not a replica set.
+type deafBus struct{ *LocalBus }
+
+func (deafBus) Subscribe(ctx context.Context, deliver func(room string, msg []byte)) error {
+	return errors.New("change streams are only supported on replica sets")
+}
+
+func TestStartFailsWithoutSubscription(t *testing.T) {
+	hub := NewHub(deafBus{NewLocalBus()})
+	assert.ErrorContains(t, hub.Start(context.Background()), "replica sets")
+}
@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBus connects the hubs of several server instances through MongoDB
+// change streams. Chat messages are already stored in the messages
+// collection, so every instance follows that collection's inserts and turns
+// each new message into an event. Events that have no document of their own
+// (typing, receipts, assignments) are inserted into a separate events
+// collection, which only needs to keep them while the stream delivers them
+// and should expire them by created_at. Both collections are followed by one
+// stream so events arrive in the order they were written. Change streams
+// need a replica set (a single-node one will do).
+type MongoBus struct {
+	events   *mongo.Collection
+	messages *mongo.Collection
+	// convert turns an inserted message document into its room and event.
+	convert func(doc bson.Raw) (room string, msg []byte, err error)
+	timeout time.Duration
+}
+
+type busEvent struct {
+	Room      string    `bson:"room"`
+	Msg       string    `bson:"msg"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// NewMongoBus follows events and messages, which must belong to the same
+// database.
+func NewMongoBus(events, messages *mongo.Collection, convert func(doc bson.Raw) (room string, msg []byte, err error), timeout time.Duration) *MongoBus {
+	return &MongoBus{events: events, messages: messages, convert: convert, timeout: timeout}
+}
+
+func (b *MongoBus) Publish(ctx context.Context, room string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	_, err := b.events.InsertOne(ctx, busEvent{Room: room, Msg: string(msg), CreatedAt: time.Now()})
+	return err
+}
+
+// PublishStored does nothing: the message's insert into the messages
+// collection is delivered by the change stream.
+func (b *MongoBus) PublishStored(ctx context.Context, room string, msg []byte) error {
+	return nil
+}
+
+// Subscribe opens the change stream before returning, so no event published
+// afterwards is missed. If the stream breaks it is reopened where it left
+// off.
+func (b *MongoBus) Subscribe(ctx context.Context, deliver func(room string, msg []byte)) error {
+	stream, err := b.watch(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		backoff := time.Second
+		for {
+			for stream.Next(ctx) {
+				backoff = time.Second
+				room, msg, err := b.decode(stream.Current)
+				if err != nil {
+					log.Printf("chat: skipping undecodable bus event: %v", err)
+					continue
+				}
+				deliver(room, msg)
+			}
+			resumeAfter := stream.ResumeToken()
+			if err := stream.Err(); err != nil && ctx.Err() == nil {
+				log.Printf("chat: change stream failed, reopening: %v", err)
+			}
+			stream.Close(context.Background())
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if stream, err = b.watch(ctx, resumeAfter); err == nil {
+					break
+				}
+				log.Printf("chat: could not reopen change stream: %v", err)
+				backoff = min(backoff*2, time.Minute)
+			}
+		}
+	}()
+	return nil
+}
+
+// decode reads the room and event out of a change, whichever collection it
+// came from.
+func (b *MongoBus) decode(change bson.Raw) (string, []byte, error) {
+	var c struct {
+		NS struct {
+			Coll string `bson:"coll"`
+		} `bson:"ns"`
+		FullDocument bson.Raw `bson:"fullDocument"`
+	}
+	if err := bson.Unmarshal(change, &c); err != nil {
+		return "", nil, err
+	}
+	if c.NS.Coll == b.messages.Name() {
+		return b.convert(c.FullDocument)
+	}
+	var event busEvent
+	if err := bson.Unmarshal(c.FullDocument, &event); err != nil {
+		return "", nil, err
+	}
+	return event.Room, []byte(event.Msg), nil
+}
+
+func (b *MongoBus) watch(ctx context.Context, resumeAfter bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": "insert",
+		"ns.coll":       bson.M{"$in": bson.A{b.events.Name(), b.messages.Name()}},
+	}}}}
+	opts := options.ChangeStream()
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	return b.events.Database().Watch(ctx, pipeline, opts)
+}
@@ -0,0 +1,474 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile is the environment variable that points at an optional config file.
+const EnvFile = "CHEESE_CONFIG"
+
+type Config struct {
+	Server   Server   `yaml:"server" json:"server"`
+	Payment  Payment  `yaml:"payment" json:"payment"`
+	Mongo    Mongo    `yaml:"mongo" json:"mongo"`
+	JWT      JWT      `yaml:"jwt" json:"jwt"`
+	Auth     Auth     `yaml:"auth" json:"auth"`
+	Mail     Mail     `yaml:"mail" json:"mail"`
+	Outbox   Outbox   `yaml:"outbox" json:"outbox"`
+	Checkout Checkout `yaml:"checkout" json:"checkout"`
+	SMTP     SMTP     `yaml:"smtp" json:"smtp"`
+	Chat     Chat     `yaml:"chat" json:"chat"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// PublicURL is the address users reach the shop at; links in emails
+	// point there.
+	PublicURL string `yaml:"public_url" json:"public_url"`
+}
+
+type Auth struct {
+	// ResetTTL is how long a password reset link stays valid.
+	ResetTTL Duration `yaml:"reset_ttl" json:"reset_ttl"`
+	// CodeTTL is how long an email verification code stays valid.
+	CodeTTL Duration `yaml:"code_ttl" json:"code_ttl"`
+	// CodeMaxAttempts wrong guesses lock a verification code until a new
+	// one is requested.
+	CodeMaxAttempts int `yaml:"code_max_attempts" json:"code_max_attempts"`
+	// ResendCooldown is the minimum time between two verification emails.
+	ResendCooldown Duration `yaml:"resend_cooldown" json:"resend_cooldown"`
+	// RequireAdminTOTP makes admins enroll an authenticator app before
+	// their first login completes.
+	RequireAdminTOTP bool `yaml:"require_admin_totp" json:"require_admin_totp"`
+}
+
+type Payment struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// PublicURL is where the main server sends customers to pay for an order.
+	PublicURL string `yaml:"public_url" json:"public_url"`
+}
+
+type Mongo struct {
+	URI            string   `yaml:"uri" json:"uri"`
+	Database       string   `yaml:"database" json:"database"`
+	MaxPoolSize    int      `yaml:"max_pool_size" json:"max_pool_size"`
+	MinPoolSize    int      `yaml:"min_pool_size" json:"min_pool_size"`
+	ConnectTimeout Duration `yaml:"connect_timeout" json:"connect_timeout"`
+	// QueryTimeout bounds every single repository call.
+	QueryTimeout   Duration `yaml:"query_timeout" json:"query_timeout"`
+	ReadPreference string   `yaml:"read_preference" json:"read_preference"`
+	// Transactions groups related writes (e.g. a new user and its
+	// verification email) in multi-document transactions. It requires a
+	// replica set.
+	Transactions bool `yaml:"transactions" json:"transactions"`
+}
+
+type JWT struct {
+	Secret string `yaml:"secret" json:"secret"`
+	// AccessTTL is the lifetime of the access token cookie. It is kept short
+	// because the token is only checked against the session store, not
+	// re-issued, until it expires.
+	AccessTTL Duration `yaml:"access_ttl" json:"access_ttl"`
+	// RefreshTTL is how long a session survives without being used.
+	RefreshTTL Duration `yaml:"refresh_ttl" json:"refresh_ttl"`
+}
+
+type Outbox struct {
+	// Worker enables the background delivery loop in this process.
+	Worker       bool     `yaml:"worker" json:"worker"`
+	PollInterval Duration `yaml:"poll_interval" json:"poll_interval"`
+	MaxAttempts  int      `yaml:"max_attempts" json:"max_attempts"`
+	// Retries wait BaseBackoff, then twice as long each time, up to MaxBackoff.
+	BaseBackoff Duration `yaml:"base_backoff" json:"base_backoff"`
+	MaxBackoff  Duration `yaml:"max_backoff" json:"max_backoff"`
+	// Lease is how long a worker may hold an entry before another worker
+	// is allowed to pick it up again.
+	Lease Duration `yaml:"lease" json:"lease"`
+}
+
+type Checkout struct {
+	// ReservationTTL is how long stock stays reserved for an unpaid order
+	// before it goes back on sale.
+	ReservationTTL Duration `yaml:"reservation_ttl" json:"reservation_ttl"`
+	// SweepInterval is how often expired reservations are looked for.
+	SweepInterval Duration `yaml:"sweep_interval" json:"sweep_interval"`
+}
+
+type Chat struct {
+	// AllowedOrigins lists extra origins (scheme://host[:port]) whose pages
+	// may open the chat WebSocket. The shop's own origin is always allowed.
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins"`
+	// AutoAssign hands new chats to online admins: "" leaves them in the
+	// queue to be claimed, "round_robin" takes admins in turn and
+	// "least_loaded" picks the admin with the fewest open chats.
+	AutoAssign string `yaml:"auto_assign" json:"auto_assign"`
+	// Bus carries chat events between server instances: "local" when only
+	// one instance runs, "mongodb" to fan out through a change stream on the
+	// messages and chat_events collections, which needs a replica set.
+	Bus string `yaml:"bus" json:"bus"`
+}
+
+type Mail struct {
+	// Backend is one of "smtp", "file" (write .eml files to Dir) or
+	// "capture" (keep messages in memory, for tests).
+	Backend string `yaml:"backend" json:"backend"`
+	From    string `yaml:"from" json:"from"`
+	Dir     string `yaml:"dir" json:"dir"`
+}
+
+type SMTP struct {
+	Host     string `yaml:"host" json:"host"`
+	Port     int    `yaml:"port" json:"port"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// TLS is "starttls" (upgrade a plain connection) or "tls" (implicit TLS,
+	// usually port 465).
+	TLS                string `yaml:"tls" json:"tls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// Default returns the settings used when neither the file nor the
+// environment provide a value. Secrets have no defaults on purpose.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:      ":8080",
+			PublicURL: "http://localhost:8080",
+		},
+		Payment: Payment{
+			Addr:      ":8082",
+			PublicURL: "http://localhost:8082",
+		},
+		JWT: JWT{
+			AccessTTL:  Duration(15 * time.Minute),
+			RefreshTTL: Duration(7 * 24 * time.Hour),
+		},
+		Auth: Auth{
+			ResetTTL:        Duration(time.Hour),
+			CodeTTL:         Duration(15 * time.Minute),
+			CodeMaxAttempts: 5,
+			ResendCooldown:  Duration(time.Minute),
+		},
+		Mongo: Mongo{
+			URI:            "mongodb://localhost:27017",
+			Database:       "cheeseMarket",
+			MaxPoolSize:    50,
+			ConnectTimeout: Duration(10 * time.Second),
+			QueryTimeout:   Duration(5 * time.Second),
+			ReadPreference: "primary",
+		},
+		Mail: Mail{
+			Backend: "smtp",
+			Dir:     "mail_outbox",
+		},
+		Outbox: Outbox{
+			Worker:       true,
+			PollInterval: Duration(2 * time.Second),
+			MaxAttempts:  8,
+			BaseBackoff:  Duration(30 * time.Second),
+			MaxBackoff:   Duration(time.Hour),
+			Lease:        Duration(2 * time.Minute),
+		},
+		Checkout: Checkout{
+			ReservationTTL: Duration(15 * time.Minute),
+			SweepInterval:  Duration(time.Minute),
+		},
+		SMTP: SMTP{
+			Port: 587,
+			TLS:  "starttls",
+		},
+		Chat: Chat{
+			Bus: "local",
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the optional file at path
+// (falling back to $CHEESE_CONFIG) and environment variables, in that order,
+// and validates the result for the shop server.
+func Load(path string) (*Config, error) {
+	return load(path, (*Config).Validate)
+}
+
+// LoadPayment is Load for the payment service. It signs and checks no
+// tokens, so it starts without jwt.secret.
+func LoadPayment(path string) (*Config, error) {
+	return load(path, (*Config).ValidatePayment)
+}
+
+func load(path string, validate func(*Config) error) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv(EnvFile)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: failed to read %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("config: unsupported file extension %q (use .yaml, .yml or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("config: failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// envVar binds an environment variable to a field of the configuration.
+type envVar struct {
+	name string
+	dst  interface{}
+}
+
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"CHEESE_SERVER_ADDR", &c.Server.Addr},
+		{"CHEESE_SERVER_PUBLIC_URL", &c.Server.PublicURL},
+		{"CHEESE_PAYMENT_ADDR", &c.Payment.Addr},
+		{"CHEESE_PAYMENT_PUBLIC_URL", &c.Payment.PublicURL},
+		{"CHEESE_MONGO_URI", &c.Mongo.URI},
+		{"CHEESE_MONGO_DATABASE", &c.Mongo.Database},
+		{"CHEESE_MONGO_MAX_POOL_SIZE", &c.Mongo.MaxPoolSize},
+		{"CHEESE_MONGO_MIN_POOL_SIZE", &c.Mongo.MinPoolSize},
+		{"CHEESE_MONGO_CONNECT_TIMEOUT", &c.Mongo.ConnectTimeout},
+		{"CHEESE_MONGO_QUERY_TIMEOUT", &c.Mongo.QueryTimeout},
+		{"CHEESE_MONGO_READ_PREFERENCE", &c.Mongo.ReadPreference},
+		{"CHEESE_MONGO_TRANSACTIONS", &c.Mongo.Transactions},
+		{"CHEESE_JWT_SECRET", &c.JWT.Secret},
+		{"CHEESE_JWT_ACCESS_TTL", &c.JWT.AccessTTL},
+		{"CHEESE_JWT_REFRESH_TTL", &c.JWT.RefreshTTL},
+		{"CHEESE_AUTH_RESET_TTL", &c.Auth.ResetTTL},
+		{"CHEESE_AUTH_CODE_TTL", &c.Auth.CodeTTL},
+		{"CHEESE_AUTH_CODE_MAX_ATTEMPTS", &c.Auth.CodeMaxAttempts},
+		{"CHEESE_AUTH_RESEND_COOLDOWN", &c.Auth.ResendCooldown},
+		{"CHEESE_AUTH_REQUIRE_ADMIN_TOTP", &c.Auth.RequireAdminTOTP},
+		{"CHEESE_MAIL_BACKEND", &c.Mail.Backend},
+		{"CHEESE_MAIL_FROM", &c.Mail.From},
+		{"CHEESE_MAIL_DIR", &c.Mail.Dir},
+		{"CHEESE_OUTBOX_WORKER", &c.Outbox.Worker},
+		{"CHEESE_OUTBOX_POLL_INTERVAL", &c.Outbox.PollInterval},
+		{"CHEESE_OUTBOX_MAX_ATTEMPTS", &c.Outbox.MaxAttempts},
+		{"CHEESE_OUTBOX_BASE_BACKOFF", &c.Outbox.BaseBackoff},
+		{"CHEESE_OUTBOX_MAX_BACKOFF", &c.Outbox.MaxBackoff},
+		{"CHEESE_OUTBOX_LEASE", &c.Outbox.Lease},
+		{"CHEESE_CHECKOUT_RESERVATION_TTL", &c.Checkout.ReservationTTL},
+		{"CHEESE_CHECKOUT_SWEEP_INTERVAL", &c.Checkout.SweepInterval},
+		{"CHEESE_SMTP_HOST", &c.SMTP.Host},
+		{"CHEESE_SMTP_PORT", &c.SMTP.Port},
+		{"CHEESE_SMTP_USERNAME", &c.SMTP.Username},
+		{"CHEESE_SMTP_PASSWORD", &c.SMTP.Password},
+		{"CHEESE_SMTP_TLS", &c.SMTP.TLS},
+		{"CHEESE_SMTP_INSECURE_SKIP_VERIFY", &c.SMTP.InsecureSkipVerify},
+		{"CHEESE_CHAT_ALLOWED_ORIGINS", &c.Chat.AllowedOrigins},
+		{"CHEESE_CHAT_AUTO_ASSIGN", &c.Chat.AutoAssign},
+		{"CHEESE_CHAT_BUS", &c.Chat.Bus},
+	}
+}
+
+func (c *Config) applyEnv() error {
+	for _, v := range c.envVars() {
+		raw, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		switch dst := v.dst.(type) {
+		case *string:
+			*dst = raw
+		case *int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("config: %s must be an integer, got %q", v.name, raw)
+			}
+			*dst = n
+		case *bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("config: %s must be true or false, got %q", v.name, raw)
+			}
+			*dst = b
+		case *Duration:
+			if err := dst.UnmarshalText([]byte(raw)); err != nil {
+				return fmt.Errorf("config: %s: %w", v.name, err)
+			}
+		case *[]string:
+			// Lists are comma-separated.
+			*dst = nil
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		default:
+			return fmt.Errorf("config: unsupported type for %s", v.name)
+		}
+	}
+	return nil
+}
+
+// Validate reports every missing or malformed value of the shop server's
+// configuration at once so a broken deployment can be fixed in a single
+// pass.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// ValidatePayment is Validate for the payment service, which does not need
+// jwt.secret.
+func (c *Config) ValidatePayment() error {
+	return c.validate(false)
+}
+
+func (c *Config) validate(needJWT bool) error {
+	var errs []error
+	required := func(value, key, env string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("config: %s is required (set %s)", key, env))
+		}
+	}
+
+	required(c.Server.Addr, "server.addr", "CHEESE_SERVER_ADDR")
+	required(c.Server.PublicURL, "server.public_url", "CHEESE_SERVER_PUBLIC_URL")
+	required(c.Payment.Addr, "payment.addr", "CHEESE_PAYMENT_ADDR")
+	required(c.Payment.PublicURL, "payment.public_url", "CHEESE_PAYMENT_PUBLIC_URL")
+	required(c.Mongo.URI, "mongo.uri", "CHEESE_MONGO_URI")
+	required(c.Mongo.Database, "mongo.database", "CHEESE_MONGO_DATABASE")
+	if needJWT {
+		required(c.JWT.Secret, "jwt.secret", "CHEESE_JWT_SECRET")
+	}
+	required(c.Mail.From, "mail.from", "CHEESE_MAIL_FROM")
+
+	if c.JWT.Secret != "" && len(c.JWT.Secret) < 16 {
+		errs = append(errs, errors.New("config: jwt.secret must be at least 16 characters"))
+	}
+	if c.JWT.AccessTTL <= 0 || c.JWT.RefreshTTL <= c.JWT.AccessTTL {
+		errs = append(errs, errors.New("config: jwt.access_ttl must be positive and shorter than jwt.refresh_ttl"))
+	}
+	if c.Auth.ResetTTL <= 0 || c.Auth.CodeTTL <= 0 {
+		errs = append(errs, errors.New("config: auth.reset_ttl and auth.code_ttl must be positive"))
+	}
+	if c.Auth.CodeMaxAttempts < 1 {
+		errs = append(errs, errors.New("config: auth.code_max_attempts must be at least 1"))
+	}
+	if c.Auth.ResendCooldown < 0 {
+		errs = append(errs, errors.New("config: auth.resend_cooldown must not be negative"))
+	}
+	if c.Mongo.MinPoolSize < 0 || (c.Mongo.MaxPoolSize > 0 && c.Mongo.MinPoolSize > c.Mongo.MaxPoolSize) {
+		errs = append(errs, fmt.Errorf("config: mongo.min_pool_size %d must be between 0 and mongo.max_pool_size", c.Mongo.MinPoolSize))
+	}
+	if c.Mongo.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("config: mongo.connect_timeout must be positive"))
+	}
+	if c.Mongo.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("config: mongo.query_timeout must be positive"))
+	}
+	switch c.Mongo.ReadPreference {
+	case "primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest":
+	default:
+		errs = append(errs, fmt.Errorf("config: mongo.read_preference %q is not a valid read preference", c.Mongo.ReadPreference))
+	}
+	if c.Outbox.PollInterval <= 0 || c.Outbox.BaseBackoff <= 0 || c.Outbox.Lease <= 0 {
+		errs = append(errs, errors.New("config: outbox.poll_interval, outbox.base_backoff and outbox.lease must be positive"))
+	}
+	if c.Outbox.MaxBackoff < c.Outbox.BaseBackoff {
+		errs = append(errs, errors.New("config: outbox.max_backoff must not be shorter than outbox.base_backoff"))
+	}
+	if c.Outbox.MaxAttempts < 1 {
+		errs = append(errs, errors.New("config: outbox.max_attempts must be at least 1"))
+	}
+	if c.Checkout.ReservationTTL <= 0 || c.Checkout.SweepInterval <= 0 {
+		errs = append(errs, errors.New("config: checkout.reservation_ttl and checkout.sweep_interval must be positive"))
+	}
+	for _, origin := range c.Chat.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			errs = append(errs, fmt.Errorf("config: chat.allowed_origins entry %q must look like https://host[:port]", origin))
+		}
+	}
+	switch c.Chat.AutoAssign {
+	case "", "round_robin", "least_loaded":
+	default:
+		errs = append(errs, fmt.Errorf("config: chat.auto_assign must be empty, round_robin or least_loaded, got %q", c.Chat.AutoAssign))
+	}
+	if c.Chat.Bus != "local" && c.Chat.Bus != "mongodb" {
+		errs = append(errs, fmt.Errorf("config: chat.bus must be local or mongodb, got %q", c.Chat.Bus))
+	}
+
+	switch c.Mail.Backend {
+	case "smtp":
+		required(c.SMTP.Host, "smtp.host", "CHEESE_SMTP_HOST")
+		if c.SMTP.Port <= 0 || c.SMTP.Port > 65535 {
+			errs = append(errs, fmt.Errorf("config: smtp.port %d is out of range", c.SMTP.Port))
+		}
+		if c.SMTP.TLS != "starttls" && c.SMTP.TLS != "tls" {
+			errs = append(errs, fmt.Errorf("config: smtp.tls must be \"starttls\" or \"tls\", got %q", c.SMTP.TLS))
+		}
+	case "file":
+		required(c.Mail.Dir, "mail.dir", "CHEESE_MAIL_DIR")
+	case "capture":
+	default:
+		errs = append(errs, fmt.Errorf("config: mail.backend must be smtp, file or capture, got %q", c.Mail.Backend))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Duration is a time.Duration written as "15s" or "2m" in files and
+// environment variables.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Std returns the value as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  addr: ":9090"
+mongo:
+  database: staging
+  query_timeout: 3s
+jwt:
+  secret: from-the-file-0123456789
+mail:
+  from: shop@example.com
+smtp:
+  host: smtp.example.com
+`), 0600)
+	require.NoError(t, err)
+
+	t.Setenv("CHEESE_MONGO_URI", "mongodb://mongo:27017")
+	t.Setenv("CHEESE_SMTP_PORT", "2525")
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", cfg.Server.Addr)
+	assert.Equal(t, "staging", cfg.Mongo.Database)
+	assert.Equal(t, 3*time.Second, cfg.Mongo.QueryTimeout.Std())
+	assert.Equal(t, "mongodb://mongo:27017", cfg.Mongo.URI)
+	assert.Equal(t, 2525, cfg.SMTP.Port)
+	assert.Equal(t, ":8082", cfg.Payment.Addr)
+}
+
+func TestLoadJSONRejectsUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"mongo": {"url": "typo"}}`), 0600))
+
+	_, err := Load(path)
+	assert.ErrorContains(t, err, "unknown field")
+}
+
+func TestValidateReportsAllMissingValues(t *testing.T) {
+	err := Default().Validate()
+	require.Error(t, err)
+	for _, key := range []string{"jwt.secret", "CHEESE_JWT_SECRET", "smtp.host", "mail.from"} {
+		assert.True(t, strings.Contains(err.Error(), key), "missing %q in %v", key, err)
+	}
+}
+
+func TestValidatePaymentNeedsNoJWTSecret(t *testing.T) {
+	err := Default().ValidatePayment()
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "jwt.secret")
+	assert.Contains(t, err.Error(), "mail.from")
+}
+
+func TestApplyEnvRejectsBadInteger(t *testing.T) {
+	t.Setenv("CHEESE_SMTP_PORT", "five-eight-seven")
+	_, err := Load("")
+	assert.ErrorContains(t, err, "CHEESE_SMTP_PORT must be an integer")
+}
+
+func TestValidateMailBackend(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Mail.From = "shop@example.com"
+	cfg.Mail.Backend = "file"
+	assert.NoError(t, cfg.Validate(), "the file backend needs no SMTP host")
+
+	cfg.Mail.Backend = "pigeon"
+	assert.ErrorContains(t, cfg.Validate(), "mail.backend")
+}
+
+func TestValidateOutbox(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Mail.From = "shop@example.com"
+	cfg.Mail.Backend = "capture"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Outbox.MaxBackoff = Duration(time.Second)
+	cfg.Outbox.MaxAttempts = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "outbox.max_backoff")
+	assert.ErrorContains(t, err, "outbox.max_attempts")
+}
+
+func TestValidateCheckout(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Mail.From = "shop@example.com"
+	cfg.Mail.Backend = "capture"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Checkout.ReservationTTL = 0
+	assert.ErrorContains(t, cfg.Validate(), "checkout.reservation_ttl")
+}
+
+func TestValidateMongoTimeouts(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Mail.From = "shop@example.com"
+	cfg.Mail.Backend = "capture"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Mongo.ConnectTimeout = 0
+	cfg.Mongo.QueryTimeout = Duration(-time.Second)
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "mongo.connect_timeout")
+	assert.ErrorContains(t, err, "mongo.query_timeout")
+}
+
+func TestChatAllowedOrigins(t *testing.T) {
+	t.Setenv("CHEESE_JWT_SECRET", "test-secret-0123456789")
+	t.Setenv("CHEESE_MAIL_FROM", "shop@example.com")
+	t.Setenv("CHEESE_MAIL_BACKEND", "capture")
+	t.Setenv("CHEESE_CHAT_ALLOWED_ORIGINS", "https://shop.example, http://localhost:3000")
+
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://shop.example", "http://localhost:3000"}, cfg.Chat.AllowedOrigins)
+
+	cfg.Chat.AllowedOrigins = []string{"shop.example", "https://shop.example/chat"}
+	cfg.Chat.AutoAssign = "random"
+	cfg.Chat.Bus = "redis"
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, `"shop.example"`)
+	assert.ErrorContains(t, err, `"https://shop.example/chat"`)
+	assert.ErrorContains(t, err, "chat.auto_assign")
+	assert.ErrorContains(t, err, "chat.bus")
+}
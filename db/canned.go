@@ -0,0 +1,111 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoCannedResponseRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoCannedResponseRepository) List(ctx context.Context) ([]models.CannedResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "shortcut", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var responses []models.CannedResponse
+	if err := cursor.All(ctx, &responses); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+func (r *mongoCannedResponseRepository) FindByShortcut(ctx context.Context, shortcut string) (*models.CannedResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var response models.CannedResponse
+	err := r.coll.FindOne(ctx, bson.M{"shortcut": shortcut}).Decode(&response)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (r *mongoCannedResponseRepository) Create(ctx context.Context, response *models.CannedResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	response.ID = ""
+	res, err := r.coll.InsertOne(ctx, response)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	response.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+func (r *mongoCannedResponseRepository) Update(ctx context.Context, response models.CannedResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(response.ID)
+	if err != nil {
+		return err
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"shortcut": response.Shortcut,
+			"title":    response.Title,
+			"content":  response.Content,
+			"keywords": response.Keywords,
+		},
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.M{"_id": oid}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoCannedResponseRepository) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
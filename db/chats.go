@@ -0,0 +1,139 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoChatRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoChatRepository) Create(ctx context.Context, chat *models.Chat) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	_, err := r.coll.InsertOne(ctx, chat)
+	return err
+}
+
+func (r *mongoChatRepository) findOne(ctx context.Context, filter bson.M) (*models.Chat, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var chat models.Chat
+	err := r.coll.FindOne(ctx, filter).Decode(&chat)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+func (r *mongoChatRepository) Get(ctx context.Context, chatID string) (*models.Chat, error) {
+	return r.findOne(ctx, bson.M{"chat_id": chatID})
+}
+
+func (r *mongoChatRepository) Exists(ctx context.Context, chatID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{"chat_id": chatID})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *mongoChatRepository) set(ctx context.Context, chatID string, fields bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, bson.M{"chat_id": chatID}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoChatRepository) Close(ctx context.Context, chatID string, at time.Time) error {
+	return r.set(ctx, chatID, bson.M{"status": "inactive", "closed_at": at})
+}
+
+func (r *mongoChatRepository) SetEmailTranscript(ctx context.Context, chatID string, enabled bool) error {
+	return r.set(ctx, chatID, bson.M{"email_transcript": enabled})
+}
+
+func (r *mongoChatRepository) list(ctx context.Context, filter bson.M) ([]models.Chat, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func (r *mongoChatRepository) ListActive(ctx context.Context) ([]models.Chat, error) {
+	return r.list(ctx, bson.M{"status": "active"})
+}
+
+// unassigned matches a missing, null or empty admin_id.
+var unassigned = bson.M{"$in": bson.A{nil, ""}}
+
+func (r *mongoChatRepository) ListUnassigned(ctx context.Context) ([]models.Chat, error) {
+	return r.list(ctx, bson.M{"status": "active", "admin_id": unassigned})
+}
+
+func (r *mongoChatRepository) Assign(ctx context.Context, chatID, fromAdminID, toAdminID string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{"chat_id": chatID, "status": "active", "admin_id": fromAdminID}
+	if fromAdminID == "" {
+		filter["admin_id"] = unassigned
+	}
+	res, err := r.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"admin_id": toAdminID, "assigned_at": at}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoChatRepository) AdvanceReadCursor(ctx context.Context, chatID, readerID, messageID string, seq int64) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{
+		"chat_id":                   chatID,
+		"last_read_seq." + readerID: bson.M{"$not": bson.M{"$gte": seq}},
+	}
+	update := bson.M{"$set": bson.M{"last_read." + readerID: messageID, "last_read_seq." + readerID: seq}}
+	_, err := r.coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (r *mongoChatRepository) FindActiveByUser(ctx context.Context, userID string) (*models.Chat, error) {
+	return r.findOne(ctx, bson.M{"user_id": userID, "status": "active"})
+}
@@ -0,0 +1,1323 @@
+package db
+
+import (
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/search"
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemoryStore returns a Store backed by process memory. It behaves like
+// the MongoDB repositories (ObjectID validation, ErrNotFound) and is meant for
+// tests and local experiments without a database.
+func NewMemoryStore() *Store {
+	chats := &memoryChatRepository{}
+	return &Store{
+		Products: &memoryProductRepository{},
+		Users:    &memoryUserRepository{},
+		Chats:    chats,
+		Messages: &memoryMessageRepository{chats: chats},
+		Canned:   &memoryCannedResponseRepository{},
+		Orders:   &memoryOrderRepository{},
+		Outbox:   &memoryOutboxRepository{},
+		Sessions: &memorySessionRepository{},
+		Resets:   &memoryPasswordResetRepository{},
+	}
+}
+
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+type memoryProductRepository struct {
+	mu       sync.Mutex
+	products []models.Product
+}
+
+func (r *memoryProductRepository) List(ctx context.Context, q ProductQuery) ([]models.Product, int64, error) {
+	if q.ID != "" {
+		if _, err := objectID(q.ID); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var matched []models.Product
+	for _, p := range r.products {
+		if productMatches(p, q) {
+			matched = append(matched, cloneProduct(p))
+		}
+	}
+	total := int64(len(matched))
+	if q.SkipTotal {
+		total = -1
+	}
+
+	// Like MongoDB, IDs break ties.
+	order := func(c int) int {
+		if q.SortDesc {
+			return -c
+		}
+		return c
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return order(compareProducts(matched[i], matched[j], q.SortBy)) < 0
+	})
+	if c := q.After; c != nil {
+		if _, err := objectID(c.ID); err != nil {
+			return nil, 0, err
+		}
+		matched = slices.DeleteFunc(matched, func(p models.Product) bool {
+			cmp := compareSortValues(productSortValue(p, q.SortBy), c.Value)
+			if cmp == 0 {
+				cmp = strings.Compare(p.ID, c.ID)
+			}
+			return order(cmp) <= 0
+		})
+	}
+
+	return paginate(matched, q.Skip, q.Limit), total, nil
+}
+
+func productMatches(p models.Product, q ProductQuery) bool {
+	inRange := func(v float64, min, max *float64) bool {
+		return (min == nil || v >= *min) && (max == nil || v <= *max)
+	}
+	oneOf := func(v string, values []string) bool {
+		return len(values) == 0 || slices.Contains(values, v)
+	}
+	return (q.ID == "" || p.ID == q.ID) &&
+		(q.Category == "" || p.Category == q.Category) &&
+		oneOf(string(p.MilkType), q.MilkTypes) &&
+		oneOf(p.Country, q.Countries) &&
+		oneOf(p.Region, q.Regions) &&
+		oneOf(string(p.Texture), q.Textures) &&
+		(q.Protected == nil || p.Protected == *q.Protected) &&
+		(q.Pasteurized == nil || (p.Pasteurized != nil && *p.Pasteurized == *q.Pasteurized)) &&
+		inRange(p.Price, q.MinPrice, q.MaxPrice) &&
+		inRange(float64(p.AgeMonths), q.MinAge, q.MaxAge) &&
+		inRange(p.FatPercent, q.MinFat, q.MaxFat)
+}
+
+// productFacetValue is p's value for a value facet, "" if it has none.
+func productFacetValue(p models.Product, facet string) string {
+	switch facet {
+	case FacetCategory:
+		return p.Category
+	case FacetMilkType:
+		return string(p.MilkType)
+	case FacetCountry:
+		return p.Country
+	case FacetRegion:
+		return p.Region
+	case FacetTexture:
+		return string(p.Texture)
+	case FacetProtected:
+		return strconv.FormatBool(p.Protected)
+	case FacetPasteurized:
+		if p.Pasteurized != nil {
+			return strconv.FormatBool(*p.Pasteurized)
+		}
+	}
+	return ""
+}
+
+func productRangeValue(p models.Product, facet string) float64 {
+	switch facet {
+	case FacetPrice:
+		return p.Price
+	case FacetAge:
+		return float64(p.AgeMonths)
+	default:
+		return p.FatPercent
+	}
+}
+
+func (r *memoryProductRepository) Facets(ctx context.Context, q ProductQuery) (ProductFacets, error) {
+	if q.ID != "" {
+		if _, err := objectID(q.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	facets := ProductFacets{}
+	for _, facet := range valueFacets {
+		fq := q.without(facet)
+		byValue := map[string]int64{}
+		for _, p := range r.products {
+			if v := productFacetValue(p, facet); v != "" && productMatches(p, fq) {
+				byValue[v]++
+			}
+		}
+		counts := []FacetCount{}
+		for v, n := range byValue {
+			counts = append(counts, FacetCount{Value: v, Count: n})
+		}
+		sortValueCounts(counts)
+		facets[facet] = counts
+	}
+	for _, rf := range rangeFacets {
+		fq := q.without(rf.field)
+		perRange := make([]int64, len(rf.bounds))
+		for _, p := range r.products {
+			v := productRangeValue(p, rf.field)
+			if v < rf.bounds[0] || !productMatches(p, fq) {
+				continue
+			}
+			i := sort.SearchFloat64s(rf.bounds, v)
+			if i == len(rf.bounds) || rf.bounds[i] != v {
+				i--
+			}
+			perRange[i]++
+		}
+		counts := []FacetCount{}
+		for i, n := range perRange {
+			if n > 0 {
+				counts = append(counts, rangeCount(rf.bounds, i, n))
+			}
+		}
+		facets[rf.field] = counts
+	}
+	return facets, nil
+}
+
+// productScore weighs how often the stemmed words of query appear in the
+// searchable fields of p, roughly as MongoDB's text score does.
+func productScore(p models.Product, query []string) int {
+	score := 0
+	for _, f := range productTextFields {
+		for _, w := range search.Words(productText(p, f.field)) {
+			if slices.Contains(query, search.Stem(w, p.Language)) {
+				score += f.weight
+			}
+		}
+	}
+	return score
+}
+
+func (r *memoryProductRepository) Search(ctx context.Context, q ProductSearch) ([]models.Product, int64, error) {
+	var query []string
+	for _, w := range search.Words(q.Text) {
+		query = append(query, search.Stem(w, q.Language))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type scored struct {
+		product models.Product
+		score   int
+	}
+	var matched []scored
+	for _, p := range r.products {
+		if score := productScore(p, query); score > 0 {
+			matched = append(matched, scored{cloneProduct(p), score})
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].score != matched[j].score {
+			return matched[i].score > matched[j].score
+		}
+		return matched[i].product.Name < matched[j].product.Name
+	})
+
+	var products []models.Product
+	for _, m := range paginate(matched, q.Skip, q.Limit) {
+		products = append(products, m.product)
+	}
+	return products, int64(len(matched)), nil
+}
+
+func (r *memoryProductRepository) Suggest(ctx context.Context, prefix string, limit int64) ([]string, error) {
+	prefix = strings.ToLower(prefix)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for _, p := range r.products {
+		if slices.ContainsFunc(search.Words(p.Name), func(w string) bool { return strings.HasPrefix(w, prefix) }) {
+			names = append(names, p.Name)
+		}
+	}
+	sort.Strings(names)
+	return paginate(names, 0, limit), nil
+}
+
+func (r *memoryProductRepository) Vocabulary(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return productVocabulary(r.products), nil
+}
+
+// compareProducts orders a and b by field, then by ID.
+func compareProducts(a, b models.Product, field string) int {
+	if c := compareSortValues(productSortValue(a, field), productSortValue(b, field)); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+func compareSortValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case float64:
+		b, _ := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+func paginate[T any](items []T, skip, limit int64) []T {
+	if skip >= int64(len(items)) {
+		return nil
+	}
+	items = items[skip:]
+	if limit > 0 && limit < int64(len(items)) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (r *memoryProductRepository) Create(ctx context.Context, product *models.Product) error {
+	if err := assignVariantIDs(product, nil); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.skuTaken(*product) {
+		return ErrDuplicate
+	}
+	product.ID = newID()
+	r.products = append(r.products, cloneProduct(*product))
+	return nil
+}
+
+func (r *memoryProductRepository) Update(ctx context.Context, product models.Product) error {
+	if _, err := objectID(product.ID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.products {
+		stored := &r.products[i]
+		if stored.ID != product.ID {
+			continue
+		}
+		if err := assignVariantIDs(&product, stored.Variants); err != nil {
+			return err
+		}
+		if r.skuTaken(product) {
+			return ErrDuplicate
+		}
+		reserved := maps.Clone(stored.VariantReserved)
+		for _, id := range droppedVariants(product, stored.Variants) {
+			if reserved[id] > 0 {
+				return ErrReserved
+			}
+			delete(reserved, id)
+		}
+		product.Reserved = stored.Reserved
+		product.VariantReserved = reserved
+		*stored = cloneProduct(product)
+		return nil
+	}
+	return ErrNotFound
+}
+
+// skuTaken reports whether another product has a variant with a SKU of p.
+// The caller holds the lock.
+func (r *memoryProductRepository) skuTaken(p models.Product) bool {
+	for _, other := range r.products {
+		if other.ID == p.ID {
+			continue
+		}
+		for _, v := range other.Variants {
+			if slices.ContainsFunc(p.Variants, func(w models.Variant) bool { return w.SKU == v.SKU }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cloneProduct copies p deeply enough that callers never share memory with
+// the stored product.
+func cloneProduct(p models.Product) models.Product {
+	p.Variants = slices.Clone(p.Variants)
+	p.VariantReserved = maps.Clone(p.VariantReserved)
+	return p
+}
+
+// adjustStock applies fn to the stock and reserved counters of the product
+// with id, or of its variant if variantID is set, under the lock.
+func (r *memoryProductRepository) adjustStock(id, variantID string, fn func(stock, reserved *int) error) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	if variantID != "" {
+		if _, err := objectID(variantID); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.products {
+		p := &r.products[i]
+		if p.ID != id {
+			continue
+		}
+		if variantID == "" {
+			return fn(&p.Stock, &p.Reserved)
+		}
+		v := p.Variant(variantID)
+		if v == nil {
+			return ErrNotFound
+		}
+		reserved := p.VariantReserved[variantID]
+		if err := fn(&v.Stock, &reserved); err != nil {
+			return err
+		}
+		if p.VariantReserved == nil {
+			p.VariantReserved = map[string]int{}
+		}
+		p.VariantReserved[variantID] = reserved
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (r *memoryProductRepository) Reserve(ctx context.Context, id, variantID string, quantity int) error {
+	return r.adjustStock(id, variantID, func(stock, reserved *int) error {
+		if *stock-*reserved < quantity {
+			return ErrInsufficientStock
+		}
+		*reserved += quantity
+		return nil
+	})
+}
+
+func (r *memoryProductRepository) Release(ctx context.Context, id, variantID string, quantity int) error {
+	return r.adjustStock(id, variantID, func(stock, reserved *int) error {
+		if *reserved < quantity {
+			return ErrInsufficientStock
+		}
+		*reserved -= quantity
+		return nil
+	})
+}
+
+func (r *memoryProductRepository) Commit(ctx context.Context, id, variantID string, quantity int) error {
+	return r.adjustStock(id, variantID, func(stock, reserved *int) error {
+		if *reserved < quantity {
+			return ErrInsufficientStock
+		}
+		*reserved -= quantity
+		*stock -= quantity
+		return nil
+	})
+}
+
+func (r *memoryProductRepository) Delete(ctx context.Context, id string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, p := range r.products {
+		if p.ID != id {
+			continue
+		}
+		if p.Reserved > 0 {
+			return ErrReserved
+		}
+		for _, n := range p.VariantReserved {
+			if n > 0 {
+				return ErrReserved
+			}
+		}
+		r.products = append(r.products[:i], r.products[i+1:]...)
+		break
+	}
+	return nil
+}
+
+type memoryUserRepository struct {
+	mu    sync.Mutex
+	users []models.User
+}
+
+func (r *memoryUserRepository) find(match func(models.User) bool) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if match(u) {
+			user := u
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUserRepository) FindByID(ctx context.Context, id string) (*models.User, error) {
+	if _, err := objectID(id); err != nil {
+		return nil, err
+	}
+	return r.find(func(u models.User) bool { return u.ID == id })
+}
+
+func (r *memoryUserRepository) FindByUsername(ctx context.Context, username string) (*models.User, error) {
+	return r.find(func(u models.User) bool { return u.Username == username })
+}
+
+func (r *memoryUserRepository) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	return r.find(func(u models.User) bool { return u.Email == email })
+}
+
+func (r *memoryUserRepository) List(ctx context.Context) ([]models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]models.User(nil), r.users...), nil
+}
+
+func (r *memoryUserRepository) Count(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return int64(len(r.users)), nil
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user.ID = newID()
+	r.users = append(r.users, *user)
+	return nil
+}
+
+// update applies fn to the first user accepted by match.
+func (r *memoryUserRepository) update(match func(models.User) bool, fn func(*models.User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.users {
+		if match(r.users[i]) {
+			fn(&r.users[i])
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryUserRepository) UpdateRole(ctx context.Context, id, role string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	return r.update(
+		func(u models.User) bool { return u.ID == id },
+		func(u *models.User) { u.Role = role },
+	)
+}
+
+func (r *memoryUserRepository) MarkVerified(ctx context.Context, email string) error {
+	return r.update(
+		func(u models.User) bool { return u.Email == email },
+		func(u *models.User) {
+			u.Verified = true
+			u.VerificationCode = ""
+			u.VerificationExpiresAt = time.Time{}
+			u.VerificationSentAt = time.Time{}
+			u.VerificationAttempts = 0
+		},
+	)
+}
+
+func (r *memoryUserRepository) SetVerificationCode(ctx context.Context, email, code string, sentAt, expiresAt time.Time) error {
+	return r.update(
+		func(u models.User) bool { return u.Email == email },
+		func(u *models.User) {
+			u.VerificationCode = code
+			u.VerificationSentAt = sentAt
+			u.VerificationExpiresAt = expiresAt
+			u.VerificationAttempts = 0
+		},
+	)
+}
+
+func (r *memoryUserRepository) SetTOTP(ctx context.Context, id string, totp models.TOTP) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	return r.update(
+		func(u models.User) bool { return u.ID == id },
+		func(u *models.User) { u.TOTP = totp },
+	)
+}
+
+func (r *memoryUserRepository) UseTOTPCounter(ctx context.Context, id string, counter int64) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	return r.update(
+		func(u models.User) bool { return u.ID == id && u.TOTP.LastCounter < counter },
+		func(u *models.User) { u.TOTP.LastCounter = counter },
+	)
+}
+
+func (r *memoryUserRepository) UseRecoveryCode(ctx context.Context, id, codeHash string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	has := func(u models.User) bool {
+		for _, h := range u.TOTP.RecoveryCodes {
+			if h == codeHash {
+				return true
+			}
+		}
+		return false
+	}
+	return r.update(
+		func(u models.User) bool { return u.ID == id && has(u) },
+		func(u *models.User) {
+			var left []string
+			for _, h := range u.TOTP.RecoveryCodes {
+				if h != codeHash {
+					left = append(left, h)
+				}
+			}
+			u.TOTP.RecoveryCodes = left
+		},
+	)
+}
+
+func (r *memoryUserRepository) AddVerificationAttempt(ctx context.Context, email string) (int, error) {
+	var attempts int
+	err := r.update(
+		func(u models.User) bool { return u.Email == email },
+		func(u *models.User) {
+			u.VerificationAttempts++
+			attempts = u.VerificationAttempts
+		},
+	)
+	return attempts, err
+}
+
+func (r *memoryUserRepository) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	return r.update(
+		func(u models.User) bool { return u.ID == id },
+		func(u *models.User) { u.Password = passwordHash },
+	)
+}
+
+type memoryChatRepository struct {
+	mu    sync.Mutex
+	chats []models.Chat
+	// messageSeq is each chat's last message Seq.
+	messageSeq map[string]int64
+}
+
+// nextMessageSeq counts a new message in chatID and returns its Seq.
+func (r *memoryChatRepository) nextMessageSeq(chatID string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.chats {
+		if c.ChatID != chatID {
+			continue
+		}
+		if r.messageSeq == nil {
+			r.messageSeq = map[string]int64{}
+		}
+		r.messageSeq[chatID]++
+		return r.messageSeq[chatID], nil
+	}
+	return 0, ErrNotFound
+}
+
+func (r *memoryChatRepository) Create(ctx context.Context, chat *models.Chat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.chats = append(r.chats, cloneChat(*chat))
+	return nil
+}
+
+// cloneChat copies c deeply enough that callers never share memory with
+// the stored chat.
+func cloneChat(c models.Chat) models.Chat {
+	if c.LastRead != nil {
+		lastRead := make(map[string]string, len(c.LastRead))
+		for k, v := range c.LastRead {
+			lastRead[k] = v
+		}
+		c.LastRead = lastRead
+	}
+	return c
+}
+
+// find returns a copy of the first chat accepted by match.
+func (r *memoryChatRepository) find(match func(models.Chat) bool) (*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.chats {
+		if match(c) {
+			chat := cloneChat(c)
+			return &chat, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryChatRepository) Get(ctx context.Context, chatID string) (*models.Chat, error) {
+	return r.find(func(c models.Chat) bool { return c.ChatID == chatID })
+}
+
+func (r *memoryChatRepository) Exists(ctx context.Context, chatID string) (bool, error) {
+	_, err := r.Get(ctx, chatID)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *memoryChatRepository) update(chatID string, fn func(*models.Chat)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.chats {
+		if r.chats[i].ChatID == chatID {
+			fn(&r.chats[i])
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryChatRepository) Close(ctx context.Context, chatID string, at time.Time) error {
+	return r.update(chatID, func(c *models.Chat) {
+		c.Status = "inactive"
+		c.ClosedAt = &at
+	})
+}
+
+func (r *memoryChatRepository) SetEmailTranscript(ctx context.Context, chatID string, enabled bool) error {
+	return r.update(chatID, func(c *models.Chat) {
+		c.EmailTranscript = enabled
+	})
+}
+
+// list returns the chats accepted by match, oldest first.
+func (r *memoryChatRepository) list(match func(models.Chat) bool) []models.Chat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var chats []models.Chat
+	for _, c := range r.chats {
+		if match(c) {
+			chats = append(chats, cloneChat(c))
+		}
+	}
+	sort.SliceStable(chats, func(i, j int) bool { return chats[i].CreatedAt.Before(chats[j].CreatedAt) })
+	return chats
+}
+
+func (r *memoryChatRepository) ListActive(ctx context.Context) ([]models.Chat, error) {
+	return r.list(func(c models.Chat) bool { return c.Status == "active" }), nil
+}
+
+func (r *memoryChatRepository) ListUnassigned(ctx context.Context) ([]models.Chat, error) {
+	return r.list(func(c models.Chat) bool { return c.Status == "active" && c.AdminID == "" }), nil
+}
+
+func (r *memoryChatRepository) Assign(ctx context.Context, chatID, fromAdminID, toAdminID string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.chats {
+		c := &r.chats[i]
+		if c.ChatID == chatID && c.Status == "active" && c.AdminID == fromAdminID {
+			c.AdminID = toAdminID
+			c.AssignedAt = &at
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryChatRepository) AdvanceReadCursor(ctx context.Context, chatID, readerID, messageID string, seq int64) error {
+	err := r.update(chatID, func(c *models.Chat) {
+		if c.LastReadSeq[readerID] >= seq {
+			return
+		}
+		if c.LastRead == nil {
+			c.LastRead = map[string]string{}
+			c.LastReadSeq = map[string]int64{}
+		}
+		c.LastRead[readerID] = messageID
+		c.LastReadSeq[readerID] = seq
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (r *memoryChatRepository) FindActiveByUser(ctx context.Context, userID string) (*models.Chat, error) {
+	return r.find(func(c models.Chat) bool { return c.UserID == userID && c.Status == "active" })
+}
+
+type memoryMessageRepository struct {
+	chats *memoryChatRepository
+
+	mu sync.Mutex
+	// messages is in Seq order within each chat.
+	messages []models.Message
+}
+
+func (r *memoryMessageRepository) Append(ctx context.Context, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seq, err := r.chats.nextMessageSeq(message.ChatID)
+	if err != nil {
+		return err
+	}
+	message.ID = newID()
+	message.Seq = seq
+	r.messages = append(r.messages, *message)
+	return nil
+}
+
+func (r *memoryMessageRepository) Get(ctx context.Context, chatID, id string) (*models.Message, error) {
+	if _, err := objectID(id); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.find(chatID, id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &m, nil
+}
+
+// find looks a message up; the caller holds the lock.
+func (r *memoryMessageRepository) find(chatID, id string) (models.Message, bool) {
+	for _, m := range r.messages {
+		if m.ChatID == chatID && m.ID == id {
+			return m, true
+		}
+	}
+	return models.Message{}, false
+}
+
+func (r *memoryMessageRepository) List(ctx context.Context, chatID string, page MessagePage) ([]models.Message, error) {
+	for _, id := range []string{page.Before, page.After} {
+		if _, err := objectID(id); id != "" && err != nil {
+			return nil, err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var after, before int64
+	if page.After != "" {
+		m, ok := r.find(chatID, page.After)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		after = m.Seq
+	} else if page.Before != "" {
+		m, ok := r.find(chatID, page.Before)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		before = m.Seq
+	}
+
+	var matched []models.Message
+	for _, m := range r.messages {
+		if m.ChatID != chatID || m.Seq <= after || (before > 0 && m.Seq >= before) {
+			continue
+		}
+		matched = append(matched, m)
+	}
+	if page.Limit > 0 && len(matched) > page.Limit {
+		if page.After != "" {
+			matched = matched[:page.Limit]
+		} else {
+			matched = matched[len(matched)-page.Limit:]
+		}
+	}
+	return matched, nil
+}
+
+func (r *memoryMessageRepository) CountUnread(ctx context.Context, chatID, readerID string, afterSeq int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for _, m := range r.messages {
+		if m.ChatID == chatID && m.Seq > afterSeq && m.SenderID != readerID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryMessageRepository) MarkDelivered(ctx context.Context, chatID, id, readerID string, at time.Time) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.messages {
+		m := &r.messages[i]
+		if m.ChatID == chatID && m.ID == id && m.SenderID != readerID && m.DeliveredAt == nil {
+			m.DeliveredAt = &at
+		}
+	}
+	return nil
+}
+
+func (r *memoryMessageRepository) MarkReadUpTo(ctx context.Context, chatID string, seq int64, readerID string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.messages {
+		m := &r.messages[i]
+		if m.ChatID != chatID || m.Seq > seq || m.SenderID == readerID {
+			continue
+		}
+		if m.DeliveredAt == nil {
+			m.DeliveredAt = &at
+		}
+		if m.ReadAt == nil {
+			m.ReadAt = &at
+		}
+	}
+	return nil
+}
+
+type memoryCannedResponseRepository struct {
+	mu        sync.Mutex
+	responses []models.CannedResponse
+}
+
+func (r *memoryCannedResponseRepository) List(ctx context.Context) ([]models.CannedResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	responses := append([]models.CannedResponse(nil), r.responses...)
+	sort.Slice(responses, func(i, j int) bool { return responses[i].Shortcut < responses[j].Shortcut })
+	return responses, nil
+}
+
+func (r *memoryCannedResponseRepository) FindByShortcut(ctx context.Context, shortcut string) (*models.CannedResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.responses {
+		if c.Shortcut == shortcut {
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// taken reports whether another response than id uses shortcut.
+func (r *memoryCannedResponseRepository) taken(shortcut, id string) bool {
+	for _, c := range r.responses {
+		if c.Shortcut == shortcut && c.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryCannedResponseRepository) Create(ctx context.Context, response *models.CannedResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.taken(response.Shortcut, "") {
+		return ErrDuplicate
+	}
+	response.ID = newID()
+	r.responses = append(r.responses, *response)
+	return nil
+}
+
+func (r *memoryCannedResponseRepository) Update(ctx context.Context, response models.CannedResponse) error {
+	if _, err := objectID(response.ID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.taken(response.Shortcut, response.ID) {
+		return ErrDuplicate
+	}
+	for i := range r.responses {
+		if r.responses[i].ID == response.ID {
+			r.responses[i] = response
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryCannedResponseRepository) Delete(ctx context.Context, id string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.responses {
+		if r.responses[i].ID == id {
+			r.responses = append(r.responses[:i], r.responses[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memoryOrderRepository struct {
+	mu     sync.Mutex
+	orders []models.Order
+}
+
+func (r *memoryOrderRepository) Create(ctx context.Context, order *models.Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order.ID = newID()
+	r.orders = append(r.orders, *order)
+	return nil
+}
+
+func (r *memoryOrderRepository) Get(ctx context.Context, id string) (*models.Order, error) {
+	if _, err := objectID(id); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, o := range r.orders {
+		if o.ID == id {
+			order := o
+			return &order, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryOrderRepository) SettleReservation(ctx context.Context, id, reservation, paymentStatus string) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.orders {
+		if o := &r.orders[i]; o.ID == id && o.Reservation == models.ReservationHeld {
+			o.Reservation, o.PaymentStatus = reservation, paymentStatus
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryOrderRepository) ListExpiredReservations(ctx context.Context, now time.Time) ([]models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var orders []models.Order
+	for _, o := range r.orders {
+		if o.Reservation == models.ReservationHeld && !o.ReservedUntil.After(now) {
+			orders = append(orders, o)
+		}
+	}
+	return orders, nil
+}
+
+type memoryOutboxRepository struct {
+	mu      sync.Mutex
+	entries []models.OutboxEntry
+}
+
+func (r *memoryOutboxRepository) Enqueue(ctx context.Context, entry *models.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.ID = newID()
+	r.entries = append(r.entries, *entry)
+	return nil
+}
+
+func (r *memoryOutboxRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration) (*models.OutboxEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	best := -1
+	for i, e := range r.entries {
+		due := (e.Status == models.OutboxPending && !e.NextAttemptAt.After(now)) ||
+			(e.Status == models.OutboxSending && !e.LockedUntil.After(now))
+		if due && (best < 0 || e.NextAttemptAt.Before(r.entries[best].NextAttemptAt)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, ErrNotFound
+	}
+
+	r.entries[best].Status = models.OutboxSending
+	r.entries[best].LockedUntil = now.Add(lease)
+	r.entries[best].Attempts++
+	entry := r.entries[best]
+	return &entry, nil
+}
+
+func (r *memoryOutboxRepository) update(id string, fn func(*models.OutboxEntry) bool) error {
+	if _, err := objectID(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.entries {
+		if r.entries[i].ID == id && fn(&r.entries[i]) {
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryOutboxRepository) MarkSent(ctx context.Context, id string, at time.Time) error {
+	return r.update(id, func(e *models.OutboxEntry) bool {
+		e.Status = models.OutboxSent
+		e.SentAt = &at
+		e.LastError = ""
+		e.LockedUntil = time.Time{}
+		return true
+	})
+}
+
+func (r *memoryOutboxRepository) MarkFailed(ctx context.Context, id string, attempts int, lastError string, next time.Time, dead bool) error {
+	return r.update(id, func(e *models.OutboxEntry) bool {
+		e.Status = models.OutboxPending
+		if dead {
+			e.Status = models.OutboxDead
+		}
+		e.Attempts = attempts
+		e.LastError = lastError
+		e.NextAttemptAt = next
+		e.LockedUntil = time.Time{}
+		return true
+	})
+}
+
+func (r *memoryOutboxRepository) Retry(ctx context.Context, id string, at time.Time) error {
+	return r.update(id, func(e *models.OutboxEntry) bool {
+		if e.Status != models.OutboxDead {
+			return false
+		}
+		e.Status = models.OutboxPending
+		e.Attempts = 0
+		e.NextAttemptAt = at
+		return true
+	})
+}
+
+func (r *memoryOutboxRepository) CountByStatus(ctx context.Context) (map[string]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := map[string]int64{}
+	for _, e := range r.entries {
+		counts[e.Status]++
+	}
+	return counts, nil
+}
+
+func (r *memoryOutboxRepository) List(ctx context.Context, status string, limit int64) ([]models.OutboxEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []models.OutboxEntry
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if status == "" || r.entries[i].Status == status {
+			entries = append(entries, redactEntry(r.entries[i]))
+		}
+	}
+	return paginate(entries, 0, limit), nil
+}
+
+// redactEntry drops what List leaves out of an entry.
+func redactEntry(e models.OutboxEntry) models.OutboxEntry {
+	e.Message.Text = ""
+	e.Message.HTML = ""
+	attachments := make([]mailer.Attachment, len(e.Message.Attachments))
+	for i, a := range e.Message.Attachments {
+		attachments[i] = mailer.Attachment{Filename: a.Filename, ContentType: a.ContentType}
+	}
+	e.Message.Attachments = attachments
+	return e
+}
+
+type memorySessionRepository struct {
+	mu       sync.Mutex
+	sessions []models.Session
+}
+
+func (r *memorySessionRepository) Create(ctx context.Context, session *models.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session.ID = newID()
+	r.sessions = append(r.sessions, *session)
+	return nil
+}
+
+func (r *memorySessionRepository) find(id string) (*models.Session, error) {
+	if _, err := objectID(id); err != nil {
+		return nil, err
+	}
+	for i := range r.sessions {
+		if r.sessions[i].ID == id {
+			return &r.sessions[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memorySessionRepository) Get(ctx context.Context, id string) (*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, err := r.find(id)
+	if err != nil {
+		return nil, err
+	}
+	found := *session
+	return &found, nil
+}
+
+func (r *memorySessionRepository) Rotate(ctx context.Context, id, oldHash, newHash string, now, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, err := r.find(id)
+	if err != nil {
+		return err
+	}
+	if session.RefreshHash != oldHash || !session.Active(now) {
+		return ErrNotFound
+	}
+	session.RefreshHash = newHash
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	return nil
+}
+
+func (r *memorySessionRepository) Revoke(ctx context.Context, id string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, err := r.find(id)
+	if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return ErrNotFound
+	}
+	session.RevokedAt = &at
+	return nil
+}
+
+func (r *memorySessionRepository) RevokeAllForUser(ctx context.Context, userID string, at time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for i := range r.sessions {
+		if r.sessions[i].UserID == userID && r.sessions[i].RevokedAt == nil {
+			r.sessions[i].RevokedAt = &at
+			n++
+		}
+	}
+	return n, nil
+}
+
+type memoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	resets []models.PasswordReset
+}
+
+func (r *memoryPasswordResetRepository) Create(ctx context.Context, reset *models.PasswordReset) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reset.ID = newID()
+	r.resets = append(r.resets, *reset)
+	return nil
+}
+
+func (r *memoryPasswordResetRepository) Consume(ctx context.Context, tokenHash string, now time.Time) (*models.PasswordReset, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.resets {
+		reset := &r.resets[i]
+		if reset.TokenHash == tokenHash && reset.UsedAt == nil && now.Before(reset.ExpiresAt) {
+			reset.UsedAt = &now
+			used := *reset
+			return &used, nil
+		}
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoMessageRepository struct {
+	coll *mongo.Collection
+	// chats holds each chat's message_seq counter.
+	chats   *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoMessageRepository) Append(ctx context.Context, message *models.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var counter struct {
+		Seq int64 `bson:"message_seq"`
+	}
+	err := r.chats.FindOneAndUpdate(ctx,
+		bson.M{"chat_id": message.ChatID},
+		bson.M{"$inc": bson.M{"message_seq": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"message_seq": 1}),
+	).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	message.ID = ""
+	message.Seq = counter.Seq
+	res, err := r.coll.InsertOne(ctx, message)
+	if err != nil {
+		return err
+	}
+	message.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+func (r *mongoMessageRepository) Get(ctx context.Context, chatID, id string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	var message models.Message
+	err = r.coll.FindOne(ctx, bson.M{"_id": oid, "chat_id": chatID}).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (r *mongoMessageRepository) List(ctx context.Context, chatID string, page MessagePage) ([]models.Message, error) {
+	// Newer pages are read forwards; older pages and the latest page
+	// backwards, then put back in order.
+	forward := page.After != ""
+	cursorID, op := page.Before, "$lt"
+	if forward {
+		cursorID, op = page.After, "$gt"
+	}
+	filter := bson.M{"chat_id": chatID}
+	if cursorID != "" {
+		cursor, err := r.Get(ctx, chatID, cursorID)
+		if err != nil {
+			return nil, err
+		}
+		filter["seq"] = bson.M{op: cursor.Seq}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	if !forward {
+		opts.SetSort(bson.D{{Key: "seq", Value: -1}})
+	}
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	if !forward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
+func (r *mongoMessageRepository) CountUnread(ctx context.Context, chatID, readerID string, afterSeq int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{"chat_id": chatID, "sender_id": bson.M{"$ne": readerID}, "seq": bson.M{"$gt": afterSeq}}
+	return r.coll.CountDocuments(ctx, filter)
+}
+
+func (r *mongoMessageRepository) MarkDelivered(ctx context.Context, chatID, id, readerID string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"_id": oid, "chat_id": chatID, "sender_id": bson.M{"$ne": readerID}, "delivered_at": nil}
+	_, err = r.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"delivered_at": at}})
+	return err
+}
+
+func (r *mongoMessageRepository) MarkReadUpTo(ctx context.Context, chatID string, seq int64, readerID string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	earlier := bson.M{"chat_id": chatID, "seq": bson.M{"$lte": seq}, "sender_id": bson.M{"$ne": readerID}}
+
+	delivered := bson.M{"delivered_at": nil}
+	for k, v := range earlier {
+		delivered[k] = v
+	}
+	if _, err := r.coll.UpdateMany(ctx, delivered, bson.M{"$set": bson.M{"delivered_at": at}}); err != nil {
+		return err
+	}
+	earlier["read_at"] = nil
+	_, err := r.coll.UpdateMany(ctx, earlier, bson.M{"$set": bson.M{"read_at": at}})
+	return err
+}
+
+// legacyMessageID is the ID of the i-th message embedded in a chat by older
+// versions. It starts with the chat's creation time, so migrated messages
+// sort before any written since, and ends with i, so they keep their order.
+// Being deterministic makes re-running the migration harmless.
+func legacyMessageID(chat primitive.ObjectID, chatID string, i int) primitive.ObjectID {
+	var id primitive.ObjectID
+	copy(id[:4], chat[:4])
+	sum := sha256.Sum256([]byte(chatID))
+	copy(id[4:9], sum[:5])
+	id[9], id[10], id[11] = byte(i>>16), byte(i>>8), byte(i)
+	return id
+}
+
+// migrateEmbeddedMessages moves messages that older versions kept in an
+// array inside the chat document into the messages collection. Messages
+// are upserted under legacyMessageID before the array is removed, so a
+// crash in between leaves nothing to duplicate on the next start.
+func (s *Store) migrateEmbeddedMessages(ctx context.Context) error {
+	chats := s.Database.Collection("chats")
+	messages := s.Database.Collection("messages")
+
+	cursor, err := chats.Find(ctx, bson.M{"messages": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var legacy struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			ChatID   string             `bson:"chat_id"`
+			Messages []models.Message   `bson:"messages"`
+		}
+		if err := cursor.Decode(&legacy); err != nil {
+			return err
+		}
+
+		if len(legacy.Messages) > 0 {
+			writes := make([]mongo.WriteModel, 0, len(legacy.Messages))
+			for i, m := range legacy.Messages {
+				id := legacyMessageID(legacy.ID, legacy.ChatID, i)
+				m.ID = ""
+				m.ChatID = legacy.ChatID
+				writes = append(writes, mongo.NewReplaceOneModel().
+					SetFilter(bson.M{"_id": id}).
+					SetReplacement(m).
+					SetUpsert(true))
+			}
+			if _, err := messages.BulkWrite(ctx, writes); err != nil {
+				return err
+			}
+		}
+		if _, err := chats.UpdateOne(ctx, bson.M{"chat_id": legacy.ChatID}, bson.M{"$unset": bson.M{"messages": ""}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// backfillMessageSeq numbers the messages stored before messages had a Seq,
+// in ID order, which is insert order for messages written by one server,
+// and sets the chats' counters and read cursors to match. Numbering
+// continues after a chat's highest Seq, so an interrupted run picks up
+// where it stopped on the next start.
+func (s *Store) backfillMessageSeq(ctx context.Context) error {
+	chats := s.Database.Collection("chats")
+	messages := s.Database.Collection("messages")
+
+	chatIDs, err := messages.Distinct(ctx, "chat_id", bson.M{"seq": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	for _, v := range chatIDs {
+		chatID, _ := v.(string)
+
+		var last models.Message
+		err := messages.FindOne(ctx, bson.M{"chat_id": chatID, "seq": bson.M{"$exists": true}},
+			options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(bson.M{"seq": 1})).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		cursor, err := messages.Find(ctx, bson.M{"chat_id": chatID, "seq": bson.M{"$exists": false}},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var unnumbered []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &unnumbered); err != nil {
+			return err
+		}
+		if len(unnumbered) == 0 {
+			continue
+		}
+		seq := last.Seq
+		writes := make([]mongo.WriteModel, 0, len(unnumbered))
+		for _, m := range unnumbered {
+			seq++
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": m.ID}).
+				SetUpdate(bson.M{"$set": bson.M{"seq": seq}}))
+		}
+		if _, err := messages.BulkWrite(ctx, writes); err != nil {
+			return err
+		}
+		if _, err := chats.UpdateOne(ctx, bson.M{"chat_id": chatID}, bson.M{"$max": bson.M{"message_seq": seq}}); err != nil {
+			return err
+		}
+	}
+
+	// Read cursors written before then name a message but not its Seq.
+	cursor, err := chats.Find(ctx, bson.M{"last_read": bson.M{"$exists": true}, "last_read_seq": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"chat_id": 1, "last_read": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var chat models.Chat
+		if err := cursor.Decode(&chat); err != nil {
+			return err
+		}
+		seqs := bson.M{}
+		for readerID, messageID := range chat.LastRead {
+			oid, err := objectID(messageID)
+			if err != nil {
+				continue
+			}
+			var m models.Message
+			err = messages.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"seq": 1})).Decode(&m)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			seqs["last_read_seq."+readerID] = m.Seq
+		}
+		if len(seqs) == 0 {
+			continue
+		}
+		if _, err := chats.UpdateOne(ctx, bson.M{"chat_id": chat.ChatID}, bson.M{"$set": seqs}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
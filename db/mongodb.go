@@ -1,27 +1,205 @@
 package db
 
 import (
+	"cheese_market/config"
 	"context"
+	"fmt"
 	"log"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-var Collection *mongo.Collection
+// Store owns the single MongoDB client of a process and the repositories
+// built on top of it.
+type Store struct {
+	Client   *mongo.Client
+	Database *mongo.Database
 
-func ConnectMongoDB() {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	Products ProductRepository
+	Users    UserRepository
+	Chats    ChatRepository
+	Messages MessageRepository
+	Canned   CannedResponseRepository
+	Orders   OrderRepository
+	Outbox   OutboxRepository
+	Sessions SessionRepository
+	Resets   PasswordResetRepository
+
+	transactions bool
+}
+
+// Connect opens the pooled client described by cfg and verifies it with a ping.
+func Connect(ctx context.Context, cfg config.Mongo) (*Store, error) {
+	mode, err := readpref.ModeFromString(cfg.ReadPreference)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		return nil, fmt.Errorf("invalid read preference %q: %w", cfg.ReadPreference, err)
 	}
-	err = client.Ping(context.TODO(), nil)
+	rp, err := readpref.New(mode)
 	if err != nil {
-		log.Fatalf("MongoDB connection failed: %v", err)
+		return nil, fmt.Errorf("invalid read preference %q: %w", cfg.ReadPreference, err)
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(cfg.URI).
+		SetMaxPoolSize(uint64(cfg.MaxPoolSize)).
+		SetMinPoolSize(uint64(cfg.MinPoolSize)).
+		SetConnectTimeout(cfg.ConnectTimeout.Std()).
+		SetReadPreference(rp)
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout.Std())
+	defer cancel()
+	if err := client.Ping(pingCtx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("MongoDB connection failed: %w", err)
 	}
 
 	log.Println("Connected to MongoDB!")
-	db := client.Database("cheeseMarket")
-	Collection = db.Collection("users")
+	store := newStore(client, client.Database(cfg.Database), cfg.QueryTimeout.Std())
+	store.transactions = cfg.Transactions
+
+	if err := store.ensureIndexes(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to create indexes: %w", err)
+	}
+	if err := store.backfillSortFields(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to fill in product sort fields: %w", err)
+	}
+	if err := store.backfillNameWords(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to index product names: %w", err)
+	}
+	if err := store.migrateEmbeddedMessages(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to migrate chat messages: %w", err)
+	}
+	if err := store.backfillMessageSeq(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to number chat messages: %w", err)
+	}
+	return store, nil
+}
+
+func newStore(client *mongo.Client, database *mongo.Database, timeout time.Duration) *Store {
+	return &Store{
+		Client:   client,
+		Database: database,
+		Products: &mongoProductRepository{coll: database.Collection("products"), timeout: timeout},
+		Users:    &mongoUserRepository{coll: database.Collection("users"), timeout: timeout},
+		Chats:    &mongoChatRepository{coll: database.Collection("chats"), timeout: timeout},
+		Messages: &mongoMessageRepository{coll: database.Collection("messages"), chats: database.Collection("chats"), timeout: timeout},
+		Canned:   &mongoCannedResponseRepository{coll: database.Collection("canned_responses"), timeout: timeout},
+		Orders:   &mongoOrderRepository{coll: database.Collection("orders"), timeout: timeout},
+		Outbox:   &mongoOutboxRepository{coll: database.Collection("outbox"), timeout: timeout},
+		Sessions: &mongoSessionRepository{coll: database.Collection("sessions"), timeout: timeout},
+		Resets:   &mongoPasswordResetRepository{coll: database.Collection("password_resets"), timeout: timeout},
+	}
+}
+
+// ensureIndexes creates the indexes the repositories rely on. Creating an
+// index that already exists is a no-op, so this runs on every start.
+func (s *Store) ensureIndexes(ctx context.Context) error {
+	textKeys, textWeights := bson.D{}, bson.D{}
+	for _, f := range productTextFields {
+		textKeys = append(textKeys, bson.E{Key: f.field, Value: "text"})
+		textWeights = append(textWeights, bson.E{Key: f.field, Value: f.weight})
+	}
+	indexes := map[string][]mongo.IndexModel{
+		"products": {
+			// Each product's "language" field picks its stemmer.
+			{Keys: textKeys, Options: options.Index().SetName("product_text").SetWeights(textWeights).SetDefaultLanguage("english")},
+			// Name suggestions match prefixes of these words.
+			{Keys: bson.D{{Key: "name_words", Value: 1}}},
+			// A SKU names one variant of one product.
+			{
+				Keys: bson.D{{Key: "variants.sku", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"variants.sku": bson.M{"$exists": true}}),
+			},
+		},
+		"outbox": {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+			{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		},
+		"sessions": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			// Expired sessions are useless; let MongoDB delete them.
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"messages": {
+			// Messages stored before sequence numbers have none until
+			// backfillMessageSeq runs.
+			{
+				Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+			},
+		},
+		"orders": {
+			// The reservation sweeper looks for held stock past its deadline.
+			{Keys: bson.D{{Key: "reservation", Value: 1}, {Key: "reservedUntil", Value: 1}}},
+		},
+		"canned_responses": {
+			{Keys: bson.D{{Key: "shortcut", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"chat_events": {
+			// Typing, receipt and assignment events only matter while change
+			// streams deliver them; messages travel through their own collection.
+			{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(300)},
+		},
+		"chats": {
+			// Every chat lookup goes by chat_id.
+			{Keys: bson.D{{Key: "chat_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			// The admin queue lists open chats by wait time.
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "admin_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		"password_resets": {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+	for name, models := range indexes {
+		if _, err := s.Database.Collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// WithTransaction runs fn so that every repository call made with the
+// context it receives commits or aborts together. Transactions need a
+// replica set; when mongo.transactions is off (or for the in-memory store)
+// fn simply runs with ctx. Called inside another transaction, fn joins it.
+func (s *Store) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.Client == nil || !s.transactions || mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	session, err := s.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// Close disconnects the client. It is a no-op for stores without one.
+func (s *Store) Close(ctx context.Context) error {
+	if s.Client == nil {
+		return nil
+	}
+	return s.Client.Disconnect(ctx)
 }
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type mongoOrderRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoOrderRepository) Create(ctx context.Context, order *models.Order) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	order.ID = ""
+	res, err := r.coll.InsertOne(ctx, order)
+	if err != nil {
+		return err
+	}
+	order.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+func (r *mongoOrderRepository) Get(ctx context.Context, id string) (*models.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	var order models.Order
+	err = r.coll.FindOne(ctx, bson.M{"_id": oid}).Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *mongoOrderRepository) SettleReservation(ctx context.Context, id, reservation, paymentStatus string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"_id": oid, "reservation": models.ReservationHeld}
+	update := bson.M{"$set": bson.M{"reservation": reservation, "paymentStatus": paymentStatus}}
+	res, err := r.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoOrderRepository) ListExpiredReservations(ctx context.Context, now time.Time) ([]models.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{"reservation": models.ReservationHeld, "reservedUntil": bson.M{"$lte": now}}
+	cursor, err := r.coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var orders []models.Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoOutboxRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoOutboxRepository) Enqueue(ctx context.Context, entry *models.OutboxEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	entry.ID = ""
+	res, err := r.coll.InsertOne(ctx, entry)
+	if err != nil {
+		return err
+	}
+	entry.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+func (r *mongoOutboxRepository) ClaimDue(ctx context.Context, now time.Time, lease time.Duration) (*models.OutboxEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": models.OutboxPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"status": models.OutboxSending, "locked_until": bson.M{"$lte": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": models.OutboxSending, "locked_until": now.Add(lease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var entry models.OutboxEntry
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *mongoOutboxRepository) updateOne(ctx context.Context, id string, filter, update bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	filter["_id"] = oid
+	res, err := r.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoOutboxRepository) MarkSent(ctx context.Context, id string, at time.Time) error {
+	return r.updateOne(ctx, id, bson.M{}, bson.M{
+		"$set":   bson.M{"status": models.OutboxSent, "sent_at": at, "last_error": ""},
+		"$unset": bson.M{"locked_until": ""},
+	})
+}
+
+func (r *mongoOutboxRepository) MarkFailed(ctx context.Context, id string, attempts int, lastError string, next time.Time, dead bool) error {
+	status := models.OutboxPending
+	if dead {
+		status = models.OutboxDead
+	}
+	return r.updateOne(ctx, id, bson.M{}, bson.M{
+		"$set": bson.M{
+			"status":          status,
+			"attempts":        attempts,
+			"last_error":      lastError,
+			"next_attempt_at": next,
+		},
+		"$unset": bson.M{"locked_until": ""},
+	})
+}
+
+func (r *mongoOutboxRepository) Retry(ctx context.Context, id string, at time.Time) error {
+	return r.updateOne(ctx, id, bson.M{"status": models.OutboxDead}, bson.M{
+		"$set": bson.M{"status": models.OutboxPending, "attempts": 0, "next_attempt_at": at},
+	})
+}
+
+func (r *mongoOutboxRepository) CountByStatus(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	cursor, err := r.coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func (r *mongoOutboxRepository) List(ctx context.Context, status string, limit int64) ([]models.OutboxEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"message.text": 0, "message.html": 0, "message.attachments.data": 0})
+
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []models.OutboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
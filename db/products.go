@@ -0,0 +1,616 @@
+package db
+
+import (
+	"cheese_market/models"
+	"cheese_market/search"
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoProductRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+
+	// vocabulary caches Vocabulary until a product is written here or
+	// vocabularyTTL passes, which bounds how long writes by other
+	// processes go unseen.
+	vocabularyMu      sync.Mutex
+	vocabulary        []string
+	vocabularyExpires time.Time
+	// writes counts forgetVocabulary calls, so a load that raced with a
+	// write is not cached.
+	writes int
+}
+
+const vocabularyTTL = time.Minute
+
+// forgetVocabulary drops the cached vocabulary after a product write.
+func (r *mongoProductRepository) forgetVocabulary() {
+	r.vocabularyMu.Lock()
+	r.vocabulary = nil
+	r.writes++
+	r.vocabularyMu.Unlock()
+}
+
+func (r *mongoProductRepository) List(ctx context.Context, q ProductQuery) ([]models.Product, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter, err := productFilter(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := int64(-1)
+	if !q.SkipTotal {
+		if total, err = r.coll.CountDocuments(ctx, filter); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if q.After != nil {
+		after, err := cursorFilter(*q.After)
+		if err != nil {
+			return nil, 0, err
+		}
+		filter = bson.M{"$and": bson.A{filter, after}}
+	}
+
+	// _id breaks ties so that pages neither repeat nor miss products.
+	sortOrder := 1
+	if q.SortDesc {
+		sortOrder = -1
+	}
+	sortKeys := bson.D{{Key: "_id", Value: sortOrder}}
+	if q.SortBy != "" {
+		sortKeys = append(bson.D{{Key: q.SortBy, Value: sortOrder}}, sortKeys...)
+	}
+	findOptions := options.Find().SetSort(sortKeys).SetSkip(q.Skip)
+	if q.Limit > 0 {
+		findOptions.SetLimit(q.Limit)
+	}
+
+	cursor, err := r.coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	var products []models.Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, 0, err
+	}
+	return products, total, nil
+}
+
+// cursorFilter matches the products sorted after c.
+func cursorFilter(c ProductCursor) (bson.M, error) {
+	oid, err := objectID(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	op := "$gt"
+	if c.SortDesc {
+		op = "$lt"
+	}
+	if c.SortBy == "" {
+		return bson.M{"_id": bson.M{op: oid}}, nil
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{c.SortBy: bson.M{op: c.Value}},
+		bson.M{c.SortBy: c.Value, "_id": bson.M{op: oid}},
+	}}, nil
+}
+
+// productFilter translates the filters of q into a MongoDB query.
+func productFilter(q ProductQuery) (bson.M, error) {
+	filter := bson.M{}
+	if q.ID != "" {
+		oid, err := objectID(q.ID)
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = oid
+	}
+	if q.Category != "" {
+		filter["category"] = q.Category
+	}
+	for field, values := range map[string][]string{
+		"milk_type": q.MilkTypes,
+		"country":   q.Countries,
+		"region":    q.Regions,
+		"texture":   q.Textures,
+	} {
+		if len(values) > 0 {
+			filter[field] = bson.M{"$in": values}
+		}
+	}
+	if q.Protected != nil {
+		filter["protected"] = true
+		if !*q.Protected {
+			// Products saved before the attribute existed are not protected.
+			filter["protected"] = bson.M{"$ne": true}
+		}
+	}
+	if q.Pasteurized != nil {
+		filter["pasteurized"] = *q.Pasteurized
+	}
+	for field, bounds := range map[string][2]*float64{
+		"price":       {q.MinPrice, q.MaxPrice},
+		"age_months":  {q.MinAge, q.MaxAge},
+		"fat_percent": {q.MinFat, q.MaxFat},
+	} {
+		cond := bson.M{}
+		if bounds[0] != nil {
+			cond["$gte"] = *bounds[0]
+		}
+		if bounds[1] != nil {
+			cond["$lte"] = *bounds[1]
+		}
+		if len(cond) > 0 {
+			filter[field] = cond
+		}
+	}
+	return filter, nil
+}
+
+// Facets counts every facet in one aggregation; each branch of the $facet
+// stage applies the query's filters except the facet's own.
+func (r *mongoProductRepository) Facets(ctx context.Context, q ProductQuery) (ProductFacets, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	branches := bson.M{}
+	for _, facet := range valueFacets {
+		filter, err := productFilter(q.without(facet))
+		if err != nil {
+			return nil, err
+		}
+		var key interface{} = "$" + facet
+		if facet == FacetProtected {
+			key = bson.M{"$ifNull": bson.A{"$protected", false}}
+		}
+		branches[facet] = bson.A{
+			bson.M{"$match": filter},
+			bson.M{"$group": bson.M{"_id": key, "count": bson.M{"$sum": 1}}},
+		}
+	}
+	for _, rf := range rangeFacets {
+		filter, err := productFilter(q.without(rf.field))
+		if err != nil {
+			return nil, err
+		}
+		branches[rf.field] = bson.A{
+			bson.M{"$match": bson.M{"$and": bson.A{filter, bson.M{rf.field: bson.M{"$gte": rf.bounds[0]}}}}},
+			bson.M{"$bucket": bson.M{
+				"groupBy":    "$" + rf.field,
+				"boundaries": rf.bounds,
+				"default":    "top",
+				"output":     bson.M{"count": bson.M{"$sum": 1}},
+			}},
+		}
+	}
+
+	cursor, err := r.coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$facet", Value: branches}}})
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string][]struct {
+		ID    interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	facets := ProductFacets{}
+	if len(results) == 0 {
+		return facets, nil
+	}
+	for _, facet := range valueFacets {
+		counts := []FacetCount{}
+		for _, g := range results[0][facet] {
+			switch v := g.ID.(type) {
+			case string:
+				if v != "" {
+					counts = append(counts, FacetCount{Value: v, Count: g.Count})
+				}
+			case bool:
+				counts = append(counts, FacetCount{Value: strconv.FormatBool(v), Count: g.Count})
+			}
+		}
+		sortValueCounts(counts)
+		facets[facet] = counts
+	}
+	for _, rf := range rangeFacets {
+		counts := []FacetCount{}
+		for i, bound := range rf.bounds {
+			for _, g := range results[0][rf.field] {
+				last := i == len(rf.bounds)-1
+				if lower, ok := g.ID.(float64); (ok && lower == bound && !last) || (g.ID == "top" && last) {
+					counts = append(counts, rangeCount(rf.bounds, i, g.Count))
+				}
+			}
+		}
+		facets[rf.field] = counts
+	}
+	return facets, nil
+}
+
+func (r *mongoProductRepository) Search(ctx context.Context, q ProductSearch) ([]models.Product, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	// The text index stems each product in its own language and the query
+	// in q.Language.
+	filter := bson.M{"$text": bson.M{"$search": q.Text, "$language": q.Language}}
+	score := bson.M{"$meta": "textScore"}
+	findOptions := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "name", Value: 1}}).
+		SetSkip(q.Skip)
+	if q.Limit > 0 {
+		findOptions.SetLimit(q.Limit)
+	}
+
+	cursor, err := r.coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	var products []models.Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	return products, total, nil
+}
+
+func (r *mongoProductRepository) Suggest(ctx context.Context, prefix string, limit int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	// An anchored, case-sensitive regex on the indexed words is a range
+	// scan of the index.
+	filter := bson.M{"name_words": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(strings.ToLower(prefix))}}
+	findOptions := options.Find().
+		SetProjection(bson.M{"name": 1}).
+		SetSort(bson.D{{Key: "name", Value: 1}}).
+		SetLimit(limit)
+
+	cursor, err := r.coll.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var products []models.Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(products))
+	for i, p := range products {
+		names[i] = p.Name
+	}
+	return names, nil
+}
+
+func (r *mongoProductRepository) Vocabulary(ctx context.Context) ([]string, error) {
+	r.vocabularyMu.Lock()
+	cached, writes := r.vocabulary, r.writes
+	if cached != nil && time.Now().After(r.vocabularyExpires) {
+		cached = nil
+	}
+	r.vocabularyMu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	projection := bson.M{}
+	for _, f := range productTextFields {
+		projection[f.field] = 1
+	}
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var products []models.Product
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	words := productVocabulary(products)
+
+	r.vocabularyMu.Lock()
+	if r.writes == writes {
+		r.vocabulary, r.vocabularyExpires = words, time.Now().Add(vocabularyTTL)
+	}
+	r.vocabularyMu.Unlock()
+	return words, nil
+}
+
+func (r *mongoProductRepository) Create(ctx context.Context, product *models.Product) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if err := assignVariantIDs(product, nil); err != nil {
+		return err
+	}
+	product.ID = ""
+	product.NameWords = search.Words(product.Name)
+	res, err := r.coll.InsertOne(ctx, product)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	product.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	r.forgetVocabulary()
+	return nil
+}
+
+func (r *mongoProductRepository) Update(ctx context.Context, product models.Product) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(product.ID)
+	if err != nil {
+		return err
+	}
+	var stored models.Product
+	err = r.coll.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"variants": 1})).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := assignVariantIDs(&product, stored.Variants); err != nil {
+		return err
+	}
+
+	// A variant may only go while nothing of it is reserved; the filter
+	// keeps that true against reservations made since the read.
+	filter := bson.M{"_id": oid}
+	dropped := droppedVariants(product, stored.Variants)
+	unset := bson.M{}
+	for _, id := range dropped {
+		filter["variant_reserved."+id] = bson.M{"$not": bson.M{"$gt": 0}}
+		unset["variant_reserved."+id] = ""
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"name":        product.Name,
+			"name_words":  search.Words(product.Name),
+			"price":       product.Price,
+			"category":    product.Category,
+			"description": product.Description,
+			"milk_type":   product.MilkType,
+			"country":     product.Country,
+			"region":      product.Region,
+			"age_months":  product.AgeMonths,
+			"texture":     product.Texture,
+			"fat_percent": product.FatPercent,
+			"protected":   product.Protected,
+			"pasteurized": product.Pasteurized,
+			"stock":       product.Stock,
+			"variants":    product.Variants,
+		},
+	}
+	// The text index refuses an empty language; leave it out instead.
+	if product.Language != "" {
+		update["$set"].(bson.M)["language"] = product.Language
+	} else {
+		unset["language"] = ""
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	res, err := r.coll.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if len(dropped) > 0 {
+			return r.missingOr(ctx, oid, bson.M{}, ErrReserved)
+		}
+		return ErrNotFound
+	}
+	r.forgetVocabulary()
+	return nil
+}
+
+func (r *mongoProductRepository) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	// Unpaid orders still expect to take their stock when they are paid.
+	filter := bson.M{
+		"_id":      oid,
+		"reserved": bson.M{"$not": bson.M{"$gt": 0}},
+		"$expr": bson.M{"$not": bson.A{bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$variant_reserved", bson.M{}}}},
+			"in":    bson.M{"$gt": bson.A{"$$this.v", 0}},
+		}}}}}},
+	}
+	res, err := r.coll.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		if err := r.missingOr(ctx, oid, bson.M{}, ErrReserved); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	r.forgetVocabulary()
+	return nil
+}
+
+// stockFields locates the stock of a product or one of its variants:
+// what a filter must also match, the stock as an expression, and the paths
+// of the stock and reserved counters for $inc.
+func stockFields(variantID string) (match bson.M, stock interface{}, stockPath, reservedPath string) {
+	if variantID == "" {
+		return bson.M{}, "$stock", "stock", "reserved"
+	}
+	stock = bson.M{"$arrayElemAt": bson.A{"$variants.stock", bson.M{"$indexOfArray": bson.A{"$variants.id", variantID}}}}
+	return bson.M{"variants.id": variantID}, stock, "variants.$.stock", "variant_reserved." + variantID
+}
+
+func (r *mongoProductRepository) Reserve(ctx context.Context, id, variantID string, quantity int) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter, err := r.stockFilter(id, variantID)
+	if err != nil {
+		return err
+	}
+	match, stock, _, reserved := stockFields(variantID)
+	// The availability check and the increment are one update, so two
+	// orders can never both take the last unit.
+	available := bson.M{"$subtract": bson.A{stock, bson.M{"$ifNull": bson.A{"$" + reserved, 0}}}}
+	filter["$expr"] = bson.M{"$gte": bson.A{available, quantity}}
+	res, err := r.coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{reserved: quantity}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return r.missingOr(ctx, filter["_id"], match, ErrInsufficientStock)
+	}
+	return nil
+}
+
+func (r *mongoProductRepository) Release(ctx context.Context, id, variantID string, quantity int) error {
+	_, _, _, reserved := stockFields(variantID)
+	return r.unreserve(ctx, id, variantID, quantity, bson.M{reserved: -quantity})
+}
+
+func (r *mongoProductRepository) Commit(ctx context.Context, id, variantID string, quantity int) error {
+	_, _, stock, reserved := stockFields(variantID)
+	return r.unreserve(ctx, id, variantID, quantity, bson.M{reserved: -quantity, stock: -quantity})
+}
+
+// stockFilter matches the product, and the variant if variantID is set.
+func (r *mongoProductRepository) stockFilter(id, variantID string) (bson.M, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	if variantID != "" {
+		if _, err := objectID(variantID); err != nil {
+			return nil, err
+		}
+	}
+	filter, _, _, _ := stockFields(variantID)
+	filter["_id"] = oid
+	return filter, nil
+}
+
+// unreserve applies inc to a product, or variant, holding at least
+// quantity reserved units.
+func (r *mongoProductRepository) unreserve(ctx context.Context, id, variantID string, quantity int, inc bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	filter, err := r.stockFilter(id, variantID)
+	if err != nil {
+		return err
+	}
+	match, _, _, reserved := stockFields(variantID)
+	filter[reserved] = bson.M{"$gte": quantity}
+	res, err := r.coll.UpdateOne(ctx, filter, bson.M{"$inc": inc})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return r.missingOr(ctx, filter["_id"], match, ErrInsufficientStock)
+	}
+	return nil
+}
+
+// missingOr explains why a conditional update matched nothing: the
+// product or variant is gone (ErrNotFound) or the condition failed (err).
+func (r *mongoProductRepository) missingOr(ctx context.Context, oid interface{}, match bson.M, err error) error {
+	filter := bson.M{"_id": oid}
+	for k, v := range match {
+		filter[k] = v
+	}
+	n, countErr := r.coll.CountDocuments(ctx, filter)
+	if countErr != nil {
+		return countErr
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// backfillSortFields gives products written before a sort field existed
+// its zero value. A missing field sorts before every value and never
+// matches a cursor's filter, so paging would skip those products.
+func (s *Store) backfillSortFields(ctx context.Context) error {
+	raw, err := bson.Marshal(models.Product{})
+	if err != nil {
+		return err
+	}
+	var zero bson.M
+	if err := bson.Unmarshal(raw, &zero); err != nil {
+		return err
+	}
+
+	products := s.Database.Collection("products")
+	for _, field := range ProductSortFields {
+		_, err := products.UpdateMany(ctx, bson.M{field: bson.M{"$exists": false}}, bson.M{"$set": bson.M{field: zero[field]}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillNameWords stores the name words of products written before
+// suggestions used them. Setting them is idempotent, so an interrupted run
+// simply continues on the next start.
+func (s *Store) backfillNameWords(ctx context.Context) error {
+	products := s.Database.Collection("products")
+	cursor, err := products.Find(ctx, bson.M{"name_words": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var p models.Product
+		if err := cursor.Decode(&p); err != nil {
+			return err
+		}
+		oid, err := objectID(p.ID)
+		if err != nil {
+			return err
+		}
+		if _, err := products.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"name_words": search.Words(p.Name)}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,482 @@
+package db
+
+import (
+	"cheese_market/models"
+	"cheese_market/search"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when the requested document does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidID is returned for identifiers that are not valid ObjectIDs.
+	ErrInvalidID = errors.New("invalid id")
+	// ErrDuplicate is returned when a unique field is already taken.
+	ErrDuplicate = errors.New("duplicate")
+	// ErrInsufficientStock is returned when fewer units are available than
+	// requested.
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrReserved is returned when an update or delete would drop a
+	// product or variant that pending orders still hold stock of.
+	ErrReserved = errors.New("reserved")
+)
+
+// ProductQuery describes a page of the product catalog. Empty filters
+// match everything; a list matches products with any of its values.
+type ProductQuery struct {
+	ID       string
+	Category string
+
+	MilkTypes   []string
+	Countries   []string
+	Regions     []string
+	Textures    []string
+	Protected   *bool
+	Pasteurized *bool
+	// Ranges are inclusive; nil leaves that end open.
+	MinPrice, MaxPrice *float64
+	MinAge, MaxAge     *float64
+	MinFat, MaxFat     *float64
+
+	// SortBy is one of ProductSortFields, or empty for insertion order.
+	// Products with equal values keep insertion order among themselves.
+	SortBy   string
+	SortDesc bool
+	Skip     int64
+	Limit    int64
+	// After starts the page right behind the cursor's product instead of
+	// skipping; SortBy and SortDesc must be those the cursor was made with.
+	After *ProductCursor
+	// SkipTotal makes List report a total of -1 instead of counting.
+	SkipTotal bool
+}
+
+// ProductSortFields are the fields the catalog can be sorted by.
+var ProductSortFields = []string{"name", "price", "category", "age_months", "fat_percent"}
+
+// productSortValue is p's value of a sort field: a string or a float64.
+func productSortValue(p models.Product, field string) interface{} {
+	switch field {
+	case "name":
+		return p.Name
+	case "category":
+		return p.Category
+	case "price":
+		return p.Price
+	case "age_months":
+		return float64(p.AgeMonths)
+	case "fat_percent":
+		return p.FatPercent
+	}
+	return nil
+}
+
+// ProductCursor marks the last product of a page so the next one can
+// continue after it. The API hands it out encoded, so the short JSON
+// names only keep it small.
+type ProductCursor struct {
+	SortBy   string `json:"s,omitempty"`
+	SortDesc bool   `json:"d,omitempty"`
+	// Value is the product's SortBy field, nil without SortBy.
+	Value interface{} `json:"v,omitempty"`
+	ID    string      `json:"id"`
+}
+
+// NewProductCursor returns the cursor after p in a listing sorted by
+// sortBy.
+func NewProductCursor(p models.Product, sortBy string, desc bool) ProductCursor {
+	return ProductCursor{SortBy: sortBy, SortDesc: desc, Value: productSortValue(p, sortBy), ID: p.ID}
+}
+
+// Valid reports whether c could have come from NewProductCursor, once
+// decoded from JSON.
+func (c ProductCursor) Valid() bool {
+	if c.SortBy != "" && !slices.Contains(ProductSortFields, c.SortBy) {
+		return false
+	}
+	if _, err := objectID(c.ID); err != nil {
+		return false
+	}
+	return reflect.TypeOf(c.Value) == reflect.TypeOf(productSortValue(models.Product{}, c.SortBy))
+}
+
+// Product facets, the keys of ProductFacets.
+const (
+	FacetCategory    = "category"
+	FacetMilkType    = "milk_type"
+	FacetCountry     = "country"
+	FacetRegion      = "region"
+	FacetTexture     = "texture"
+	FacetProtected   = "protected"
+	FacetPasteurized = "pasteurized"
+	FacetPrice       = "price"
+	FacetAge         = "age_months"
+	FacetFat         = "fat_percent"
+)
+
+// valueFacets count products per distinct value of a field. rangeFacets
+// count them per range of a numeric field: [bounds[i], bounds[i+1]) and,
+// last, everything from the final bound up.
+var (
+	valueFacets = []string{FacetCategory, FacetMilkType, FacetCountry, FacetRegion, FacetTexture, FacetProtected, FacetPasteurized}
+	rangeFacets = []struct {
+		field  string
+		bounds []float64
+	}{
+		{FacetPrice, []float64{0, 10, 20, 50, 100}},
+		{FacetAge, []float64{0, 3, 6, 12, 24}},
+		{FacetFat, []float64{0, 20, 30, 45, 60}},
+	}
+)
+
+// FacetCount is how many products have a value, or fall in a range, of a
+// facet. Ranges also carry their bounds: Min inclusive, Max exclusive and
+// nil for the open-ended last range.
+type FacetCount struct {
+	Value string   `json:"value"`
+	Count int64    `json:"count"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// ProductFacets maps each facet to its counts. A facet is counted with all
+// filters of the query except its own, so picking one value still shows
+// how many products the others would give.
+type ProductFacets map[string][]FacetCount
+
+// without returns q without its filter on facet and without pagination.
+func (q ProductQuery) without(facet string) ProductQuery {
+	q.SortBy, q.Skip, q.Limit = "", 0, 0
+	switch facet {
+	case FacetCategory:
+		q.Category = ""
+	case FacetMilkType:
+		q.MilkTypes = nil
+	case FacetCountry:
+		q.Countries = nil
+	case FacetRegion:
+		q.Regions = nil
+	case FacetTexture:
+		q.Textures = nil
+	case FacetProtected:
+		q.Protected = nil
+	case FacetPasteurized:
+		q.Pasteurized = nil
+	case FacetPrice:
+		q.MinPrice, q.MaxPrice = nil, nil
+	case FacetAge:
+		q.MinAge, q.MaxAge = nil, nil
+	case FacetFat:
+		q.MinFat, q.MaxFat = nil, nil
+	}
+	return q
+}
+
+// rangeCount labels the range of bounds starting at bounds[i].
+func rangeCount(bounds []float64, i int, count int64) FacetCount {
+	min := bounds[i]
+	if i == len(bounds)-1 {
+		return FacetCount{Value: fmt.Sprintf("%g+", min), Count: count, Min: &min}
+	}
+	max := bounds[i+1]
+	return FacetCount{Value: fmt.Sprintf("%g-%g", min, max), Count: count, Min: &min, Max: &max}
+}
+
+// sortValueCounts puts the most common values first.
+func sortValueCounts(counts []FacetCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+}
+
+// ProductSearch is a page of full-text search results.
+type ProductSearch struct {
+	Text string
+	// Language is the language of Text, "english" or "russian".
+	Language string
+	Skip     int64
+	Limit    int64
+}
+
+// productTextFields are the fields product search looks at, with how much
+// a match in each counts towards relevance.
+var productTextFields = []struct {
+	field  string
+	weight int
+}{
+	{"name", 10},
+	{"country", 3},
+	{"region", 3},
+	{"description", 1},
+}
+
+func productText(p models.Product, field string) string {
+	switch field {
+	case "name":
+		return p.Name
+	case "country":
+		return p.Country
+	case "region":
+		return p.Region
+	case "description":
+		return p.Description
+	}
+	return ""
+}
+
+// productVocabulary lists the distinct words of the searchable fields of
+// products, sorted.
+func productVocabulary(products []models.Product) []string {
+	seen := map[string]bool{}
+	var words []string
+	for _, p := range products {
+		for _, f := range productTextFields {
+			for _, w := range search.Words(productText(p, f.field)) {
+				if !seen[w] {
+					seen[w] = true
+					words = append(words, w)
+				}
+			}
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+type ProductRepository interface {
+	// List returns the requested page and the number of products matching
+	// the filter regardless of pagination, unless q.SkipTotal is set.
+	List(ctx context.Context, q ProductQuery) ([]models.Product, int64, error)
+	// Facets counts the products matching q by each facet, ignoring
+	// sorting and pagination.
+	Facets(ctx context.Context, q ProductQuery) (ProductFacets, error)
+	// Search returns the requested page of products matching any word of
+	// q.Text, most relevant first, and how many match in total.
+	Search(ctx context.Context, q ProductSearch) ([]models.Product, int64, error)
+	// Suggest returns up to limit product names, sorted, with a word
+	// starting with prefix.
+	Suggest(ctx context.Context, prefix string, limit int64) ([]string, error)
+	// Vocabulary returns the distinct words search looks at, sorted, to
+	// correct typos against.
+	Vocabulary(ctx context.Context) ([]string, error)
+	// Create and Update give new variants an ID. Both return ErrDuplicate
+	// if another product has a variant with the same SKU.
+	Create(ctx context.Context, product *models.Product) error
+	// Update replaces the product, stock included, but keeps what is
+	// reserved. A variant sent without an ID keeps the ID of the stored
+	// variant with its SKU. Update returns ErrReserved rather than drop a
+	// variant that still has reserved stock.
+	Update(ctx context.Context, product models.Product) error
+	// Delete returns ErrReserved while any of the product's stock is
+	// reserved.
+	Delete(ctx context.Context, id string) error
+	// Reserve holds quantity units of a product, or of one of its variants
+	// if variantID is set, in one atomic step, so concurrent orders can
+	// never hold more than the stock. It returns ErrInsufficientStock if
+	// fewer are available.
+	Reserve(ctx context.Context, id, variantID string, quantity int) error
+	// Release puts reserved units back on sale.
+	Release(ctx context.Context, id, variantID string, quantity int) error
+	// Commit takes reserved units out of stock once they are paid for.
+	Commit(ctx context.Context, id, variantID string, quantity int) error
+}
+
+// assignVariantIDs gives the variants of p without an ID the ID of the
+// stored variant with the same SKU, or a new one. Variant IDs become field
+// names of Product.VariantReserved, so given ones must be ObjectIDs.
+func assignVariantIDs(p *models.Product, stored []models.Variant) error {
+	for i := range p.Variants {
+		v := &p.Variants[i]
+		if v.ID != "" {
+			if _, err := objectID(v.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		v.ID = primitive.NewObjectID().Hex()
+		for _, s := range stored {
+			if s.SKU == v.SKU {
+				v.ID = s.ID
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// droppedVariants returns the IDs of the stored variants that p no longer
+// has.
+func droppedVariants(p models.Product, stored []models.Variant) []string {
+	var dropped []string
+	for _, s := range stored {
+		if p.Variant(s.ID) == nil {
+			dropped = append(dropped, s.ID)
+		}
+	}
+	return dropped
+}
+
+type UserRepository interface {
+	FindByID(ctx context.Context, id string) (*models.User, error)
+	FindByUsername(ctx context.Context, username string) (*models.User, error)
+	FindByEmail(ctx context.Context, email string) (*models.User, error)
+	List(ctx context.Context) ([]models.User, error)
+	Count(ctx context.Context) (int64, error)
+	Create(ctx context.Context, user *models.User) error
+	UpdateRole(ctx context.Context, id, role string) error
+	// MarkVerified flags the user with the given email as verified and
+	// clears the verification code.
+	MarkVerified(ctx context.Context, email string) error
+	// SetVerificationCode replaces the user's verification code and resets
+	// its attempt counter.
+	SetVerificationCode(ctx context.Context, email, code string, sentAt, expiresAt time.Time) error
+	// AddVerificationAttempt counts one guess of the verification code and
+	// returns the number of guesses so far, including this one.
+	AddVerificationAttempt(ctx context.Context, email string) (int, error)
+	SetTOTP(ctx context.Context, id string, totp models.TOTP) error
+	// UseTOTPCounter records that the code for counter was used. It returns
+	// ErrNotFound if a code from that time step or a later one was already
+	// accepted.
+	UseTOTPCounter(ctx context.Context, id string, counter int64) error
+	// UseRecoveryCode removes the recovery code with the given hash, or
+	// returns ErrNotFound if the user has no such code left.
+	UseRecoveryCode(ctx context.Context, id, codeHash string) error
+	UpdatePassword(ctx context.Context, id, passwordHash string) error
+}
+
+type ChatRepository interface {
+	Create(ctx context.Context, chat *models.Chat) error
+	Get(ctx context.Context, chatID string) (*models.Chat, error)
+	Exists(ctx context.Context, chatID string) (bool, error)
+	// Close marks the chat inactive as of at.
+	Close(ctx context.Context, chatID string, at time.Time) error
+	SetEmailTranscript(ctx context.Context, chatID string, enabled bool) error
+	// ListActive returns open chats, longest waiting first.
+	ListActive(ctx context.Context) ([]models.Chat, error)
+	// ListUnassigned returns open chats no admin has taken yet, longest
+	// waiting first.
+	ListUnassigned(ctx context.Context) ([]models.Chat, error)
+	// Assign hands an open chat from fromAdminID ("" for an unclaimed chat)
+	// to toAdminID. It returns ErrNotFound if the chat is closed or no
+	// longer belongs to fromAdminID, so two admins cannot both claim it.
+	Assign(ctx context.Context, chatID, fromAdminID, toAdminID string, at time.Time) error
+	// AdvanceReadCursor moves readerID's read cursor forward to the message
+	// with messageID and seq. It does nothing if the cursor is already there
+	// or further on.
+	AdvanceReadCursor(ctx context.Context, chatID, readerID, messageID string, seq int64) error
+	FindActiveByUser(ctx context.Context, userID string) (*models.Chat, error)
+}
+
+// CannedResponseRepository stores the answers admins send by shortcut.
+// Shortcuts are unique; Create and Update return ErrDuplicate for a taken
+// one.
+type CannedResponseRepository interface {
+	// List returns every canned response ordered by shortcut.
+	List(ctx context.Context) ([]models.CannedResponse, error)
+	FindByShortcut(ctx context.Context, shortcut string) (*models.CannedResponse, error)
+	Create(ctx context.Context, response *models.CannedResponse) error
+	Update(ctx context.Context, response models.CannedResponse) error
+	Delete(ctx context.Context, id string) error
+}
+
+// MessagePage selects a slice of a chat's messages. With After set, the
+// first Limit messages newer than After; otherwise the last Limit messages
+// older than Before, or the latest Limit messages if Before is empty too.
+// Before and After are message IDs; newer means stored later, by Seq.
+type MessagePage struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+type MessageRepository interface {
+	// Append stores message after the chat's last one and sets its ID and
+	// Seq, or returns ErrNotFound if the chat does not exist. Seq order is
+	// commit order only inside Store.WithTransaction; otherwise two
+	// servers appending to one chat at the same moment may store them the
+	// other way round.
+	Append(ctx context.Context, message *models.Message) error
+	Get(ctx context.Context, chatID, id string) (*models.Message, error)
+	// List returns a page of a chat's messages, oldest first. It returns
+	// ErrNotFound if the cursor is not a message of the chat.
+	List(ctx context.Context, chatID string, page MessagePage) ([]models.Message, error)
+	// CountUnread counts messages after afterSeq (0 for all) that someone
+	// other than readerID sent.
+	CountUnread(ctx context.Context, chatID, readerID string, afterSeq int64) (int64, error)
+	// MarkDelivered records that a message reached readerID. Messages that
+	// readerID sent themselves are left alone.
+	MarkDelivered(ctx context.Context, chatID, id, readerID string, at time.Time) error
+	// MarkReadUpTo marks every message up to and including seq that someone
+	// other than readerID sent as delivered and read.
+	MarkReadUpTo(ctx context.Context, chatID string, seq int64, readerID string, at time.Time) error
+}
+
+type OrderRepository interface {
+	Create(ctx context.Context, order *models.Order) error
+	Get(ctx context.Context, id string) (*models.Order, error)
+	// SettleReservation moves an order whose stock is still held to the
+	// given reservation state and payment status. It returns ErrNotFound
+	// if the stock is no longer held, so only one of payment and expiry
+	// settles an order.
+	SettleReservation(ctx context.Context, id, reservation, paymentStatus string) error
+	// ListExpiredReservations returns orders still holding stock after
+	// their ReservedUntil has passed at now.
+	ListExpiredReservations(ctx context.Context, now time.Time) ([]models.Order, error)
+}
+
+type SessionRepository interface {
+	Create(ctx context.Context, session *models.Session) error
+	Get(ctx context.Context, id string) (*models.Session, error)
+	// Rotate replaces the refresh token hash of an active session, but only
+	// if oldHash is still current. It returns ErrNotFound otherwise, which
+	// means the old token was already used or the session has ended.
+	Rotate(ctx context.Context, id, oldHash, newHash string, now, expiresAt time.Time) error
+	Revoke(ctx context.Context, id string, at time.Time) error
+	RevokeAllForUser(ctx context.Context, userID string, at time.Time) (int64, error)
+}
+
+type PasswordResetRepository interface {
+	Create(ctx context.Context, reset *models.PasswordReset) error
+	// Consume marks the unused, unexpired reset with tokenHash as used and
+	// returns it. It returns ErrNotFound if there is no such reset, so a
+	// link works exactly once.
+	Consume(ctx context.Context, tokenHash string, now time.Time) (*models.PasswordReset, error)
+}
+
+type OutboxRepository interface {
+	Enqueue(ctx context.Context, entry *models.OutboxEntry) error
+	// ClaimDue atomically leases the oldest entry that is due at now (or
+	// whose previous lease expired), marks it as sending and counts the
+	// attempt, so an entry that keeps crashing its worker still runs out of
+	// attempts. It returns ErrNotFound when nothing is due.
+	ClaimDue(ctx context.Context, now time.Time, lease time.Duration) (*models.OutboxEntry, error)
+	MarkSent(ctx context.Context, id string, at time.Time) error
+	// MarkFailed records why the claimed attempt failed and either schedules
+	// the next one or moves the entry to the dead letters.
+	MarkFailed(ctx context.Context, id string, attempts int, lastError string, next time.Time, dead bool) error
+	// Retry moves a dead entry back to pending.
+	Retry(ctx context.Context, id string, at time.Time) error
+	CountByStatus(ctx context.Context) (map[string]int64, error)
+	// List returns the newest entries without message bodies or attachment
+	// data: they hold reset links and verification codes.
+	List(ctx context.Context, status string, limit int64) ([]models.OutboxEntry, error)
+}
+
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidID
+	}
+	return oid, nil
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"cheese_market/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoUserRepository struct {
+	coll    *mongo.Collection
+	timeout time.Duration
+}
+
+func (r *mongoUserRepository) findOne(ctx context.Context, filter bson.M) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var user models.User
+	err := r.coll.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) FindByID(ctx context.Context, id string) (*models.User, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.findOne(ctx, bson.M{"_id": oid})
+}
+
+func (r *mongoUserRepository) FindByUsername(ctx context.Context, username string) (*models.User, error) {
+	return r.findOne(ctx, bson.M{"username": username})
+}
+
+func (r *mongoUserRepository) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	return r.findOne(ctx, bson.M{"email": email})
+}
+
+func (r *mongoUserRepository) List(ctx context.Context) ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	cursor, err := r.coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *mongoUserRepository) Count(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	return r.coll.CountDocuments(ctx, bson.M{})
+}
+
+func (r *mongoUserRepository) Create(ctx context.Context, user *models.User) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	user.ID = ""
+	res, err := r.coll.InsertOne(ctx, user)
+	if err != nil {
+		return err
+	}
+	user.ID = res.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+func (r *mongoUserRepository) updateOne(ctx context.Context, filter, update bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoUserRepository) UpdateRole(ctx context.Context, id, role string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	return r.updateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"role": role}})
+}
+
+func (r *mongoUserRepository) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	return r.updateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"password": passwordHash}})
+}
+
+func (r *mongoUserRepository) MarkVerified(ctx context.Context, email string) error {
+	return r.updateOne(ctx,
+		bson.M{"email": email},
+		bson.M{
+			"$set":   bson.M{"verified": true},
+			"$unset": bson.M{"verificationCode": "", "verificationExpiresAt": "", "verificationSentAt": "", "verificationAttempts": ""},
+		},
+	)
+}
+
+func (r *mongoUserRepository) SetVerificationCode(ctx context.Context, email, code string, sentAt, expiresAt time.Time) error {
+	return r.updateOne(ctx,
+		bson.M{"email": email},
+		bson.M{
+			"$set":   bson.M{"verificationCode": code, "verificationSentAt": sentAt, "verificationExpiresAt": expiresAt},
+			"$unset": bson.M{"verificationAttempts": ""},
+		},
+	)
+}
+
+func (r *mongoUserRepository) SetTOTP(ctx context.Context, id string, totp models.TOTP) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	return r.updateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"totp": totp}})
+}
+
+func (r *mongoUserRepository) UseTOTPCounter(ctx context.Context, id string, counter int64) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	return r.updateOne(ctx,
+		bson.M{"_id": oid, "$or": bson.A{
+			bson.M{"totp.lastCounter": bson.M{"$lt": counter}},
+			bson.M{"totp.lastCounter": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"totp.lastCounter": counter}},
+	)
+}
+
+func (r *mongoUserRepository) UseRecoveryCode(ctx context.Context, id, codeHash string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	return r.updateOne(ctx,
+		bson.M{"_id": oid, "totp.recoveryCodes": codeHash},
+		bson.M{"$pull": bson.M{"totp.recoveryCodes": codeHash}},
+	)
+}
+
+func (r *mongoUserRepository) AddVerificationAttempt(ctx context.Context, email string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var user models.User
+	err := r.coll.FindOneAndUpdate(ctx,
+		bson.M{"email": email},
+		bson.M{"$inc": bson.M{"verificationAttempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return user.VerificationAttempts, nil
+}
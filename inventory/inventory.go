@@ -0,0 +1,156 @@
+// Package inventory keeps product stock in step with orders. Placing an
+// order reserves its items, paying for it takes them out of stock, and a
+// failed or abandoned payment puts them back on sale.
+package inventory
+
+import (
+	"cheese_market/db"
+	"cheese_market/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrNotHeld is returned when an order no longer holds stock: it was
+// paid, failed or expired already.
+var ErrNotHeld = errors.New("inventory: order does not hold stock")
+
+// ShortageError names the item that could not be reserved.
+type ShortageError struct {
+	Item models.OrderItem
+	// Err is db.ErrInsufficientStock or db.ErrNotFound for a product that
+	// does not exist.
+	Err error
+}
+
+func (e *ShortageError) Error() string {
+	if errors.Is(e.Err, db.ErrNotFound) {
+		if e.Item.VariantID != "" {
+			return fmt.Sprintf("product %s has no variant %s", e.Item.ID, e.Item.VariantID)
+		}
+		return fmt.Sprintf("product %s does not exist", e.Item.ID)
+	}
+	return fmt.Sprintf("not enough %s in stock for %d", e.Item.Name, e.Item.Quantity)
+}
+
+func (e *ShortageError) Unwrap() error { return e.Err }
+
+// PlaceOrder reserves every item of order and stores it as pending until
+// ttl from now. Either all items are reserved and the order is created, or
+// nothing is: when an item is short the error is a *ShortageError.
+func PlaceOrder(ctx context.Context, store *db.Store, order *models.Order, ttl time.Duration) error {
+	now := time.Now()
+	order.CreatedAt = now
+	order.PaymentStatus = models.PaymentPending
+	order.Reservation = models.ReservationHeld
+	order.ReservedUntil = now.Add(ttl)
+
+	return store.WithTransaction(ctx, func(ctx context.Context) error {
+		for i, item := range order.Items {
+			err := store.Products.Reserve(ctx, item.ID, item.VariantID, item.Quantity)
+			if errors.Is(err, db.ErrInsufficientStock) || errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+				err = &ShortageError{Item: item, Err: err}
+			}
+			if err != nil {
+				// Without transactions nothing rolls back on its own.
+				release(ctx, store, order.Items[:i])
+				return err
+			}
+		}
+		if err := store.Orders.Create(ctx, order); err != nil {
+			release(ctx, store, order.Items)
+			return err
+		}
+		return nil
+	})
+}
+
+// Commit takes the stock held by the order out of stock and marks it paid.
+func Commit(ctx context.Context, store *db.Store, orderID string) error {
+	return settle(ctx, store, orderID, models.ReservationCommitted, models.PaymentPaid, store.Products.Commit)
+}
+
+// Release puts the stock held by the order back on sale and gives it the
+// payment status, models.PaymentFailed or models.PaymentExpired.
+func Release(ctx context.Context, store *db.Store, orderID, paymentStatus string) error {
+	return settle(ctx, store, orderID, models.ReservationReleased, paymentStatus, store.Products.Release)
+}
+
+func settle(ctx context.Context, store *db.Store, orderID, reservation, paymentStatus string, apply func(ctx context.Context, id, variantID string, quantity int) error) error {
+	return store.WithTransaction(ctx, func(ctx context.Context) error {
+		order, err := store.Orders.Get(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		// Settling first makes payment and expiry race for the order, not
+		// for the stock: whoever loses leaves the stock alone.
+		err = store.Orders.SettleReservation(ctx, orderID, reservation, paymentStatus)
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrNotHeld
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range order.Items {
+			if err := apply(ctx, item.ID, item.VariantID, item.Quantity); err != nil {
+				return fmt.Errorf("order %s, product %s: %w", orderID, item.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// release gives back stock reserved for items that ended up without an
+// order. Failures are only logged; the caller is already failing.
+func release(ctx context.Context, store *db.Store, items []models.OrderItem) {
+	for _, item := range items {
+		if err := store.Products.Release(ctx, item.ID, item.VariantID, item.Quantity); err != nil {
+			log.Printf("inventory: could not release %d of %s: %v", item.Quantity, item.ID, err)
+		}
+	}
+}
+
+// ReleaseExpired releases the stock of every order left unpaid past its
+// reservation and returns how many orders it expired.
+func ReleaseExpired(ctx context.Context, store *db.Store, now time.Time) (int, error) {
+	orders, err := store.Orders.ListExpiredReservations(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, order := range orders {
+		err := Release(ctx, store, order.ID, models.PaymentExpired)
+		if errors.Is(err, ErrNotHeld) {
+			continue // paid in the meantime
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// RunSweeper releases expired reservations every interval until ctx is
+// cancelled.
+func RunSweeper(ctx context.Context, store *db.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := ReleaseExpired(ctx, store, now)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("inventory: %v", err)
+			}
+			if n > 0 {
+				log.Printf("inventory: released the stock of %d unpaid orders", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package inventory
+
+import (
+	"cheese_market/db"
+	"cheese_market/models"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setup(t *testing.T, stock ...int) (*db.Store, []models.Product) {
+	t.Helper()
+	store := db.NewMemoryStore()
+	var products []models.Product
+	for i, n := range stock {
+		p := models.Product{Name: string(rune('A' + i)), Stock: n}
+		require.NoError(t, store.Products.Create(context.Background(), &p))
+		products = append(products, p)
+	}
+	return store, products
+}
+
+func product(t *testing.T, store *db.Store, id string) models.Product {
+	t.Helper()
+	products, _, err := store.Products.List(context.Background(), db.ProductQuery{ID: id})
+	require.NoError(t, err)
+	require.Len(t, products, 1)
+	return products[0]
+}
+
+func order(items ...models.OrderItem) *models.Order {
+	return &models.Order{CustomerName: "Ann", Email: "ann@example.com", Items: items}
+}
+
+func TestPlaceOrderReservesAllOrNothing(t *testing.T) {
+	store, p := setup(t, 5, 1)
+	ctx := context.Background()
+
+	err := PlaceOrder(ctx, store, order(
+		models.OrderItem{ID: p[0].ID, Name: "A", Quantity: 2},
+		models.OrderItem{ID: p[1].ID, Name: "B", Quantity: 2},
+	), time.Minute)
+	var shortage *ShortageError
+	require.True(t, errors.As(err, &shortage), "%v", err)
+	assert.Equal(t, p[1].ID, shortage.Item.ID)
+	assert.ErrorIs(t, err, db.ErrInsufficientStock)
+	// What was reserved for A before B ran short is back on sale.
+	assert.Equal(t, 5, product(t, store, p[0].ID).Available())
+
+	o := order(models.OrderItem{ID: p[0].ID, Name: "A", Quantity: 2}, models.OrderItem{ID: p[1].ID, Name: "B", Quantity: 1})
+	require.NoError(t, PlaceOrder(ctx, store, o, time.Minute))
+	assert.Equal(t, models.PaymentPending, o.PaymentStatus)
+	assert.Equal(t, 3, product(t, store, p[0].ID).Available())
+	assert.Equal(t, 0, product(t, store, p[1].ID).Available())
+}
+
+func TestCommitAndRelease(t *testing.T) {
+	store, p := setup(t, 5)
+	ctx := context.Background()
+
+	paid := order(models.OrderItem{ID: p[0].ID, Quantity: 2})
+	require.NoError(t, PlaceOrder(ctx, store, paid, time.Minute))
+	failed := order(models.OrderItem{ID: p[0].ID, Quantity: 1})
+	require.NoError(t, PlaceOrder(ctx, store, failed, time.Minute))
+
+	require.NoError(t, Commit(ctx, store, paid.ID))
+	require.NoError(t, Release(ctx, store, failed.ID, models.PaymentFailed))
+
+	got := product(t, store, p[0].ID)
+	assert.Equal(t, 3, got.Stock)
+	assert.Equal(t, 3, got.Available())
+
+	o, err := store.Orders.Get(ctx, paid.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentPaid, o.PaymentStatus)
+	assert.Equal(t, models.ReservationCommitted, o.Reservation)
+
+	// Settling twice changes nothing.
+	assert.ErrorIs(t, Commit(ctx, store, paid.ID), ErrNotHeld)
+	assert.ErrorIs(t, Release(ctx, store, failed.ID, models.PaymentFailed), ErrNotHeld)
+	assert.Equal(t, 3, product(t, store, p[0].ID).Stock)
+}
+
+func TestReleaseExpired(t *testing.T) {
+	store, p := setup(t, 5)
+	ctx := context.Background()
+
+	stale := order(models.OrderItem{ID: p[0].ID, Quantity: 2})
+	require.NoError(t, PlaceOrder(ctx, store, stale, time.Minute))
+	fresh := order(models.OrderItem{ID: p[0].ID, Quantity: 1})
+	require.NoError(t, PlaceOrder(ctx, store, fresh, time.Hour))
+
+	n, err := ReleaseExpired(ctx, store, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 4, product(t, store, p[0].ID).Available())
+
+	// Paying after expiry is too late; the stock may be sold to others.
+	assert.ErrorIs(t, Commit(ctx, store, stale.ID), ErrNotHeld)
+	o, err := store.Orders.Get(ctx, stale.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentExpired, o.PaymentStatus)
+
+	require.NoError(t, Commit(ctx, store, fresh.ID))
+	assert.Equal(t, 4, product(t, store, p[0].ID).Stock)
+}
+
+func TestVariantStock(t *testing.T) {
+	store := db.NewMemoryStore()
+	ctx := context.Background()
+	p := models.Product{Name: "Comté", Stock: 10, Variants: []models.Variant{
+		{SKU: "C-250", Unit: models.UnitGram, Size: 250, Stock: 3},
+	}}
+	require.NoError(t, store.Products.Create(ctx, &p))
+	variant := p.Variants[0].ID
+
+	err := PlaceOrder(ctx, store, order(models.OrderItem{ID: p.ID, VariantID: variant, Name: "Comté", Quantity: 4}), time.Minute)
+	assert.ErrorIs(t, err, db.ErrInsufficientStock)
+
+	o := order(models.OrderItem{ID: p.ID, VariantID: variant, Quantity: 2})
+	require.NoError(t, PlaceOrder(ctx, store, o, time.Minute))
+	require.NoError(t, Commit(ctx, store, o.ID))
+
+	got := product(t, store, p.ID)
+	assert.Equal(t, 1, got.Variants[0].Stock)
+	assert.Equal(t, 1, got.VariantAvailable(variant))
+	// The product's own stock is untouched.
+	assert.Equal(t, 10, got.Available())
+}
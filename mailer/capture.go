@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// CaptureMailer keeps messages in memory so tests can inspect them.
+type CaptureMailer struct {
+	from string
+
+	mu       sync.Mutex
+	messages []Message
+	err      error
+}
+
+func NewCapture(from string) *CaptureMailer {
+	return &CaptureMailer{from: from}
+}
+
+func (c *CaptureMailer) Send(ctx context.Context, msg *Message) error {
+	if _, err := build(msg, c.from); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	captured := *msg
+	if captured.From == "" {
+		captured.From = c.from
+	}
+	c.messages = append(c.messages, captured)
+	return nil
+}
+
+// SetErr makes every following Send fail with err until it is reset to nil.
+func (c *CaptureMailer) SetErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+}
+
+// Messages returns a copy of everything sent so far.
+func (c *CaptureMailer) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Message(nil), c.messages...)
+}
+
+// Last returns the most recent message, or nil if nothing was sent.
+func (c *CaptureMailer) Last() *Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.messages) == 0 {
+		return nil
+	}
+	msg := c.messages[len(c.messages)-1]
+	return &msg
+}
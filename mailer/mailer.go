@@ -0,0 +1,99 @@
+// Package mailer sends the shop's emails through a configurable backend:
+// a real SMTP server, a directory of .eml files or an in-process capture.
+package mailer
+
+import (
+	"cheese_market/config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+type Attachment struct {
+	Filename    string `bson:"filename" json:"filename"`
+	ContentType string `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Data        []byte `bson:"data" json:"-"`
+}
+
+type Message struct {
+	// From defaults to the configured sender when empty.
+	From        string       `bson:"from,omitempty" json:"from,omitempty"`
+	To          []string     `bson:"to" json:"to"`
+	Subject     string       `bson:"subject" json:"subject"`
+	Text        string       `bson:"text,omitempty" json:"text,omitempty"`
+	HTML        string       `bson:"html,omitempty" json:"html,omitempty"`
+	Attachments []Attachment `bson:"attachments,omitempty" json:"attachments,omitempty"`
+}
+
+// Mailer delivers a single message.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New returns the backend selected by cfg.Mail.Backend.
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.Mail.Backend {
+	case "smtp":
+		return NewSMTP(cfg.SMTP, cfg.Mail.From), nil
+	case "file":
+		return NewFile(cfg.Mail.Dir, cfg.Mail.From)
+	case "capture":
+		return NewCapture(cfg.Mail.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", cfg.Mail.Backend)
+	}
+}
+
+// build converts msg into a gomail message, which both the SMTP and the file
+// backend know how to serialise.
+func build(msg *Message, defaultFrom string) (*gomail.Message, error) {
+	if len(msg.To) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+	if msg.Text == "" && msg.HTML == "" {
+		return nil, errors.New("message has no body")
+	}
+
+	from := msg.From
+	if from == "" {
+		from = defaultFrom
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", msg.To...)
+	m.SetHeader("Subject", msg.Subject)
+
+	switch {
+	case msg.Text != "" && msg.HTML != "":
+		m.SetBody("text/plain", msg.Text)
+		m.AddAlternative("text/html", msg.HTML)
+	case msg.HTML != "":
+		m.SetBody("text/html", msg.HTML)
+	default:
+		m.SetBody("text/plain", msg.Text)
+	}
+
+	for _, a := range msg.Attachments {
+		data := a.Data
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		}
+		if a.ContentType != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}))
+		}
+		m.Attach(a.Filename, settings...)
+	}
+	return m, nil
+}
+
+func recipients(msg *Message) string {
+	return strings.Join(msg.To, ", ")
+}
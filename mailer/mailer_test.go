@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailerWritesEML(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFile(dir, "shop@example.com")
+	require.NoError(t, err)
+
+	err = m.Send(context.Background(), &Message{
+		To:      []string{"ann@example.com"},
+		Subject: "Your Payment Receipt",
+		Text:    "Please find your receipt attached.",
+		HTML:    "<p>Please find your receipt attached.</p>",
+		Attachments: []Attachment{{
+			Filename:    "receipt.pdf",
+			ContentType: "application/pdf",
+			Data:        []byte("%PDF-1.3"),
+		}},
+	})
+	require.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	raw, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	eml := string(raw)
+	assert.Contains(t, eml, "From: shop@example.com")
+	assert.Contains(t, eml, "To: ann@example.com")
+	assert.Contains(t, eml, "Subject: Your Payment Receipt")
+	assert.Contains(t, eml, "text/html")
+	assert.Contains(t, eml, `filename="receipt.pdf"`)
+}
+
+func TestCaptureMailer(t *testing.T) {
+	m := NewCapture("shop@example.com")
+
+	assert.Error(t, m.Send(context.Background(), &Message{Subject: "no recipients", Text: "x"}))
+	assert.Nil(t, m.Last())
+
+	require.NoError(t, m.Send(context.Background(), &Message{To: []string{"ann@example.com"}, Text: "hello"}))
+	require.NotNil(t, m.Last())
+	assert.Equal(t, "shop@example.com", m.Last().From)
+
+	m.SetErr(assert.AnError)
+	assert.ErrorIs(t, m.Send(context.Background(), &Message{To: []string{"ann@example.com"}, Text: "again"}), assert.AnError)
+	assert.Len(t, m.Messages(), 1)
+}
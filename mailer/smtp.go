@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"cheese_market/config"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"gopkg.in/gomail.v2"
+)
+
+// SMTPMailer delivers messages through an SMTP relay.
+type SMTPMailer struct {
+	cfg  config.SMTP
+	from string
+}
+
+func NewSMTP(cfg config.SMTP, from string) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg, from: from}
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m, err := build(msg, s.from)
+	if err != nil {
+		return err
+	}
+
+	// A fresh dialer per message: gomail caches the negotiated auth on it.
+	d := gomail.NewDialer(s.cfg.Host, s.cfg.Port, s.cfg.Username, s.cfg.Password)
+	d.SSL = s.cfg.TLS == "tls"
+	d.TLSConfig = &tls.Config{
+		ServerName:         s.cfg.Host,
+		InsecureSkipVerify: s.cfg.InsecureSkipVerify,
+	}
+
+	if err := d.DialAndSend(m); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	log.Printf("Email sent successfully to: %s", recipients(msg))
+	return nil
+}
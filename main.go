@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"cheese_market/auth"
+	"cheese_market/chat"
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/inventory"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
+	"cheese_market/search"
+	"cheese_market/transcript"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +26,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -23,49 +37,17 @@ import (
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/time/rate"
-	"gopkg.in/gomail.v2"
 )
 
 var (
-	collection    *mongo.Collection
+	cfg           *config.Config
+	store         *db.Store
 	templateDir   string
 	staticDir     string
 	uploadTempDir string
 )
 
-type Product struct {
-	ID       string  `json:"id" bson:"_id,omitempty"`
-	Name     string  `json:"name" bson:"name"`
-	Price    float64 `json:"price" bson:"price"`
-	Category string  `json:"category" bson:"category"`
-}
-type User struct {
-	ID               string `bson:"_id,omitempty" json:"id"`
-	Email            string `bson:"email" json:"email"`
-	Username         string `bson:"username" json:"username"`
-	Password         string `bson:"password,omitempty" json:"-"`
-	Role             string `bson:"role" json:"role"`
-	Verified         bool   `bson:"verified" json:"verified"`
-	VerificationCode string `bson:"verificationCode,omitempty" json:"-"`
-}
-type Chat struct {
-	ChatID    string    `bson:"chat_id" json:"chat_id"`
-	UserID    string    `bson:"user_id" json:"user_id"`
-	AdminID   string    `bson:"admin_id,omitempty" json:"admin_id,omitempty"`
-	Status    string    `bson:"status" json:"status"`
-	Messages  []Message `bson:"messages" json:"messages"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-}
-
-type Message struct {
-	Sender    string    `json:"sender" bson:"sender"`
-	Content   string    `json:"content" bson:"content"`
-	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
-}
-
 func initPaths() {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -86,27 +68,6 @@ func initPaths() {
 	}
 }
 
-var chatCollection *mongo.Collection
-
-func connectMongoDB() {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-	err = client.Ping(context.TODO(), nil)
-	if err != nil {
-		log.Fatalf("MongoDB connection failed: %v", err)
-	}
-
-	fmt.Println("Connected to MongoDB!")
-
-	db := client.Database("cheeseMarket")
-	collection = db.Collection("products")
-	chatCollection = db.Collection("chats")
-}
-
 // Serves static HTML files from the templates directory
 func serveHTML(w http.ResponseWriter, r *http.Request, filename string) {
 	filePath := filepath.Join(templateDir, filename)
@@ -136,145 +97,153 @@ func handleProducts(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		id := r.URL.Query().Get("id")
 		sortBy := r.URL.Query().Get("sortBy")
+		// script.js has always sent sortOrder; order is the documented name.
 		order := r.URL.Query().Get("order")
-		page := r.URL.Query().Get("page")
-		pageSize := r.URL.Query().Get("pageSize")
-		category := r.URL.Query().Get("category")
-
-		filter := bson.M{}
-
-		if id != "" {
-			objectID, err := primitive.ObjectIDFromHex(id)
-			if err != nil {
-				http.Error(w, "Invalid ID format", http.StatusBadRequest)
-				return
-			}
-			filter["_id"] = objectID
+		if order == "" {
+			order = r.URL.Query().Get("sortOrder")
 		}
+		category := r.URL.Query().Get("category")
 
-		if category != "" {
-			filter["category"] = category
+		if sortBy != "" && !slices.Contains(db.ProductSortFields, sortBy) {
+			http.Error(w, "sortBy must be one of "+strings.Join(db.ProductSortFields, ", "), http.StatusBadRequest)
+			return
 		}
-
-		findOptions := options.Find()
-
-		// Sorting
-		if sortBy != "" {
-			sortOrder := 1
-			if order == "desc" {
-				sortOrder = -1
-			}
-			findOptions.SetSort(bson.D{{Key: sortBy, Value: sortOrder}})
+		if order != "" && order != "asc" && order != "desc" {
+			http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+			return
 		}
 
-		// Pagination
-		p, _ := strconv.Atoi(page)
-		ps, _ := strconv.Atoi(pageSize)
-		if p < 1 {
-			p = 1
+		query := db.ProductQuery{
+			ID:       id,
+			Category: category,
+			SortBy:   sortBy,
+			SortDesc: order == "desc",
 		}
-		if ps < 1 {
-			ps = 10
+		if err := parseProductFilters(r.URL.Query(), &query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		skip := (p - 1) * ps
-		findOptions.SetSkip(int64(skip))
-		findOptions.SetLimit(int64(ps))
 
-		// Getting products
-		cursor, err := collection.Find(context.TODO(), filter, findOptions)
+		// A cursor continues a listing, keeping its sort; counting the
+		// total and facets again is then left to the client to ask for.
+		p, ps, err := pageParams(r)
 		if err != nil {
-			http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer cursor.Close(context.TODO())
-
-		var products []Product
-		for cursor.Next(context.TODO()) {
-			var product Product
-			if err = cursor.Decode(&product); err != nil {
-				http.Error(w, "Failed to decode data", http.StatusInternalServerError)
+		cursor := r.URL.Query().Get("cursor")
+		counted := true
+		if cursor != "" {
+			after, ok := decodeProductCursor(cursor)
+			if !ok {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
 				return
 			}
-			products = append(products, product)
+			query.After = after
+			query.SortBy, query.SortDesc = after.SortBy, after.SortDesc
+			counted = r.URL.Query().Get("includeTotal") == "true"
+			query.SkipTotal = !counted
+		} else {
+			query.Skip = int64((p - 1) * ps)
 		}
+		// One extra product tells whether there is a next page.
+		query.Limit = int64(ps) + 1
 
-		if err := cursor.Err(); err != nil {
-			http.Error(w, "Error during cursor iteration", http.StatusInternalServerError)
+		// Getting products
+		products, totalCount, err := store.Products.List(r.Context(), query)
+		if errors.Is(err, db.ErrInvalidID) {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
 			return
 		}
 
-		if len(products) == 0 {
+		if len(products) == 0 && cursor == "" {
 			http.Error(w, "No products match the filter", http.StatusNotFound)
 			return
 		}
 
-		totalCount, err := collection.CountDocuments(context.TODO(), filter)
-		if err != nil {
-			http.Error(w, "Failed to fetch total count", http.StatusInternalServerError)
-			return
+		markStock(products)
+		nextCursor := ""
+		if len(products) > ps {
+			products = products[:ps]
+			nextCursor = encodeProductCursor(db.NewProductCursor(products[ps-1], query.SortBy, query.SortDesc))
 		}
 
 		response := map[string]interface{}{
 			"products":   products,
-			"total":      totalCount,
-			"page":       p,
 			"pageSize":   ps,
-			"totalPages": (totalCount + int64(ps) - 1) / int64(ps),
+			"nextCursor": nextCursor,
+		}
+		if cursor == "" {
+			response["page"] = p
+		}
+		if counted {
+			facets, err := store.Products.Facets(r.Context(), query)
+			if err != nil {
+				log.Printf("Error counting product facets: %v", err)
+				http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+				return
+			}
+			response["facets"] = facets
+			response["total"] = totalCount
+			response["totalPages"] = (totalCount + int64(ps) - 1) / int64(ps)
 		}
 
 		json.NewEncoder(w).Encode(response)
 
 	case http.MethodPost:
-		var product Product
+		var product models.Product
 		err := json.NewDecoder(r.Body).Decode(&product)
 		if err != nil {
 			http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 			return
 		}
-		_, err = collection.InsertOne(context.TODO(), product)
-		if err != nil {
+		if problem := validateProduct(product); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		err = store.Products.Create(r.Context(), &product)
+		if errors.Is(err, db.ErrInvalidID) {
+			http.Error(w, "Invalid variant ID format", http.StatusBadRequest)
+			return
+		} else if errors.Is(err, db.ErrDuplicate) {
+			http.Error(w, "A variant SKU is already used by another product", http.StatusConflict)
+			return
+		} else if err != nil {
 			http.Error(w, "Failed to insert data", http.StatusInternalServerError)
 			return
 		}
 		json.NewEncoder(w).Encode(map[string]string{"message": "Product added successfully!"})
 
 	case http.MethodPut:
-		var payload struct {
-			ID       string  `json:"id"`
-			Name     string  `json:"name"`
-			Price    float64 `json:"price"`
-			Category string  `json:"category"`
-		}
-
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		var product models.Product
+		if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
 			http.Error(w, "Failed to decode request body", http.StatusBadRequest)
 			return
 		}
-
-		objectID, err := primitive.ObjectIDFromHex(payload.ID)
-		if err != nil {
-			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		if problem := validateProduct(product); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
 			return
 		}
 
-		filter := bson.M{"_id": objectID}
-		update := bson.M{
-			"$set": bson.M{
-				"name":     payload.Name,
-				"price":    payload.Price,
-				"category": payload.Category,
-			},
-		}
-
-		result, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			http.Error(w, "Failed to update product", http.StatusInternalServerError)
+		err := store.Products.Update(r.Context(), product)
+		if errors.Is(err, db.ErrInvalidID) {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
 			return
-		}
-
-		if result.MatchedCount == 0 {
+		} else if errors.Is(err, db.ErrNotFound) {
 			http.Error(w, "Product not found", http.StatusNotFound)
 			return
+		} else if errors.Is(err, db.ErrDuplicate) {
+			http.Error(w, "A variant SKU is already used by another product", http.StatusConflict)
+			return
+		} else if errors.Is(err, db.ErrReserved) {
+			http.Error(w, "A removed variant is held by unpaid orders", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to update product", http.StatusInternalServerError)
+			return
 		}
 
 		json.NewEncoder(w).Encode(map[string]string{"message": "Product updated successfully!"})
@@ -288,15 +257,14 @@ func handleProducts(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		objectID, err := primitive.ObjectIDFromHex(payload.ID)
-		if err != nil {
+		err := store.Products.Delete(r.Context(), payload.ID)
+		if errors.Is(err, db.ErrInvalidID) {
 			http.Error(w, "Invalid ID format", http.StatusBadRequest)
 			return
-		}
-
-		filter := bson.M{"_id": objectID}
-		_, err = collection.DeleteOne(context.TODO(), filter)
-		if err != nil {
+		} else if errors.Is(err, db.ErrReserved) {
+			http.Error(w, "The product is held by unpaid orders", http.StatusConflict)
+			return
+		} else if err != nil {
 			http.Error(w, "Failed to delete product", http.StatusInternalServerError)
 			return
 		}
@@ -308,6 +276,261 @@ func handleProducts(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// markStock flags the products and variants that cannot be ordered right
+// now and fills in the price per kg of each variant. A product with
+// variants is out of stock when all of them are.
+func markStock(products []models.Product) {
+	for i := range products {
+		p := &products[i]
+		if len(p.Variants) == 0 {
+			p.OutOfStock = p.Available() <= 0
+			continue
+		}
+		p.OutOfStock = true
+		for j := range p.Variants {
+			v := &p.Variants[j]
+			v.OutOfStock = p.VariantAvailable(v.ID) <= 0
+			v.PricePerKg = v.PerKg()
+			if !v.OutOfStock {
+				p.OutOfStock = false
+			}
+		}
+	}
+}
+
+// maxPageSize caps the pageSize of catalog requests.
+const maxPageSize = 100
+
+// pageParams reads the page and pageSize of a catalog request, defaulting to
+// the first page of 10 and capping pageSize at maxPageSize. It fails on
+// values that are not numbers.
+func pageParams(r *http.Request) (page, pageSize int, err error) {
+	page, pageSize = 1, 10
+	if v := r.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil {
+			return 0, 0, errors.New("page must be a number")
+		}
+		page = max(page, 1)
+	}
+	if v := r.URL.Query().Get("pageSize"); v != "" {
+		if pageSize, err = strconv.Atoi(v); err != nil {
+			return 0, 0, errors.New("pageSize must be a number")
+		}
+		if pageSize < 1 {
+			pageSize = 10
+		}
+		pageSize = min(pageSize, maxPageSize)
+	}
+	return page, pageSize, nil
+}
+
+// encodeProductCursor makes c opaque to clients; they only hand it back.
+func encodeProductCursor(c db.ProductCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeProductCursor(s string) (*db.ProductCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var c db.ProductCursor
+	if err := json.Unmarshal(data, &c); err != nil || !c.Valid() {
+		return nil, false
+	}
+	return &c, true
+}
+
+// handleProductSearch serves GET /products/search?q=. Results are ranked by
+// relevance and paginated like /products. When nothing matches, typos in q
+// are corrected against the catalog's words and the search is retried;
+// "corrected" then holds the query that was used.
+func handleProductSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	p, ps, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := db.ProductSearch{
+		Text:     q,
+		Language: search.Language(q),
+		Skip:     int64((p - 1) * ps),
+		Limit:    int64(ps),
+	}
+
+	products, totalCount, err := store.Products.Search(r.Context(), query)
+	if err != nil {
+		log.Printf("Error searching products for %q: %v", q, err)
+		http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+		return
+	}
+
+	corrected := ""
+	if totalCount == 0 {
+		vocabulary, err := store.Products.Vocabulary(r.Context())
+		if err != nil {
+			log.Printf("Error loading search vocabulary: %v", err)
+			http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+			return
+		}
+		if c := search.Correct(q, vocabulary); c != strings.Join(search.Words(q), " ") {
+			corrected, query.Text = c, c
+			products, totalCount, err = store.Products.Search(r.Context(), query)
+			if err != nil {
+				log.Printf("Error searching products for %q: %v", c, err)
+				http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if products == nil {
+		products = []models.Product{}
+	}
+	markStock(products)
+
+	response := map[string]interface{}{
+		"query":      q,
+		"products":   products,
+		"total":      totalCount,
+		"page":       p,
+		"pageSize":   ps,
+		"totalPages": (totalCount + int64(ps) - 1) / int64(ps),
+	}
+	if corrected != "" {
+		response["corrected"] = corrected
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// maxSuggestions caps the limit of GET /products/suggest.
+const maxSuggestions = 20
+
+// handleProductSuggest serves GET /products/suggest?q=, the names of
+// products with a word starting with q, for autocompleting the search box.
+func handleProductSuggest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > maxSuggestions {
+		limit = 5
+	}
+	suggestions := []string{}
+	if prefix := strings.TrimSpace(r.URL.Query().Get("q")); prefix != "" {
+		names, err := store.Products.Suggest(r.Context(), prefix, int64(limit))
+		if err != nil {
+			log.Printf("Error suggesting products for %q: %v", prefix, err)
+			http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+			return
+		}
+		suggestions = append(suggestions, names...)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"suggestions": suggestions})
+}
+
+// validateProduct reports what is wrong with a product sent by an admin.
+func validateProduct(p models.Product) string {
+	switch {
+	case !p.MilkType.Valid():
+		return "milk_type must be cow, goat, sheep, buffalo or mixed"
+	case !p.Texture.Valid():
+		return "texture must be fresh, soft, semi-soft, semi-hard or hard"
+	case p.Price < 0:
+		return "price must not be negative"
+	case p.Stock < 0:
+		return "stock must not be negative"
+	case p.AgeMonths < 0:
+		return "age_months must not be negative"
+	case p.FatPercent < 0 || p.FatPercent > 100:
+		return "fat_percent must be between 0 and 100"
+	case !search.ValidLanguage(p.Language):
+		return "language must be english or russian"
+	}
+	skus := map[string]bool{}
+	for _, v := range p.Variants {
+		switch {
+		case v.SKU == "":
+			return "every variant needs a sku"
+		case skus[v.SKU]:
+			return "variant sku " + v.SKU + " is used twice"
+		case v.Unit != models.UnitGram && v.Unit != models.UnitKilogram && v.Unit != models.UnitPiece:
+			return "variant unit must be g, kg or piece"
+		case v.Size <= 0:
+			return "variant size must be positive"
+		case v.Price < 0:
+			return "variant price must not be negative"
+		case v.Stock < 0:
+			return "variant stock must not be negative"
+		case v.WeightGrams < 0:
+			return "variant weight_grams must not be negative"
+		}
+		skus[v.SKU] = true
+	}
+	return ""
+}
+
+// parseProductFilters reads the attribute filters of GET /products into q.
+// milk_type, country, region and texture take several values, repeated or
+// comma-separated; protected and pasteurized take true or false; price,
+// age and fat take min_ and max_ bounds.
+func parseProductFilters(values url.Values, q *db.ProductQuery) error {
+	list := func(key string) []string {
+		var out []string
+		for _, v := range values[key] {
+			for _, part := range strings.Split(v, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					out = append(out, part)
+				}
+			}
+		}
+		return out
+	}
+	q.MilkTypes = list("milk_type")
+	q.Countries = list("country")
+	q.Regions = list("region")
+	q.Textures = list("texture")
+
+	for key, dst := range map[string]**bool{"protected": &q.Protected, "pasteurized": &q.Pasteurized} {
+		if v := values.Get(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", key)
+			}
+			*dst = &b
+		}
+	}
+
+	for key, dst := range map[string]**float64{
+		"min_price": &q.MinPrice, "max_price": &q.MaxPrice,
+		"min_age": &q.MinAge, "max_age": &q.MaxAge,
+		"min_fat": &q.MinFat, "max_fat": &q.MaxFat,
+	} {
+		if v := values.Get(key); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", key)
+			}
+			*dst = &f
+		}
+	}
+	return nil
+}
+
 func fetchEmailDataFromPage(url string) (string, string, string, []byte, string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -382,43 +605,21 @@ type EmailPayload struct {
 	} `json:"file"`
 }
 
-func sendEmail(to, subject, body string, fileData []byte, fileName string) error {
-	smtpHost := "smtp.office365.com"
-	smtpPort := 587
-	username := "230047@astanait.edu.kz"
-	password := "aRBmKl1O0G0kw"
-
-	m := gomail.NewMessage()
-	m.SetHeader("From", username)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", body)
-
+// sendEmail queues the email in the outbox; the worker delivers it.
+func sendEmail(ctx context.Context, to, subject, body string, fileData []byte, fileName string) error {
+	msg := mailer.Message{
+		To:      []string{to},
+		Subject: subject,
+		Text:    body,
+	}
 	if len(fileData) > 0 {
-		tempFile, err := ioutil.TempFile("", fileName)
-		if err != nil {
-			return fmt.Errorf("failed to create temp file: %w", err)
-		}
-		defer os.Remove(tempFile.Name())
-
-		if _, err := tempFile.Write(fileData); err != nil {
-			return fmt.Errorf("failed to write to temp file: %w", err)
-		}
-		if err := tempFile.Close(); err != nil {
-			return fmt.Errorf("failed to close temp file: %w", err)
-		}
-
-		m.Attach(tempFile.Name(), gomail.Rename(fileName))
+		msg.Attachments = append(msg.Attachments, mailer.Attachment{Filename: fileName, Data: fileData})
 	}
 
-	d := gomail.NewDialer(smtpHost, smtpPort, username, password)
-
-	if err := d.DialAndSend(m); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return fmt.Errorf("failed to send email: %w", err)
+	if err := outbox.Enqueue(ctx, store.Outbox, msg); err != nil {
+		log.Printf("Error queueing email: %v", err)
+		return err
 	}
-
-	log.Printf("Email sent successfully to: %s", to)
 	return nil
 }
 
@@ -438,8 +639,8 @@ func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Sending email to: %s", payload.To)
-	err = sendEmail(payload.To, payload.Subject, payload.Body, fileData, payload.File.Filename)
+	log.Printf("Queueing email to: %s", payload.To)
+	err = sendEmail(r.Context(), payload.To, payload.Subject, payload.Body, fileData, payload.File.Filename)
 	if err != nil {
 		log.Printf("Error sending email: %v", err)
 		http.Error(w, "Failed to send email", http.StatusInternalServerError)
@@ -447,7 +648,7 @@ func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]string{
-		"status": "Email sent successfully!",
+		"status": "Email queued for delivery",
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -456,7 +657,80 @@ func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to encode response JSON", http.StatusInternalServerError)
 	}
 
-	log.Printf("Email sent successfully!")
+	log.Printf("Email queued successfully!")
+}
+
+// getOutbox reports how many emails are in each outbox state and lists the
+// most recent entries, optionally only those with ?status=.
+func getOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := int64(50)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	counts, err := store.Outbox.CountByStatus(r.Context())
+	if err != nil {
+		log.Printf("Error counting outbox entries: %v", err)
+		http.Error(w, "Failed to read outbox", http.StatusInternalServerError)
+		return
+	}
+	entries, err := store.Outbox.List(r.Context(), r.URL.Query().Get("status"), limit)
+	if err != nil {
+		log.Printf("Error listing outbox entries: %v", err)
+		http.Error(w, "Failed to read outbox", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []models.OutboxEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"counts":  counts,
+		"entries": entries,
+	})
+}
+
+// retryOutboxEntry puts a dead-lettered email back in the queue.
+func retryOutboxEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := store.Outbox.Retry(r.Context(), req.ID, time.Now())
+	if errors.Is(err, db.ErrInvalidID) {
+		http.Error(w, "Invalid outbox ID", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "No dead outbox entry with this ID", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrying outbox entry %s: %v", req.ID, err)
+		http.Error(w, "Failed to retry entry", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "Email requeued"})
 }
 
 func rateLimiter(next http.Handler, limiter *rate.Limiter) http.Handler {
@@ -471,29 +745,11 @@ func rateLimiter(next http.Handler, limiter *rate.Limiter) http.Handler {
 func getUsersEmailList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	usersCollection := collection.Database().Collection("users")
-
-	cursor, err := usersCollection.Find(context.TODO(), bson.M{})
+	users, err := store.Users.List(r.Context())
 	if err != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var users []User
-	for cursor.Next(context.TODO()) {
-		var user User
-		if err := cursor.Decode(&user); err != nil {
-			http.Error(w, "Failed to decode user data", http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
-	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
 
 	emails := []string{}
 	for _, user := range users {
@@ -510,11 +766,14 @@ type PaymentResponse struct {
 	Currency    string  `json:"currency"`
 }
 
+// CartItem is a line of the cart sent to /cart. Name and Price are what
+// the page showed; the order takes both from the catalog.
 type CartItem struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Quantity int     `json:"quantity"`
+	ID        string  `json:"id"`
+	VariantID string  `json:"variant_id,omitempty"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+	Quantity  int     `json:"quantity"`
 }
 
 type PaymentRequest struct {
@@ -525,11 +784,32 @@ type PaymentRequest struct {
 	PaymentMethod string     `json:"payment_method"`
 }
 
-type OrderItem struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Quantity int     `json:"quantity"`
+// catalogItem turns a cart line into an order item with the name and price
+// of the product, or of its variant, in the catalog. problem says why the
+// line cannot be ordered.
+func catalogItem(ctx context.Context, item CartItem) (orderItem models.OrderItem, problem string, err error) {
+	products, _, err := store.Products.List(ctx, db.ProductQuery{ID: item.ID})
+	if errors.Is(err, db.ErrInvalidID) || (err == nil && len(products) == 0) {
+		return orderItem, fmt.Sprintf("product %s does not exist", item.ID), nil
+	} else if err != nil {
+		return orderItem, "", err
+	}
+	p := products[0]
+
+	orderItem = models.OrderItem{ID: p.ID, Name: p.Name, Price: p.Price, Quantity: item.Quantity}
+	switch {
+	case item.VariantID != "":
+		v := p.Variant(item.VariantID)
+		if v == nil {
+			return orderItem, fmt.Sprintf("product %s has no variant %s", p.ID, item.VariantID), nil
+		}
+		orderItem.VariantID = v.ID
+		orderItem.Name = p.Name + ", " + v.Name
+		orderItem.Price = v.Price
+	case len(p.Variants) > 0:
+		return orderItem, fmt.Sprintf("choose a variant of %s", p.Name), nil
+	}
+	return orderItem, "", nil
 }
 
 func handleCart(w http.ResponseWriter, r *http.Request) {
@@ -564,47 +844,53 @@ func handleCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Подключение к MongoDB
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		http.Error(w, "Database connection error", http.StatusInternalServerError)
-		return
-	}
-	defer client.Disconnect(context.TODO())
-
-	ordersCollection := client.Database("cheeseMarket").Collection("orders")
-
-	var orderItems []OrderItem
+	var orderItems []models.OrderItem
 	for _, item := range request.Cart {
-		orderItems = append(orderItems, OrderItem{
-			ID:       item.ID,
-			Name:     item.Name,
-			Price:    item.Price,
-			Quantity: item.Quantity,
-		})
+		if item.Quantity < 1 {
+			http.Error(w, "Quantity must be at least 1", http.StatusBadRequest)
+			return
+		}
+		orderItem, problem, err := catalogItem(r.Context(), item)
+		if err != nil {
+			log.Printf("Error pricing cart item %s: %v", item.ID, err)
+			http.Error(w, "Failed to save order", http.StatusInternalServerError)
+			return
+		} else if problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		orderItems = append(orderItems, orderItem)
 	}
 
-	// Создаем заказ с "pending" статусом
-	orderDocument := bson.M{
-		"customerName":  request.CustomerName,
-		"email":         request.Email,
-		"items":         orderItems,
-		"createdAt":     time.Now(),
-		"totalAmount":   0.0, // Обновится после платежа
-		"currency":      "USD",
-		"paymentStatus": "pending",
+	// Создаем заказ с "pending" статусом; its cheese is held until it
+	// is paid or checkout.reservation_ttl runs out.
+	order := models.Order{
+		CustomerName: request.CustomerName,
+		Email:        request.Email,
+		Items:        orderItems,
+		Currency:     "USD",
 	}
-
-	insertResult, err := ordersCollection.InsertOne(context.TODO(), orderDocument)
-	if err != nil {
+	order.TotalAmount = order.Total()
+
+	err = inventory.PlaceOrder(r.Context(), store, &order, cfg.Checkout.ReservationTTL.Std())
+	var shortage *inventory.ShortageError
+	if errors.As(err, &shortage) {
+		status := http.StatusConflict
+		if !errors.Is(err, db.ErrInsufficientStock) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, shortage.Error(), status)
+		return
+	} else if err != nil {
+		log.Printf("Error placing order: %v", err)
 		http.Error(w, "Failed to save order", http.StatusInternalServerError)
 		return
 	}
 
-	log.Println("Order created with pending status:", insertResult.InsertedID)
+	log.Println("Order created with pending status:", order.ID)
 
 	// Редирект на страницу оплаты /card с параметром email
-	redirectURL := fmt.Sprintf("http://localhost:8082/card?email=%s", url.QueryEscape(request.Email))
+	redirectURL := fmt.Sprintf("%s/card?email=%s&order_id=%s", strings.TrimSuffix(cfg.Payment.PublicURL, "/"), url.QueryEscape(request.Email), order.ID)
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
 
@@ -614,24 +900,11 @@ func ProtectedHandler(w http.ResponseWriter, r *http.Request) {
 func getAllUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var users []User
-	usersCollection := collection.Database().Collection("users")
-
-	cursor, err := usersCollection.Find(context.TODO(), bson.M{})
+	users, err := store.Users.List(r.Context())
 	if err != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	for cursor.Next(context.TODO()) {
-		var user User
-		if err := cursor.Decode(&user); err != nil {
-			http.Error(w, "Error decoding user", http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
-	}
 
 	json.NewEncoder(w).Encode(users)
 }
@@ -643,13 +916,6 @@ func updateUserRole(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Updating role for userID: %s", userID)
 
-	objID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		log.Printf("Invalid ObjectID: %v", err)
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
 	var updateData struct {
 		Role string `json:"role"`
 	}
@@ -660,78 +926,282 @@ func updateUserRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usersCollection := collection.Database().Collection("users")
-
-	filter := bson.M{"_id": objID}
-	update := bson.M{"$set": bson.M{"role": updateData.Role}}
-
-	res, err := usersCollection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
+	err := store.Users.UpdateRole(r.Context(), userID, updateData.Role)
+	if errors.Is(err, db.ErrInvalidID) {
+		log.Printf("Invalid ObjectID: %s", userID)
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, db.ErrNotFound) {
+		log.Printf("User not found for ID: %s", userID)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Printf("MongoDB UpdateOne error: %v", err)
 		http.Error(w, "Failed to update role", http.StatusInternalServerError)
 		return
 	}
 
-	if res.MatchedCount == 0 {
-		log.Printf("User not found for ID: %s", userID)
-		http.Error(w, "User not found", http.StatusNotFound)
+	// Tokens carry the role, so the user has to sign in again to get one
+	// with the new role.
+	if err := auth.RevokeUserSessions(r.Context(), userID); err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", userID, err)
+		http.Error(w, "Role updated but sessions could not be revoked", http.StatusInternalServerError)
 		return
 	}
 
 	json.NewEncoder(w).Encode(map[string]string{"message": "User role updated"})
 }
+
+// revokeUserSessions logs a user out on every device (DELETE /api/users/{id}/sessions).
+func revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/sessions")
+	if _, err := store.Users.FindByID(r.Context(), userID); errors.Is(err, db.ErrInvalidID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading user %s: %v", userID, err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if err := auth.RevokeUserSessions(r.Context(), userID); err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", userID, err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User sessions revoked"})
+}
+
+// handleUserAPI dispatches /api/users/{id}/role and /api/users/{id}/sessions.
+func handleUserAPI(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/sessions") {
+		revokeUserSessions(w, r)
+		return
+	}
+	updateUserRole(w, r)
+}
 func createChat(userID string) (string, error) {
 	chatID := primitive.NewObjectID().Hex() // Генерация уникального ID чата
 
-	chat := Chat{
+	chat := models.Chat{
 		ChatID:    chatID,
 		UserID:    userID,
 		Status:    "active",
-		Messages:  []Message{},
 		CreatedAt: time.Now(),
 	}
 
-	_, err := chatCollection.InsertOne(context.TODO(), chat)
+	err := store.Chats.Create(context.TODO(), &chat)
 	if err != nil {
 		return "", fmt.Errorf("failed to create chat: %v", err)
 	}
 
 	return chatID, nil
 }
-func sendMessage(chatID string, sender string, content string) error {
-	message := Message{
-		Sender:    sender,
+
+// sendMessage stores a message from the given user. Sender is "admin" or
+// "user", which is all the chat pages need to lay the message out.
+func sendMessage(chatID string, from chat.Identity, content string) (models.Message, error) {
+	message := models.Message{
+		ChatID:    chatID,
+		Sender:    "user",
+		SenderID:  from.ID,
 		Content:   content,
 		Timestamp: time.Now(),
 	}
+	if from.IsAdmin() {
+		message.Sender = "admin"
+	}
 
-	filter := bson.M{"chat_id": chatID}
-	update := bson.M{"$push": bson.M{"messages": message}}
+	err := appendMessage(context.TODO(), &message)
+	if err != nil {
+		return message, fmt.Errorf("failed to send message: %v", err)
+	}
 
-	_, err := chatCollection.UpdateOne(context.TODO(), filter, update)
+	// Whoever answers has read everything before their answer.
+	if err := markRead(context.TODO(), chatID, message.ID, from.ID, message.Timestamp); err != nil {
+		log.Printf("Failed to move read cursor in chat %s: %v", chatID, err)
+	}
+	return message, nil
+}
+
+// appendMessage stores a chat message. Numbering it and inserting it in one
+// transaction keeps the chat's order the order messages were committed in,
+// which resuming clients rely on when several servers write to one chat.
+func appendMessage(ctx context.Context, message *models.Message) error {
+	return store.WithTransaction(ctx, func(ctx context.Context) error {
+		return store.Messages.Append(ctx, message)
+	})
+}
+
+// markRead records that readerID has read chatID up to and including
+// messageID: the messages are stamped read and the reader's cursor moves on.
+func markRead(ctx context.Context, chatID, messageID, readerID string, at time.Time) error {
+	message, err := store.Messages.Get(ctx, chatID, messageID)
 	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+		return err
+	}
+	if err := store.Messages.MarkReadUpTo(ctx, chatID, message.Seq, readerID, at); err != nil {
+		return err
+	}
+	return store.Chats.AdvanceReadCursor(ctx, chatID, readerID, messageID, message.Seq)
+}
+func closeChat(chatID string) error {
+	err := store.Chats.Close(context.TODO(), chatID, time.Now())
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("chat with ID %s not found", chatID)
+	} else if err != nil {
+		return fmt.Errorf("failed to close chat: %v", err)
 	}
 
+	log.Printf("Chat %s successfully closed", chatID)
+	// The chat is closed either way; a transcript that cannot be queued
+	// is only logged.
+	if err := emailTranscript(context.TODO(), chatID); err != nil {
+		log.Printf("Failed to email transcript of chat %s: %v", chatID, err)
+	}
 	return nil
 }
-func closeChat(chatID string) error {
-	filter := bson.M{"chat_id": chatID}
-	update := bson.M{"$set": bson.M{"status": "inactive"}}
 
-	result, err := chatCollection.UpdateOne(context.TODO(), filter, update)
+// loadTranscript collects a chat, its customer and all of its messages.
+// It also returns the customer, whose email the transcript is sent to.
+func loadTranscript(ctx context.Context, chatID string) (*transcript.Transcript, *models.User, error) {
+	c, err := store.Chats.Get(ctx, chatID)
 	if err != nil {
-		return fmt.Errorf("failed to close chat: %v", err)
+		return nil, nil, err
+	}
+	messages, err := store.Messages.List(ctx, chatID, db.MessagePage{})
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &transcript.Transcript{Chat: *c, Customer: "Customer", Messages: messages}
+	if t.Messages == nil {
+		t.Messages = []models.Message{}
 	}
 
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("chat with ID %s not found", chatID)
+	customer, err := store.Users.FindByID(ctx, c.UserID)
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+		return t, nil, nil
+	} else if err != nil {
+		return nil, nil, err
 	}
+	t.Customer = customer.Username
+	return t, customer, nil
+}
 
-	log.Printf("Chat %s successfully closed", chatID)
+// emailTranscript queues the transcript of a chat for its customer if they
+// asked for one.
+func emailTranscript(ctx context.Context, chatID string) error {
+	t, customer, err := loadTranscript(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	if !t.Chat.EmailTranscript || customer == nil || customer.Email == "" {
+		return nil
+	}
+	msg, err := transcript.Email(t, customer.Email)
+	if err != nil {
+		return err
+	}
+	return outbox.Enqueue(ctx, store.Outbox, msg)
+}
+
+var errChatForbidden = errors.New("not a participant of this chat")
+
+// assigner hands new chats to online admins according to chat.auto_assign.
+var assigner = chat.NewAssigner(chat.AssignManual)
+
+// assignChat moves a chat from fromAdminID ("" for the queue) to admin and
+// tells the chat's room and the lobby, so every admin page can update.
+func assignChat(ctx context.Context, chatID, fromAdminID string, admin chat.Identity, reason string) error {
+	if err := store.Chats.Assign(ctx, chatID, fromAdminID, admin.ID, time.Now()); err != nil {
+		return err
+	}
+
+	event := map[string]string{
+		"type":              "chat_assigned",
+		"chat_id":           chatID,
+		"admin_id":          admin.ID,
+		"admin_name":        admin.Username,
+		"previous_admin_id": fromAdminID,
+		"reason":            reason,
+	}
+	publish(chatID, event)
+	publish(chat.Lobby, event)
 	return nil
 }
 
+// autoAssign gives a new chat to one of the admins watching the lobby, if
+// chat.auto_assign is set. Otherwise the chat waits to be claimed.
+func autoAssign(ctx context.Context, chatID string) {
+	online := hub.Members(chat.Lobby)
+	if len(online) == 0 {
+		return
+	}
+
+	active, err := store.Chats.ListActive(ctx)
+	if err != nil {
+		log.Printf("Failed to auto-assign chat %s: %v", chatID, err)
+		return
+	}
+	load := map[string]int{}
+	for _, c := range active {
+		if c.AdminID != "" {
+			load[c.AdminID]++
+		}
+	}
+
+	admin, ok := assigner.Pick(online, load)
+	if !ok {
+		return
+	}
+	if err := assignChat(ctx, chatID, "", admin, "auto"); err != nil {
+		log.Printf("Failed to auto-assign chat %s: %v", chatID, err)
+	}
+}
+
+// transferChat hands a chat to another admin on behalf of by.
+func transferChat(ctx context.Context, by chat.Identity, chatID, toAdminID string) error {
+	current, err := store.Chats.Get(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	target, err := store.Users.FindByID(ctx, toAdminID)
+	if err != nil {
+		return err
+	}
+	if target.Role != "admin" {
+		return fmt.Errorf("%s is not an admin", target.Username)
+	}
+	if current.AdminID == target.ID {
+		return nil
+	}
+	log.Printf("Admin %s transfers chat %s to %s", by.Username, chatID, target.Username)
+	return assignChat(ctx, chatID, current.AdminID, chat.Identity{ID: target.ID, Username: target.Username, Role: target.Role}, "transferred")
+}
+
+// authorizeChat loads a chat the user may take part in: admins may open any
+// chat, customers only their own.
+func authorizeChat(ctx context.Context, user chat.Identity, chatID string) (*models.Chat, error) {
+	c, err := store.Chats.Get(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsAdmin() && c.UserID != user.ID {
+		return nil, errChatForbidden
+	}
+	return c, nil
+}
+
 func getChatHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -742,10 +1212,29 @@ func getChatHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filter := bson.M{"chat_id": chatID}
-	var chat Chat
-	err := chatCollection.FindOne(context.TODO(), filter).Decode(&chat)
-	if err == mongo.ErrNoDocuments {
+	page := db.MessagePage{
+		Before: r.URL.Query().Get("before"),
+		After:  r.URL.Query().Get("after"),
+		Limit:  50,
+	}
+	if page.Before != "" && page.After != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "use either before or after, not both"})
+		return
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 200"})
+			return
+		}
+		page.Limit = n
+	}
+
+	_, err := authorizeChat(r.Context(), chatIdentity(auth.ClaimsFromContext(r.Context())), chatID)
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, errChatForbidden) {
+		// Other users' chats look the same as missing ones.
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Chat not found"})
 		return
@@ -755,195 +1244,792 @@ func getChatHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Если у чата нет сообщений, возвращаем пустой массив
-	if chat.Messages == nil {
-		chat.Messages = []Message{}
+	// One extra message tells us whether there is another page in the
+	// direction we are reading.
+	want := page.Limit
+	page.Limit++
+	messages, err := store.Messages.List(r.Context(), chatID, page)
+	if errors.Is(err, db.ErrInvalidID) || errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid cursor"})
+		return
+	} else if err != nil {
+		log.Printf("Error loading history of chat %s: %v", chatID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load chat history"})
+		return
+	}
+
+	hasMore := len(messages) > want
+	if hasMore {
+		if page.After != "" {
+			messages = messages[:want]
+		} else {
+			messages = messages[1:]
+		}
+	}
+	if messages == nil {
+		messages = []models.Message{}
+	}
+
+	// prev_cursor pages to older messages and next_cursor to newer ones;
+	// either is empty when there is nothing (yet) in that direction.
+	resp := chatHistoryPage{Messages: messages, HasMore: hasMore}
+	if len(messages) > 0 {
+		resp.NextCursor = messages[len(messages)-1].ID
+		if page.After != "" || hasMore {
+			resp.PrevCursor = messages[0].ID
+		}
+	} else {
+		resp.NextCursor = page.After
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// chatHistoryPage is one page of /api/chat-history, oldest message first.
+type chatHistoryPage struct {
+	Messages   []models.Message `json:"messages"`
+	HasMore    bool             `json:"has_more"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// shortcutPattern is what a canned response shortcut may look like; admins
+// may type it with a leading slash.
+var shortcutPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// normalizeCannedResponse cleans up a canned response sent by an admin and
+// reports what is wrong with it, if anything.
+func normalizeCannedResponse(c *models.CannedResponse) string {
+	c.Shortcut = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(c.Shortcut)), "/")
+	c.Content = strings.TrimSpace(c.Content)
+	if !shortcutPattern.MatchString(c.Shortcut) {
+		return "shortcut must be 1-32 lowercase letters, digits, - or _"
+	}
+	if c.Content == "" {
+		return "content is required"
+	}
+	keywords := c.Keywords[:0]
+	for _, k := range c.Keywords {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	c.Keywords = keywords
+	return ""
+}
+
+// handleCannedResponses lets admins manage canned responses: GET lists
+// them, POST creates one, PUT replaces the one with the given id and DELETE
+// removes it.
+func handleCannedResponses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodGet {
+		responses, err := store.Canned.List(r.Context())
+		if err != nil {
+			log.Printf("Error listing canned responses: %v", err)
+			http.Error(w, "Failed to fetch canned responses", http.StatusInternalServerError)
+			return
+		}
+		if responses == nil {
+			responses = []models.CannedResponse{}
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+
+	var response models.CannedResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if problem := normalizeCannedResponse(&response); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = store.Canned.Create(r.Context(), &response)
+		} else {
+			err = store.Canned.Update(r.Context(), response)
+		}
+	case http.MethodDelete:
+		err = store.Canned.Delete(r.Context(), response.ID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, db.ErrInvalidID) {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Canned response not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, db.ErrDuplicate) {
+		http.Error(w, "Shortcut is already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error saving canned response: %v", err)
+		http.Error(w, "Failed to save canned response", http.StatusInternalServerError)
+		return
 	}
 
-	// Возвращаем массив сообщений
-	json.NewEncoder(w).Encode(chat.Messages)
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(map[string]string{"message": "Canned response deleted"})
+		return
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
-var clients = make(map[*websocket.Conn]bool)      // Все клиенты
-var adminClients = make(map[*websocket.Conn]bool) // Админы
+// botReply answers a customer's message with the first canned response
+// whose keyword it contains, as long as no admin has claimed the chat. It
+// never sends the same answer twice in one chat. It returns nil when it has
+// nothing to say.
+func botReply(ctx context.Context, chatID, content string) (*models.Message, error) {
+	c, err := store.Chats.Get(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if c.AdminID != "" || c.Status != "active" {
+		return nil, nil
+	}
+
+	responses, err := store.Canned.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	content = strings.ToLower(content)
+	var answer *models.CannedResponse
+	for i := range responses {
+		for _, keyword := range responses[i].Keywords {
+			if strings.Contains(content, keyword) {
+				answer = &responses[i]
+				break
+			}
+		}
+		if answer != nil {
+			break
+		}
+	}
+	if answer == nil {
+		return nil, nil
+	}
+
+	recent, err := store.Messages.List(ctx, chatID, db.MessagePage{Limit: 50})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range recent {
+		if m.Sender == "bot" && m.Content == answer.Content {
+			return nil, nil
+		}
+	}
+
+	message := models.Message{
+		ChatID:    chatID,
+		Sender:    "bot",
+		Content:   answer.Content,
+		Timestamp: time.Now(),
+	}
+	if err := appendMessage(ctx, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// getChatTranscript lets admins download a chat, open or closed, as
+// ?format=json (the default), csv or pdf.
+func getChatTranscript(w http.ResponseWriter, r *http.Request) {
+	chatID := r.URL.Query().Get("chat_id")
+	if chatID == "" {
+		http.Error(w, "chat_id is required", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := transcript.Formats[format]
+	if !ok {
+		http.Error(w, "format must be json, csv or pdf", http.StatusBadRequest)
+		return
+	}
+
+	t, _, err := loadTranscript(r.Context(), chatID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading transcript of chat %s: %v", chatID, err)
+		http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+		return
+	}
+
+	// Render first so a failure can still be reported as an error.
+	var buf bytes.Buffer
+	if err := transcript.Write(&buf, t, format); err != nil {
+		log.Printf("Error rendering transcript of chat %s: %v", chatID, err)
+		http.Error(w, "Failed to render transcript", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat_%s.%s"`, chatID, format))
+	w.Write(buf.Bytes())
+}
+
+// hub fans chat events out to connected WebSocket clients. Every chat has a
+// room holding its customer and the admins looking at it; admins also join
+// chat.Lobby to hear about chats being opened and closed. main puts it on
+// the MongoDB bus when several instances share the chat.
+var hub = chat.NewHub(chat.NewLocalBus())
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: checkOrigin,
 }
 
-func checkChatExists(chatID string) (bool, error) {
-	count, err := chatCollection.CountDocuments(context.TODO(), bson.M{"chat_id": chatID})
+// checkOrigin lets pages open the chat socket only from the shop itself or
+// from chat.allowed_origins, so other sites cannot ride on a customer's
+// cookies. Clients that send no Origin are not browsers and still need a
+// session.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
 	if err != nil {
-		return false, err
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
 	}
-	return count > 0, nil
+
+	allowed := append([]string{cfg.Server.PublicURL}, cfg.Chat.AllowedOrigins...)
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err == nil && strings.EqualFold(au.Scheme, u.Scheme) && strings.EqualFold(au.Host, u.Host) {
+			return true
+		}
+	}
+	return false
 }
+
+func chatIdentity(claims *auth.CustomClaims) chat.Identity {
+	return chat.Identity{ID: claims.ID, Username: claims.Username, Role: claims.Role}
+}
+
+func checkChatExists(chatID string) (bool, error) {
+	return store.Chats.Exists(context.TODO(), chatID)
+}
+
+// handleConnections upgrades a signed-in user's request. It is only reached
+// through auth.RequireUser, which may have renewed the session cookies; they
+// are passed on in the handshake response.
 func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	claims := auth.ClaimsFromContext(r.Context())
+	ws, err := upgrader.Upgrade(w, r, http.Header{"Set-Cookie": w.Header()["Set-Cookie"]})
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
-	defer ws.Close()
+	hub.Serve(ws, chatIdentity(claims), handleChatMessage)
+}
 
-	// Добавляем в список подключенных клиентов
-	clients[ws] = true
+// maxReplay bounds how many missed messages a resume replays.
+const maxReplay = 200
+
+// messageEvent is the new_message event announcing m.
+func messageEvent(m models.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "new_message",
+		"chat_id":    m.ChatID,
+		"message_id": m.ID,
+		"sender":     m.Sender,
+		"sender_id":  m.SenderID,
+		"content":    m.Content,
+		"timestamp":  m.Timestamp,
+	}
+}
 
-	for {
-		var msg map[string]string
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			delete(clients, ws)
-			break
+// storedMessageEvent is how the MongoDB bus turns a document inserted into
+// the messages collection into the event for its chat.
+func storedMessageEvent(doc bson.Raw) (string, []byte, error) {
+	var m models.Message
+	if err := bson.Unmarshal(doc, &m); err != nil {
+		return "", nil, err
+	}
+	event, err := json.Marshal(messageEvent(m))
+	return m.ChatID, event, err
+}
+
+// publish sends an event to a chat room. The change it reports has already
+// been made, so a failure is only logged; clients catch up on reconnect.
+func publish(room string, v interface{}) {
+	if err := hub.Publish(room, v); err != nil {
+		log.Printf("Failed to publish chat event to %s: %v", room, err)
+	}
+}
+
+// publishMessage announces a message that has been stored.
+func publishMessage(m models.Message) {
+	if err := hub.PublishStored(m.ChatID, messageEvent(m)); err != nil {
+		log.Printf("Failed to publish message %s in chat %s: %v", m.ID, m.ChatID, err)
+	}
+}
+
+func sendChatError(c *chat.Client, chatID, message string) {
+	c.Send(map[string]string{"type": "error", "chat_id": chatID, "error": message})
+}
+
+// handleChatMessage runs one client request. Who is speaking always comes
+// from c.User; user_id and sender fields sent by the page are ignored.
+func handleChatMessage(c *chat.Client, msg map[string]string) {
+	ctx := context.TODO()
+	chatID := msg["chat_id"]
+
+	switch msg["type"] {
+	case "check_chat":
+		ch, err := authorizeChat(ctx, c.User, chatID)
+		exists := err == nil
+		if err != nil && !errors.Is(err, db.ErrNotFound) && !errors.Is(err, errChatForbidden) {
+			log.Printf("Ошибка при проверке чата: %v", err)
 		}
+		if exists {
+			hub.Join(c, chatID)
+		}
+		c.Send(map[string]interface{}{
+			"type":             "chat_status",
+			"chat_id":          chatID,
+			"exists":           exists,
+			"email_transcript": exists && ch.EmailTranscript,
+		})
 
-		switch msg["type"] {
-		case "check_chat":
-			chatID := msg["chat_id"]
-			exists, err := checkChatExists(chatID)
-			if err != nil {
-				log.Printf("Ошибка при проверке чата: %v", err)
-			}
-			ws.WriteJSON(map[string]interface{}{
-				"type":    "chat_status",
-				"chat_id": chatID,
-				"exists":  exists,
-			})
-
-		case "create_chat":
-			chatID, err := createChat(msg["user_id"])
-			if err != nil {
-				log.Printf("Failed to create chat: %v", err)
-				continue
+	case "create_chat":
+		chatID, err := createChat(c.User.ID)
+		if err != nil {
+			log.Printf("Failed to create chat: %v", err)
+			sendChatError(c, "", "could not create chat")
+			return
+		}
+		if msg["email_transcript"] == "true" {
+			if err := store.Chats.SetEmailTranscript(ctx, chatID, true); err != nil {
+				log.Printf("Failed to request transcript of chat %s: %v", chatID, err)
 			}
-			ws.WriteJSON(map[string]string{"type": "chat_created", "chat_id": chatID})
+		}
+		hub.Join(c, chatID)
+		c.Send(map[string]string{"type": "chat_created", "chat_id": chatID})
+		publish(chat.Lobby, map[string]string{
+			"type":    "new_chat",
+			"chat_id": chatID,
+			"user_id": c.User.ID,
+		})
+		autoAssign(ctx, chatID)
 
-		case "send_message":
-			err := sendMessage(msg["chat_id"], msg["sender"], msg["content"])
-			if err != nil {
-				log.Printf("Failed to send message: %v", err)
-				continue
-			}
-			broadcastMessage(map[string]string{
-				"type":    "new_message",
-				"chat_id": msg["chat_id"],
-				"sender":  msg["sender"],
-				"content": msg["content"],
-			})
-		case "close_chat":
-			chatID := msg["chat_id"]
-			err := closeChat(chatID)
+	case "claim_chat":
+		if !c.User.IsAdmin() {
+			sendChatError(c, chatID, "only admins can claim chats")
+			return
+		}
+		err := assignChat(ctx, chatID, "", c.User, "claimed")
+		if errors.Is(err, db.ErrNotFound) {
+			sendChatError(c, chatID, "chat is closed or already taken")
+			return
+		} else if err != nil {
+			log.Printf("Failed to claim chat %s: %v", chatID, err)
+			sendChatError(c, chatID, "chat not claimed")
+			return
+		}
+		hub.Join(c, chatID)
+
+	case "transfer_chat":
+		if !c.User.IsAdmin() {
+			sendChatError(c, chatID, "only admins can transfer chats")
+			return
+		}
+		err := transferChat(ctx, c.User, chatID, msg["admin_id"])
+		if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+			sendChatError(c, chatID, "chat or admin not found, or the chat changed hands meanwhile")
+			return
+		} else if err != nil {
+			log.Printf("Failed to transfer chat %s: %v", chatID, err)
+			sendChatError(c, chatID, err.Error())
+			return
+		}
+
+	case "subscribe_lobby":
+		if !c.User.IsAdmin() {
+			sendChatError(c, "", "only admins can watch the lobby")
+			return
+		}
+		hub.Join(c, chat.Lobby)
+
+	case "join_chat":
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		hub.Join(c, chatID)
+
+	case "leave_chat":
+		hub.Leave(c, chatID)
+
+	case "send_message":
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		message, err := sendMessage(chatID, c.User, msg["content"])
+		if err != nil {
+			log.Printf("Failed to send message: %v", err)
+			sendChatError(c, chatID, "message not sent")
+			return
+		}
+		hub.Join(c, chatID)
+		publishMessage(message)
+
+		if !c.User.IsAdmin() {
+			reply, err := botReply(ctx, chatID, message.Content)
 			if err != nil {
-				log.Printf("Failed to close chat: %v", err)
-				continue
+				log.Printf("Bot failed to answer in chat %s: %v", chatID, err)
+			} else if reply != nil {
+				publishMessage(*reply)
 			}
+		}
 
-			response := map[string]string{
-				"type":    "chat_closed",
-				"chat_id": chatID,
-			}
+	case "send_canned":
+		// Admins answer common questions by shortcut.
+		if !c.User.IsAdmin() {
+			sendChatError(c, chatID, "only admins can send canned responses")
+			return
+		}
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		response, err := store.Canned.FindByShortcut(ctx, strings.TrimPrefix(msg["shortcut"], "/"))
+		if errors.Is(err, db.ErrNotFound) {
+			sendChatError(c, chatID, "no canned response with that shortcut")
+			return
+		} else if err != nil {
+			log.Printf("Failed to look up canned response %q: %v", msg["shortcut"], err)
+			sendChatError(c, chatID, "message not sent")
+			return
+		}
+		message, err := sendMessage(chatID, c.User, response.Content)
+		if err != nil {
+			log.Printf("Failed to send message: %v", err)
+			sendChatError(c, chatID, "message not sent")
+			return
+		}
+		hub.Join(c, chatID)
+		publishMessage(message)
+
+	case "resume":
+		// A client that lost its connection reports the last message it saw
+		// and gets everything after it. Joining first means nothing sent
+		// meanwhile is lost; the client drops anything it sees twice.
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		hub.Join(c, chatID)
+		missed, err := store.Messages.List(ctx, chatID, db.MessagePage{After: msg["last_message_id"], Limit: maxReplay + 1})
+		if errors.Is(err, db.ErrInvalidID) || errors.Is(err, db.ErrNotFound) {
+			sendChatError(c, chatID, "invalid last_message_id")
+			return
+		} else if err != nil {
+			log.Printf("Failed to load missed messages in chat %s: %v", chatID, err)
+			sendChatError(c, chatID, "could not resume chat")
+			return
+		}
+		// The replay goes out as one frame so it cannot overflow the
+		// client's queue. Clients that missed more load the rest from
+		// /api/chat-history.
+		hasMore := len(missed) > maxReplay
+		if hasMore {
+			missed = missed[:maxReplay]
+		}
+		events := make([]map[string]interface{}, 0, len(missed))
+		for _, m := range missed {
+			events = append(events, messageEvent(m))
+		}
+		c.Send(map[string]interface{}{
+			"type":     "resumed",
+			"chat_id":  chatID,
+			"messages": events,
+			"has_more": hasMore,
+		})
 
-			broadcastMessage(response)
+	case "typing_start", "typing_stop":
+		// Typing indicators are passed on to the room and never stored.
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		sender := "user"
+		if c.User.IsAdmin() {
+			sender = "admin"
+		}
+		publish(chatID, map[string]interface{}{
+			"type":    "typing",
+			"chat_id": chatID,
+			"user_id": c.User.ID,
+			"sender":  sender,
+			"typing":  msg["type"] == "typing_start",
+		})
 
+	case "delivered", "read":
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		messageID := msg["message_id"]
+		var err error
+		if msg["type"] == "delivered" {
+			if _, err = store.Messages.Get(ctx, chatID, messageID); err == nil {
+				err = store.Messages.MarkDelivered(ctx, chatID, messageID, c.User.ID, time.Now())
+			}
+		} else {
+			err = markRead(ctx, chatID, messageID, c.User.ID, time.Now())
+		}
+		if errors.Is(err, db.ErrInvalidID) {
+			err = db.ErrNotFound
 		}
+		if errors.Is(err, db.ErrNotFound) {
+			sendChatError(c, chatID, "message not found")
+			return
+		} else if err != nil {
+			log.Printf("Failed to record %s receipt in chat %s: %v", msg["type"], chatID, err)
+			return
+		}
+		publish(chatID, map[string]string{
+			"type":       "receipt",
+			"chat_id":    chatID,
+			"message_id": messageID,
+			"user_id":    c.User.ID,
+			"status":     msg["type"],
+		})
 
-	}
-}
+	case "email_transcript":
+		// Only the customer decides whether their conversation is mailed
+		// to them.
+		ch, err := authorizeChat(ctx, c.User, chatID)
+		if err != nil || ch.UserID != c.User.ID {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		enabled := msg["enabled"] == "true"
+		if err := store.Chats.SetEmailTranscript(ctx, chatID, enabled); err != nil {
+			log.Printf("Failed to update transcript request of chat %s: %v", chatID, err)
+			sendChatError(c, chatID, "could not update transcript request")
+			return
+		}
+		c.Send(map[string]interface{}{"type": "email_transcript", "chat_id": chatID, "enabled": enabled})
 
-// Функция рассылки сообщения всем клиентам (всем админам и пользователю)
-func broadcastMessage(msg map[string]string) {
-	messageJSON, _ := json.Marshal(msg)
+	case "close_chat":
+		if _, err := authorizeChat(ctx, c.User, chatID); err != nil {
+			sendChatError(c, chatID, "chat not found")
+			return
+		}
+		if err := closeChat(chatID); err != nil {
+			log.Printf("Failed to close chat: %v", err)
+			sendChatError(c, chatID, "chat not closed")
+			return
+		}
 
-	for client := range clients {
-		err := client.WriteMessage(websocket.TextMessage, messageJSON)
-		if err != nil {
-			log.Printf("Ошибка отправки сообщения клиенту: %v", err)
-			client.Close()
-			delete(clients, client)
+		closed := map[string]string{
+			"type":    "chat_closed",
+			"chat_id": chatID,
 		}
+		publish(chatID, closed)
+		publish(chat.Lobby, closed)
 	}
 }
 
+// activeChat is an open chat as the admin asking for it sees it.
+type activeChat struct {
+	models.Chat
+	// Unread counts messages from others after the admin's read cursor.
+	Unread int `json:"unread"`
+}
+
 // Получение активных чатов для админа
 func getActiveChats(w http.ResponseWriter, r *http.Request) {
-	filter := bson.M{"status": "active"}
-	cursor, err := chatCollection.Find(context.TODO(), filter)
+	chats, err := store.Chats.ListActive(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var chats []Chat
-	if err = cursor.All(context.TODO(), &chats); err != nil {
+	adminID := auth.ClaimsFromContext(r.Context()).ID
+	active := make([]activeChat, 0, len(chats))
+	for _, c := range chats {
+		unread, err := store.Messages.CountUnread(r.Context(), c.ChatID, adminID, c.LastReadSeq[adminID])
+		if err != nil {
+			log.Printf("Error counting unread messages in chat %s: %v", c.ChatID, err)
+		}
+		active = append(active, activeChat{Chat: c, Unread: int(unread)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+// getChatQueue lists the chats no admin has taken yet, longest waiting first.
+func getChatQueue(w http.ResponseWriter, r *http.Request) {
+	chats, err := store.Chats.ListUnassigned(r.Context())
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Active chats: %+v", chats)
 
-	json.NewEncoder(w).Encode(chats)
+	type queued struct {
+		ChatID         string    `json:"chat_id"`
+		UserID         string    `json:"user_id"`
+		CreatedAt      time.Time `json:"created_at"`
+		WaitingSeconds int64     `json:"waiting_seconds"`
+	}
+	queue := make([]queued, 0, len(chats))
+	for _, c := range chats {
+		queue = append(queue, queued{
+			ChatID:         c.ChatID,
+			UserID:         c.UserID,
+			CreatedAt:      c.CreatedAt,
+			WaitingSeconds: int64(time.Since(c.CreatedAt).Seconds()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue)
 }
 
 // Проверка активного чата для пользователя
 func getActiveChat(w http.ResponseWriter, r *http.Request) {
-	userID := "USER_ID_FROM_SESSION" // Получать из аутентификации
-	filter := bson.M{"user_id": userID, "status": "active"}
-
-	var chat Chat
-	err := chatCollection.FindOne(context.TODO(), filter).Decode(&chat)
+	userID := auth.ClaimsFromContext(r.Context()).ID
+	active, err := store.Chats.FindActiveByUser(r.Context(), userID)
 
-	if err == mongo.ErrNoDocuments {
+	if errors.Is(err, db.ErrNotFound) {
 		json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
 		return
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"active":  true,
-		"chat_id": chat.ChatID,
+		"chat_id": active.ChatID,
 	})
 }
 
-func main() {
-	initPaths()
-	connectMongoDB()
-
+// routes registers every endpoint of the shop. Admin APIs are guarded by
+// auth.RequireRole; /products is public for reading only.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
 	limiter := rate.NewLimiter(2, 5)
+	adminOnly := auth.RequireRole("admin")
+	adminWrites := auth.RequireRole("admin", http.MethodPost, http.MethodPut, http.MethodDelete)
 
 	fs := http.FileServer(http.Dir(staticDir))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+
+	mux.Handle("/", auth.NoCacheMiddleware(auth.AuthMiddleware(rateLimiter(http.HandlerFunc(auth.DashboardHandler), limiter))))
+	mux.Handle("/user", auth.NoCacheMiddleware(auth.AuthMiddleware(http.HandlerFunc(serveUser))))
+	mux.Handle("/dashboard", auth.NoCacheMiddleware(auth.AuthMiddleware(rateLimiter(http.HandlerFunc(auth.DashboardHandler), limiter))))
+	mux.Handle("/protected", auth.NoCacheMiddleware(auth.AuthMiddleware(http.HandlerFunc(ProtectedHandler))))
+	mux.Handle("/admin", auth.NoCacheMiddleware(adminOnly(http.HandlerFunc(serveAdmin))))
+
+	mux.Handle("/login", http.HandlerFunc(auth.LoginHandler))
+	mux.Handle("/register", http.HandlerFunc(auth.RegisterHandler))
+	mux.Handle("/logout", http.HandlerFunc(auth.LogoutHandler))
+	mux.Handle("/logout-all", http.HandlerFunc(auth.LogoutAllHandler))
+	mux.Handle("/refresh", http.HandlerFunc(auth.RefreshHandler))
+	mux.Handle("/api/me", http.HandlerFunc(auth.MeHandler))
+	mux.Handle("/verify", http.HandlerFunc(auth.VerifyHandler))
+	mux.Handle("/resend-code", http.HandlerFunc(auth.ResendCodeHandler))
+	mux.Handle("/login/2fa", http.HandlerFunc(auth.SecondFactorHandler))
+	mux.Handle("/2fa/setup", auth.NoCacheMiddleware(http.HandlerFunc(auth.TOTPSetupHandler)))
+	mux.Handle("/2fa/disable", http.HandlerFunc(auth.TOTPDisableHandler))
+	mux.Handle("/forgot-password", http.HandlerFunc(auth.ForgotPasswordHandler))
+	mux.Handle("/reset-password", http.HandlerFunc(auth.ResetPasswordHandler))
+
+	mux.Handle("/send_email", adminOnly(http.HandlerFunc(sendEmailHandler)))
+	mux.Handle("/get_users_email_list", adminOnly(http.HandlerFunc(getUsersEmailList)))
+	mux.Handle("/api/outbox", adminOnly(http.HandlerFunc(getOutbox)))
+	mux.Handle("/api/outbox/retry", adminOnly(http.HandlerFunc(retryOutboxEntry)))
+
+	mux.Handle("/products", adminWrites(http.HandlerFunc(handleProducts)))
+	mux.HandleFunc("/products/search", handleProductSearch)
+	mux.HandleFunc("/products/suggest", handleProductSuggest)
+	mux.HandleFunc("/cart", handleCart)
+
+	mux.Handle("/users", adminOnly(http.HandlerFunc(getAllUsers)))
+	mux.Handle("/api/users/", adminOnly(http.HandlerFunc(handleUserAPI)))
+
+	mux.Handle("/ws", auth.RequireUser(http.HandlerFunc(handleConnections)))
+	mux.Handle("/api/active-chats", adminOnly(http.HandlerFunc(getActiveChats)))
+	mux.Handle("/api/chat-queue", adminOnly(http.HandlerFunc(getChatQueue)))
+	mux.Handle("/api/active-chat", auth.RequireUser(http.HandlerFunc(getActiveChat)))
+	mux.Handle("/api/chat-history", auth.RequireUser(http.HandlerFunc(getChatHistory)))
+	mux.Handle("/api/chat-transcript", adminOnly(http.HandlerFunc(getChatTranscript)))
+	mux.Handle("/api/canned-responses", adminOnly(http.HandlerFunc(handleCannedResponses)))
+	return mux
+}
 
-	http.Handle("/", auth.NoCacheMiddleware(auth.AuthMiddleware(rateLimiter(http.HandlerFunc(auth.DashboardHandler), limiter))))
-	http.Handle("/user", auth.NoCacheMiddleware(auth.AuthMiddleware(http.HandlerFunc(serveUser))))
-	http.Handle("/dashboard", auth.NoCacheMiddleware(auth.AuthMiddleware(rateLimiter(http.HandlerFunc(auth.DashboardHandler), limiter))))
-	http.Handle("/protected", auth.NoCacheMiddleware(auth.AuthMiddleware(http.HandlerFunc(ProtectedHandler))))
-	http.Handle("/admin", auth.NoCacheMiddleware(auth.AuthMiddleware(http.HandlerFunc(serveAdmin))))
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or JSON config file (overrides $"+config.EnvFile+")")
+	flag.Parse()
 
-	http.Handle("/login", http.HandlerFunc(auth.LoginHandler))
-	http.Handle("/register", http.HandlerFunc(auth.RegisterHandler))
-	http.Handle("/logout", http.HandlerFunc(auth.LogoutHandler))
-	http.Handle("/verify", http.HandlerFunc(auth.VerifyHandler))
+	var err error
+	cfg, err = config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
-	http.HandleFunc("/send_email", sendEmailHandler)
-	http.HandleFunc("/get_users_email_list", getUsersEmailList)
+	initPaths()
+
+	store, err = db.Connect(context.Background(), cfg.Mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	mailSender, err := mailer.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/products", handleProducts)
-	http.HandleFunc("/cart", handleCart)
+	auth.Init(cfg, store)
 
-	http.HandleFunc("/users", getAllUsers)
-	http.HandleFunc("/api/users/", updateUserRole)
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+	if cfg.Outbox.Worker {
+		go outbox.NewWorker(store.Outbox, mailSender, cfg.Outbox).Run(workerCtx)
+	}
+	assigner = chat.NewAssigner(cfg.Chat.AutoAssign)
+	if cfg.Chat.Bus == "mongodb" {
+		hub = chat.NewHub(chat.NewMongoBus(store.Database.Collection("chat_events"), store.Database.Collection("messages"), storedMessageEvent, cfg.Mongo.QueryTimeout.Std()))
+	}
+	if err := hub.Start(workerCtx); err != nil {
+		log.Fatal(err)
+	}
+	go inventory.RunSweeper(workerCtx, store, cfg.Checkout.SweepInterval.Std())
 
-	http.HandleFunc("/ws", handleConnections)
-	http.HandleFunc("/api/active-chats", getActiveChats)
-	http.HandleFunc("/api/active-chat", getActiveChat)
-	http.HandleFunc("/api/chat-history", getChatHistory)
 	srv := &http.Server{
-		Addr:         ":8080",
+		Addr:         cfg.Server.Addr,
+		Handler:      routes(),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	fmt.Println("Server running on http://localhost:8080/login")
+	fmt.Printf("Server running on %s\n", cfg.Server.Addr)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -955,6 +2041,7 @@ func main() {
 	}()
 
 	<-quit
+	stopWorker()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
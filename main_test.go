@@ -1,199 +1,1567 @@
 package main
 
 import (
+	"bytes"
+	"cheese_market/auth"
+	"cheese_market/chat"
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
 	"context"
-	"os/exec"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
-	"math/rand"
-	"strconv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
-	"github.com/tebeka/selenium"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// setupTestStore points the handlers at an empty in-memory store and a
+// configuration that needs no external services.
+func setupTestStore(t *testing.T) {
+	t.Helper()
 
-var (
-	client          *mongo.Client
-	db              *mongo.Database
-	test_collection *mongo.Collection
-)
+	cfg = config.Default()
+	cfg.JWT.Secret = "test-secret-0123456789"
+	cfg.Mail.Backend = "capture"
+	cfg.Mail.From = "shop@example.com"
+	require.NoError(t, cfg.Validate())
 
-func TestSendEmail(t *testing.T) {
-	err := sendEmail("kamil.akbarov.95@gmail.com", "Test Email", "This is a test email.", []byte{}, "plain/text")
-   assert.NoError(t, err, "Email should be sent successfully")
+	store = db.NewMemoryStore()
+	auth.Configure(cfg, store)
 }
 
+// tokenCookie creates a user with a session and signs an access token for
+// it the way auth.LoginHandler does.
+func tokenCookie(t *testing.T, username, role string) *http.Cookie {
+	t.Helper()
+
+	user := models.User{Username: username, Email: username + "@example.com", Role: role}
+	require.NoError(t, store.Users.Create(context.Background(), &user))
+	session := models.Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, store.Sessions.Create(context.Background(), &session))
 
-func setup() {
-	var err error
-	client, err = mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		log.Fatal(err)
+	claims := auth.CustomClaims{
+		ID:        user.ID,
+		Username:  username,
+		Role:      role,
+		SessionID: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
 	}
-	db = client.Database("cheeseMarket")
-	test_collection = db.Collection("test")
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.JWT.Secret))
+	require.NoError(t, err)
+	return &http.Cookie{Name: "token", Value: token}
+}
 
-	_, err = test_collection.DeleteMany(context.Background(), bson.D{})
-	if err != nil {
-		log.Fatal(err)
+func doJSON(t *testing.T, handler http.HandlerFunc, method, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&buf).Encode(body))
 	}
+	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+type productsResponse struct {
+	Products   []models.Product `json:"products"`
+	Total      int64            `json:"total"`
+	Page       int              `json:"page"`
+	PageSize   int              `json:"pageSize"`
+	TotalPages int64            `json:"totalPages"`
+	Facets     db.ProductFacets `json:"facets"`
+	NextCursor string           `json:"nextCursor"`
 }
 
-func teardown() {
-	if err := client.Disconnect(context.Background()); err != nil {
-		log.Fatal(err)
+func TestHandleProducts(t *testing.T) {
+	setupTestStore(t)
+
+	for _, p := range []models.Product{
+		{Name: "Gouda", Price: 12.5, Category: "Semi-Hard Cheese"},
+		{Name: "Brie", Price: 9.9, Category: "Soft Cheese"},
+		{Name: "Camembert", Price: 8.0, Category: "Soft Cheese"},
+	} {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
 	}
+
+	t.Run("GET filters, sorts and paginates", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?category=Soft+Cheese&sortBy=price&order=desc&page=1&pageSize=1", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.EqualValues(t, 2, resp.Total)
+		assert.EqualValues(t, 2, resp.TotalPages)
+		require.Len(t, resp.Products, 1)
+		assert.Equal(t, "Brie", resp.Products[0].Name)
+	})
+
+	t.Run("GET caps pageSize and rejects non-numeric paging", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?pageSize=100000000", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, maxPageSize, resp.PageSize)
+
+		for _, query := range []string{"page=two", "pageSize=lots", "pageSize=1e9"} {
+			rec := doJSON(t, handleProducts, http.MethodGet, "/products?"+query, nil)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+		}
+	})
+
+	t.Run("GET with no match is 404", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?category=Blue+Cheese", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("GET rejects malformed ID", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?id=nope", nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	products, _, err := store.Products.List(context.Background(), db.ProductQuery{SortBy: "name"})
+	require.NoError(t, err)
+	brie := products[0]
+
+	t.Run("PUT updates the product", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodPut, "/products", map[string]interface{}{
+			"id": brie.ID, "name": "Brie de Meaux", "price": 14.0, "category": "Soft Cheese",
+		})
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = doJSON(t, handleProducts, http.MethodGet, "/products?id="+brie.ID, nil)
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Len(t, resp.Products, 1)
+		assert.Equal(t, "Brie de Meaux", resp.Products[0].Name)
+	})
+
+	t.Run("PUT unknown product is 404", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodPut, "/products", map[string]interface{}{
+			"id": "0123456789abcdef01234567", "name": "Ghost",
+		})
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("DELETE removes the product", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodDelete, "/products", map[string]string{"id": brie.ID})
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = doJSON(t, handleProducts, http.MethodGet, "/products?id="+brie.ID, nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
 }
 
-func TestCRUDOperations(t *testing.T) {
-	setup()
-	defer teardown()
+func TestProductAttributeFilters(t *testing.T) {
+	setupTestStore(t)
 
-	t.Run("POST /item", func(t *testing.T) {
-		item := bson.D{
-			{"name", "item1"},
-			{"price", 10.0},
+	raw := false
+	for _, p := range []models.Product{
+		{Name: "Roquefort", Price: 32, Category: "Blue Cheese", MilkType: models.MilkSheep, Country: "France",
+			Region: "Occitanie", AgeMonths: 3, Texture: models.TextureSemiSoft, FatPercent: 52, Protected: true, Pasteurized: &raw},
+		{Name: "Comté", Price: 28, Category: "Hard Cheese", MilkType: models.MilkCow, Country: "France",
+			Region: "Jura", AgeMonths: 18, Texture: models.TextureHard, FatPercent: 45, Protected: true, Pasteurized: &raw},
+		{Name: "Gouda", Price: 12.5, Category: "Semi-Hard Cheese", MilkType: models.MilkCow, Country: "Netherlands",
+			AgeMonths: 6, Texture: models.TextureSemiHard, FatPercent: 48},
+		{Name: "Chèvre", Price: 9, Category: "Soft Cheese", MilkType: models.MilkGoat, Country: "France",
+			Texture: models.TextureFresh, FatPercent: 45},
+	} {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	get := func(t *testing.T, target string) productsResponse {
+		t.Helper()
+		rec := doJSON(t, handleProducts, http.MethodGet, target, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	names := func(products []models.Product) []string {
+		var out []string
+		for _, p := range products {
+			out = append(out, p.Name)
 		}
-		insertResult, err := test_collection.InsertOne(context.Background(), item)
-		assert.NoError(t, err)
-		assert.NotNil(t, insertResult.InsertedID)
+		return out
+	}
+	count := func(counts []db.FacetCount, value string) int64 {
+		for _, c := range counts {
+			if c.Value == value {
+				return c.Count
+			}
+		}
+		return 0
+	}
+
+	t.Run("filters combine", func(t *testing.T) {
+		resp := get(t, "/products?country=France&milk_type=cow,sheep&pasteurized=false&sortBy=name")
+		assert.Equal(t, []string{"Comté", "Roquefort"}, names(resp.Products))
 
-		var result bson.D
-		err = test_collection.FindOne(context.Background(), bson.D{{"name", "item1"}}).Decode(&result)
-		assert.NoError(t, err)
-		assert.Equal(t, "item1", result.Map()["name"])
+		resp = get(t, "/products?milk_type=cow&milk_type=goat&min_price=10&max_price=30&sortBy=name")
+		assert.Equal(t, []string{"Comté", "Gouda"}, names(resp.Products))
+
+		resp = get(t, "/products?protected=false&min_age=1")
+		assert.Equal(t, []string{"Gouda"}, names(resp.Products))
+
+		resp = get(t, "/products?texture=hard,semi-hard&max_fat=46")
+		assert.Equal(t, []string{"Comté"}, names(resp.Products))
 	})
 
-	t.Run("GET /item", func(t *testing.T) {
-		var result bson.D
-		err := test_collection.FindOne(context.Background(), bson.D{{"name", "item1"}}).Decode(&result)
-		assert.NoError(t, err)
-		assert.Equal(t, "item1", result.Map()["name"])
+	t.Run("facets ignore their own filter", func(t *testing.T) {
+		resp := get(t, "/products?country=France&milk_type=cow")
+		assert.Equal(t, []string{"Comté"}, names(resp.Products))
+
+		// Every French milk type stays on offer, but only French cow's milk
+		// cheese is counted by country.
+		milk := resp.Facets[db.FacetMilkType]
+		assert.EqualValues(t, 1, count(milk, "cow"))
+		assert.EqualValues(t, 1, count(milk, "sheep"))
+		assert.EqualValues(t, 1, count(milk, "goat"))
+		assert.EqualValues(t, 1, count(resp.Facets[db.FacetCountry], "France"))
+		assert.EqualValues(t, 1, count(resp.Facets[db.FacetCountry], "Netherlands"))
+
+		assert.EqualValues(t, 1, count(resp.Facets[db.FacetPrice], "20-50"))
+		assert.EqualValues(t, 1, count(resp.Facets[db.FacetProtected], "true"))
 	})
 
-	t.Run("PUT /item", func(t *testing.T) {
-		update := bson.D{
-			{"$set", bson.D{{"price", 20.0}}},
+	t.Run("ranges count every product without filters", func(t *testing.T) {
+		resp := get(t, "/products")
+		price := resp.Facets[db.FacetPrice]
+		assert.EqualValues(t, 1, count(price, "0-10"))
+		assert.EqualValues(t, 1, count(price, "10-20"))
+		assert.EqualValues(t, 2, count(price, "20-50"))
+		assert.EqualValues(t, 4, count(resp.Facets[db.FacetFat], "45-60"))
+		assert.EqualValues(t, 1, count(resp.Facets[db.FacetAge], "12-24"))
+	})
+
+	t.Run("bad filter values are 400", func(t *testing.T) {
+		for _, target := range []string{"/products?min_price=cheap", "/products?protected=maybe", "/products?max_age=old"} {
+			rec := doJSON(t, handleProducts, http.MethodGet, target, nil)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, target)
 		}
-		_, err := test_collection.UpdateOne(context.Background(), bson.D{{"name", "item1"}}, update)
-		assert.NoError(t, err)
+	})
+
+	t.Run("POST rejects unknown attributes", func(t *testing.T) {
+		for _, p := range []models.Product{
+			{Name: "Yak", MilkType: "yak"},
+			{Name: "Goo", Texture: "liquid"},
+			{Name: "Rich", FatPercent: 120},
+			{Name: "Young", AgeMonths: -1},
+		} {
+			rec := doJSON(t, handleProducts, http.MethodPost, "/products", p)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, p.Name)
+		}
+	})
+}
+
+func TestProductCursorPagination(t *testing.T) {
+	setupTestStore(t)
+
+	for _, p := range []models.Product{
+		{Name: "Gouda", Price: 12.5},
+		{Name: "Brie", Price: 9.9},
+		{Name: "Feta", Price: 9.9},
+		{Name: "Comté", Price: 28},
+		{Name: "Ricotta", Price: 5},
+	} {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	get := func(t *testing.T, target string) map[string]json.RawMessage {
+		t.Helper()
+		rec := doJSON(t, handleProducts, http.MethodGet, target, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp map[string]json.RawMessage
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	decode := func(t *testing.T, resp map[string]json.RawMessage) productsResponse {
+		raw, _ := json.Marshal(resp)
+		var page productsResponse
+		require.NoError(t, json.Unmarshal(raw, &page))
+		return page
+	}
 
-		var result bson.D
-		err = test_collection.FindOne(context.Background(), bson.D{{"name", "item1"}}).Decode(&result)
-		assert.NoError(t, err)
-		assert.Equal(t, 20.0, result.Map()["price"])
+	t.Run("cursors walk the whole listing once", func(t *testing.T) {
+		var names []string
+		resp := get(t, "/products?sortBy=price&sortOrder=desc&pageSize=2")
+		for {
+			page := decode(t, resp)
+			for _, p := range page.Products {
+				names = append(names, p.Name)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			resp = get(t, "/products?pageSize=2&cursor="+page.NextCursor)
+			assert.NotContains(t, resp, "total")
+			assert.NotContains(t, resp, "facets")
+		}
+		// Brie and Feta cost the same; insertion order breaks the tie,
+		// reversed like the price.
+		assert.Equal(t, []string{"Comté", "Gouda", "Feta", "Brie", "Ricotta"}, names)
 	})
 
-	t.Run("DELETE /item", func(t *testing.T) {
-		_, err := test_collection.DeleteOne(context.Background(), bson.D{{"name", "item1"}})
-		assert.NoError(t, err)
+	t.Run("totals on demand", func(t *testing.T) {
+		first := decode(t, get(t, "/products?sortBy=name&pageSize=2"))
+		assert.EqualValues(t, 5, first.Total)
+		require.NotEmpty(t, first.NextCursor)
 
-		var result bson.D
-		err = test_collection.FindOne(context.Background(), bson.D{{"name", "item1"}}).Decode(&result)
-		assert.Error(t, err)
+		resp := get(t, "/products?pageSize=2&includeTotal=true&cursor="+first.NextCursor)
+		page := decode(t, resp)
+		assert.EqualValues(t, 5, page.Total)
+		assert.EqualValues(t, 3, page.TotalPages)
+		assert.Contains(t, resp, "facets")
+		assert.Equal(t, "Feta", page.Products[0].Name)
+	})
+
+	t.Run("rejects unknown sorts and bad cursors", func(t *testing.T) {
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"price","v":"cheap","id":"0123456789abcdef01234567"}`))
+		for _, target := range []string{
+			"/products?sortBy=password",
+			"/products?sortBy=price&order=sideways",
+			"/products?cursor=not-a-cursor",
+			"/products?cursor=" + forged,
+		} {
+			rec := doJSON(t, handleProducts, http.MethodGet, target, nil)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, target)
+		}
 	})
 }
-func generateUniqueUsername() string {
-	rand.Seed(time.Now().UnixNano()) 
-	uniqueSuffix := rand.Intn(1000) 
-	return "user" + strconv.Itoa(int(time.Now().Unix())) + strconv.Itoa(uniqueSuffix)
+
+func TestProductSearch(t *testing.T) {
+	setupTestStore(t)
+
+	for _, p := range []models.Product{
+		{Name: "Camembert de Normandie", Price: 11, Country: "France", Region: "Normandy",
+			Description: "Soft cow's milk cheese with a bloomy rind."},
+		{Name: "Brie", Price: 9.9, Country: "France", Description: "Milder than camembert, and larger."},
+		{Name: "Pont-l'Évêque", Price: 13, Country: "France", Region: "Normandy", Description: "Washed rind cheese."},
+		{Name: "Российский сыр", Price: 6, Country: "Россия", Language: "russian",
+			Description: "Полутвёрдый сыр из коровьего молока."},
+	} {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	type searchResponse struct {
+		productsResponse
+		Corrected string `json:"corrected"`
+	}
+	get := func(t *testing.T, target string) searchResponse {
+		t.Helper()
+		rec := doJSON(t, handleProductSearch, http.MethodGet, target, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp searchResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	names := func(products []models.Product) []string {
+		out := []string{}
+		for _, p := range products {
+			out = append(out, p.Name)
+		}
+		return out
+	}
+
+	t.Run("ranks name matches first", func(t *testing.T) {
+		resp := get(t, "/products/search?q=camembert")
+		assert.Equal(t, []string{"Camembert de Normandie", "Brie"}, names(resp.Products))
+		assert.Empty(t, resp.Corrected)
+	})
+
+	t.Run("paginates like the catalog", func(t *testing.T) {
+		resp := get(t, "/products/search?q=normandy&page=2&pageSize=1")
+		assert.EqualValues(t, 2, resp.Total)
+		assert.EqualValues(t, 2, resp.TotalPages)
+		assert.Equal(t, 2, resp.Page)
+		assert.Equal(t, []string{"Pont-l'Évêque"}, names(resp.Products))
+	})
+
+	t.Run("stems English and Russian", func(t *testing.T) {
+		resp := get(t, "/products/search?q=rinds")
+		assert.Len(t, resp.Products, 2)
+
+		resp = get(t, "/products/search?q=сыры")
+		assert.Equal(t, []string{"Российский сыр"}, names(resp.Products))
+	})
+
+	t.Run("corrects typos", func(t *testing.T) {
+		resp := get(t, "/products/search?q=Camembar")
+		assert.Equal(t, "camembert", resp.Corrected)
+		assert.Equal(t, []string{"Camembert de Normandie", "Brie"}, names(resp.Products))
+	})
+
+	t.Run("no match is an empty page", func(t *testing.T) {
+		resp := get(t, "/products/search?q=cheddar")
+		assert.Empty(t, resp.Products)
+		assert.EqualValues(t, 0, resp.Total)
+	})
+
+	t.Run("q is required", func(t *testing.T) {
+		rec := doJSON(t, handleProductSearch, http.MethodGet, "/products/search?q=+", nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("suggests names by word prefix", func(t *testing.T) {
+		for prefix, want := range map[string][]string{
+			"Cam": {"Camembert de Normandie"},
+			"nor": {"Camembert de Normandie"},
+			"p":   {"Pont-l'Évêque"},
+			"рос": {"Российский сыр"},
+			"zz":  {},
+		} {
+			rec := doJSON(t, handleProductSuggest, http.MethodGet, "/products/suggest?q="+url.QueryEscape(prefix), nil)
+			require.Equal(t, http.StatusOK, rec.Code)
+			var resp struct {
+				Suggestions []string `json:"suggestions"`
+			}
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, want, resp.Suggestions, prefix)
+		}
+	})
+
+	t.Run("POST rejects unknown languages", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", models.Product{Name: "Gouda", Language: "dutch"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
 }
-func startSeleniumServer() (*exec.Cmd, error) {
-	cmd := exec.Command("java", "-jar", "selenium-server-4.28.0.jar", "standalone")
-	err := cmd.Start() 
-	if err != nil {
-		return nil, fmt.Errorf("failed to start Selenium Server: %v", err)
+
+func TestHandleCart(t *testing.T) {
+	setupTestStore(t)
+
+	gouda := models.Product{Name: "Gouda", Price: 12.5, Stock: 3}
+	require.NoError(t, store.Products.Create(context.Background(), &gouda))
+
+	checkout := func(items ...CartItem) *httptest.ResponseRecorder {
+		return doJSON(t, handleCart, http.MethodPost, "/cart", map[string]interface{}{
+			"cart":           items,
+			"customer_name":  "Ann",
+			"email":          "ann@example.com",
+			"payment_method": "credit_card",
+		})
+	}
+	listed := func(t *testing.T) models.Product {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?id="+gouda.ID, nil)
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Len(t, resp.Products, 1)
+		return resp.Products[0]
 	}
 
-	time.Sleep(5 * time.Second)
-	return cmd, nil
+	t.Run("missing fields", func(t *testing.T) {
+		rec := doJSON(t, handleCart, http.MethodPost, "/cart", map[string]interface{}{"cart": []CartItem{}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("creates a pending order and redirects to payment", func(t *testing.T) {
+		rec := checkout(CartItem{ID: gouda.ID, Name: "Gouda", Price: 12.5, Quantity: 2})
+		require.Equal(t, http.StatusSeeOther, rec.Code, rec.Body.String())
+
+		location, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/card", location.Path)
+		assert.Equal(t, "ann@example.com", location.Query().Get("email"))
+
+		order, err := store.Orders.Get(context.Background(), location.Query().Get("order_id"))
+		require.NoError(t, err)
+		assert.Equal(t, "pending", order.PaymentStatus)
+		assert.Equal(t, models.ReservationHeld, order.Reservation)
+		assert.WithinDuration(t, time.Now().Add(cfg.Checkout.ReservationTTL.Std()), order.ReservedUntil, time.Minute)
+		require.Len(t, order.Items, 1)
+		assert.Equal(t, 2, order.Items[0].Quantity)
+		assert.False(t, listed(t).OutOfStock)
+	})
+
+	t.Run("refuses more than is left", func(t *testing.T) {
+		rec := checkout(CartItem{ID: gouda.ID, Name: "Gouda", Quantity: 2})
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		rec = checkout(CartItem{ID: gouda.ID, Name: "Gouda", Quantity: 1})
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.True(t, listed(t).OutOfStock)
+	})
+
+	t.Run("refuses unknown products and empty quantities", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, checkout(CartItem{ID: "p1", Name: "Gouda", Quantity: 1}).Code)
+		assert.Equal(t, http.StatusBadRequest, checkout(CartItem{ID: gouda.ID, Name: "Gouda", Quantity: 0}).Code)
+	})
 }
-func TestRegisterForm(t *testing.T) {
-	username := generateUniqueUsername()
-	seleniumCmd, err := startSeleniumServer()
-	if err != nil {
-		t.Fatalf("Could not start Selenium Server: %v", err)
+
+func TestConcurrentCheckoutsNeverOversell(t *testing.T) {
+	setupTestStore(t)
+
+	brie := models.Product{Name: "Brie", Price: 9.9, Stock: 5}
+	require.NoError(t, store.Products.Create(context.Background(), &brie))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := doJSON(t, handleCart, http.MethodPost, "/cart", map[string]interface{}{
+				"cart":           []CartItem{{ID: brie.ID, Name: "Brie", Quantity: 1}},
+				"customer_name":  "Ann",
+				"email":          "ann@example.com",
+				"payment_method": "credit_card",
+			})
+			codes <- rec.Code
+		}()
 	}
-	defer seleniumCmd.Process.Kill() 
+	wg.Wait()
+	close(codes)
 
-	caps := selenium.Capabilities{
-		"browserName": "chrome",
+	placed := 0
+	for code := range codes {
+		if code == http.StatusSeeOther {
+			placed++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
 	}
+	assert.Equal(t, 5, placed)
+
+	products, _, err := store.Products.List(context.Background(), db.ProductQuery{ID: brie.ID})
+	require.NoError(t, err)
+	assert.Equal(t, 0, products[0].Available())
+}
+
+func TestProductVariants(t *testing.T) {
+	setupTestStore(t)
+
+	comte := models.Product{Name: "Comté", Price: 30, Variants: []models.Variant{
+		{SKU: "COMTE-250", Name: "250 g wedge", Price: 8.5, Unit: models.UnitGram, Size: 250, Stock: 2},
+		{SKU: "COMTE-WHEEL", Name: "Whole wheel", Price: 1200, Unit: models.UnitPiece, Size: 1, WeightGrams: 40000, Stock: 1},
+	}}
+	rec := doJSON(t, handleProducts, http.MethodPost, "/products", comte)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
 
-	driver, err := selenium.NewRemote(caps, "http://localhost:4444/wd/hub")
-	if err != nil {
-		t.Fatalf("Failed to open session: %v", err)
+	listed := func(t *testing.T) models.Product {
+		rec := doJSON(t, handleProducts, http.MethodGet, "/products?search=Comté", nil)
+		var resp productsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Len(t, resp.Products, 1)
+		return resp.Products[0]
 	}
-	defer driver.Quit()
+	got := listed(t)
+	require.Len(t, got.Variants, 2)
+	wedge, wheel := got.Variants[0], got.Variants[1]
+	assert.NotEmpty(t, wedge.ID)
+	assert.Equal(t, 34.0, wedge.PricePerKg)
+	assert.Equal(t, 30.0, wheel.PricePerKg)
+	assert.False(t, got.OutOfStock)
 
-	// Переход на страницу регистрации
-	if err := driver.Get("http://localhost:8080/register"); err != nil {
-		t.Fatalf("Failed to load page: %v", err)
+	checkout := func(items ...CartItem) *httptest.ResponseRecorder {
+		return doJSON(t, handleCart, http.MethodPost, "/cart", map[string]interface{}{
+			"cart":           items,
+			"customer_name":  "Ann",
+			"email":          "ann@example.com",
+			"payment_method": "credit_card",
+		})
 	}
 
-	// Функция ожидания элемента
-	waitForElement := func(selector string) selenium.WebElement {
-		var elem selenium.WebElement
-		for i := 0; i < 10; i++ { // 10 попыток с интервалом 500 мс
-			elem, err = driver.FindElement(selenium.ByCSSSelector, selector)
-			if err == nil {
-				return elem
-			}
-			time.Sleep(500 * time.Millisecond)
+	t.Run("checkout reserves the variant's stock", func(t *testing.T) {
+		rec := checkout(CartItem{ID: got.ID, VariantID: wheel.ID, Name: "Comté, Whole wheel", Price: 0.01, Quantity: 1})
+		require.Equal(t, http.StatusSeeOther, rec.Code, rec.Body.String())
+
+		location, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		order, err := store.Orders.Get(context.Background(), location.Query().Get("order_id"))
+		require.NoError(t, err)
+		require.Len(t, order.Items, 1)
+		assert.Equal(t, wheel.ID, order.Items[0].VariantID)
+		assert.Equal(t, 1200.0, order.Items[0].Price, "the price comes from the catalog")
+		assert.Equal(t, "Comté, Whole wheel", order.Items[0].Name)
+		assert.Equal(t, 1200.0, order.TotalAmount)
+
+		p := listed(t)
+		assert.True(t, p.Variants[1].OutOfStock)
+		assert.False(t, p.Variants[0].OutOfStock)
+		assert.False(t, p.OutOfStock)
+
+		assert.Equal(t, http.StatusConflict, checkout(CartItem{ID: got.ID, VariantID: wheel.ID, Quantity: 1}).Code)
+		assert.Equal(t, http.StatusConflict, checkout(CartItem{ID: got.ID, VariantID: wedge.ID, Quantity: 3}).Code)
+		assert.Equal(t, http.StatusBadRequest, checkout(CartItem{ID: got.ID, VariantID: "0123456789abcdef01234567", Quantity: 1}).Code)
+		assert.Equal(t, http.StatusBadRequest, checkout(CartItem{ID: got.ID, Quantity: 1}).Code, "a variant must be chosen")
+	})
+
+	t.Run("PUT keeps variant IDs and what is reserved", func(t *testing.T) {
+		p := listed(t)
+		p.Variants[1].Stock = 3
+		rec := doJSON(t, handleProducts, http.MethodPut, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		stored, _, err := store.Products.List(context.Background(), db.ProductQuery{ID: p.ID})
+		require.NoError(t, err)
+		assert.Equal(t, wheel.ID, stored[0].Variants[1].ID)
+		assert.Equal(t, 2, stored[0].VariantAvailable(wheel.ID))
+
+		// Variants sent without IDs are matched to the stored ones by SKU.
+		p.Variants[0].ID, p.Variants[1].ID = "", ""
+		rec = doJSON(t, handleProducts, http.MethodPut, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		stored, _, err = store.Products.List(context.Background(), db.ProductQuery{ID: p.ID})
+		require.NoError(t, err)
+		assert.Equal(t, wedge.ID, stored[0].Variants[0].ID)
+		assert.Equal(t, 2, stored[0].VariantAvailable(wheel.ID))
+	})
+
+	t.Run("PUT refuses to drop a reserved variant", func(t *testing.T) {
+		p := listed(t)
+		p.Variants = p.Variants[:1]
+		rec := doJSON(t, handleProducts, http.MethodPut, "/products", p)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		// A variant nobody holds can go.
+		p = listed(t)
+		p.Variants = p.Variants[1:]
+		rec = doJSON(t, handleProducts, http.MethodPut, "/products", p)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Len(t, listed(t).Variants, 1)
+	})
+
+	t.Run("rejects invalid variants", func(t *testing.T) {
+		for _, v := range []models.Variant{
+			{Name: "no sku", Unit: models.UnitGram, Size: 100},
+			{SKU: "X-1", Unit: "lb", Size: 1},
+			{SKU: "X-2", Unit: models.UnitKilogram},
+			{SKU: "X-3", Unit: models.UnitKilogram, Size: 1, Price: -1},
+		} {
+			rec := doJSON(t, handleProducts, http.MethodPost, "/products", models.Product{Name: "Brie", Variants: []models.Variant{v}})
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "%+v", v)
 		}
-		t.Fatalf("Element not found: %s", selector)
-		return nil
+		twice := models.Variant{SKU: "BRIE-1", Unit: models.UnitKilogram, Size: 1}
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", models.Product{Name: "Brie", Variants: []models.Variant{twice, twice}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("SKUs are unique across products", func(t *testing.T) {
+		rec := doJSON(t, handleProducts, http.MethodPost, "/products", models.Product{Name: "Beaufort", Variants: []models.Variant{
+			{SKU: "COMTE-WHEEL", Name: "Whole wheel", Price: 900, Unit: models.UnitPiece, Size: 1},
+		}})
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+
+	t.Run("DELETE refuses a product with reserved stock", func(t *testing.T) {
+		// The wheel is still held by the order placed above.
+		rec := doJSON(t, handleProducts, http.MethodDelete, "/products", map[string]string{"id": got.ID})
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		listed(t)
+
+		require.NoError(t, store.Products.Release(context.Background(), got.ID, wheel.ID, 1))
+		rec = doJSON(t, handleProducts, http.MethodDelete, "/products", map[string]string{"id": got.ID})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		gouda := models.Product{Name: "Gouda", Price: 12, Stock: 3}
+		require.NoError(t, store.Products.Create(context.Background(), &gouda))
+		require.NoError(t, store.Products.Reserve(context.Background(), gouda.ID, "", 1))
+		rec = doJSON(t, handleProducts, http.MethodDelete, "/products", map[string]string{"id": gouda.ID})
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	setupTestStore(t)
+
+	user := models.User{Username: "ann", Email: "ann@example.com", Role: "user"}
+	require.NoError(t, store.Users.Create(context.Background(), &user))
+
+	rec := doJSON(t, updateUserRole, http.MethodPut, "/api/users/"+user.ID+"/role", map[string]string{"role": "admin"})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	updated, err := store.Users.FindByID(context.Background(), user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "admin", updated.Role)
+
+	rec = doJSON(t, updateUserRole, http.MethodPut, "/api/users/not-an-id/role", map[string]string{"role": "admin"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doJSON(t, updateUserRole, http.MethodPut, "/api/users/0123456789abcdef01234567/role", map[string]string{"role": "admin"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// chatUser creates a signed-in user and returns its identity and cookie.
+func chatUser(t *testing.T, username, role string) (chat.Identity, *http.Cookie) {
+	t.Helper()
+	cookie := tokenCookie(t, username, role)
+	user, err := store.Users.FindByUsername(context.Background(), username)
+	require.NoError(t, err)
+	return chat.Identity{ID: user.ID, Username: username, Role: role}, cookie
+}
+
+func getWithCookie(t *testing.T, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
 	}
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
 
-	// Ожидание и ввод данных
-	emailField := waitForElement("#email")
-	usernameField := waitForElement("#username")
-	passwordField := waitForElement("#password")
+func TestGetChatHistory(t *testing.T) {
+	setupTestStore(t)
+	customer, customerCookie := chatUser(t, "customer", "user")
+	admin, adminCookie := chatUser(t, "boss", "admin")
+	_, otherCookie := chatUser(t, "other", "user")
 
-	if err := emailField.SendKeys("test@gmail.com"); err != nil {
-		t.Fatalf("Failed to input email: %v", err)
+	chatID, err := createChat(customer.ID)
+	require.NoError(t, err)
+	_, err = sendMessage(chatID, customer, "Do you ship to Almaty?")
+	require.NoError(t, err)
+	_, err = sendMessage(chatID, admin, "Yes, within three days.")
+	require.NoError(t, err)
+
+	for _, cookie := range []*http.Cookie{customerCookie, adminCookie} {
+		rec := getWithCookie(t, "/api/chat-history?chat_id="+chatID, cookie)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var page chatHistoryPage
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+		messages := page.Messages
+		require.Len(t, messages, 2)
+		assert.False(t, page.HasMore)
+		assert.Equal(t, chatID, messages[1].ChatID)
+		assert.Equal(t, "admin", messages[1].Sender)
+		assert.Equal(t, admin.ID, messages[1].SenderID)
+		assert.WithinDuration(t, time.Now(), messages[1].Timestamp, time.Minute)
 	}
-	if err := usernameField.SendKeys(username); err != nil {
-		t.Fatalf("Failed to input username: %v", err)
+
+	rec := getWithCookie(t, "/api/chat-history?chat_id="+chatID, otherCookie)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "other customers cannot read the chat")
+
+	rec = getWithCookie(t, "/api/chat-history?chat_id="+chatID, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = getWithCookie(t, "/api/chat-history?chat_id=missing", customerCookie)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = getWithCookie(t, "/api/chat-history", customerCookie)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetChatHistoryPages(t *testing.T) {
+	setupTestStore(t)
+	customer, cookie := chatUser(t, "customer", "user")
+	chatID, err := createChat(customer.ID)
+	require.NoError(t, err)
+
+	var sent []string
+	for i := 0; i < 5; i++ {
+		m, err := sendMessage(chatID, customer, fmt.Sprintf("message %d", i))
+		require.NoError(t, err)
+		sent = append(sent, m.ID)
 	}
-	if err := passwordField.SendKeys("TestPassword123"); err != nil {
-		t.Fatalf("Failed to input password: %v", err)
+
+	fetch := func(query string) chatHistoryPage {
+		t.Helper()
+		rec := getWithCookie(t, "/api/chat-history?chat_id="+chatID+query, cookie)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var page chatHistoryPage
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+		return page
 	}
+	ids := func(page chatHistoryPage) []string {
+		var ids []string
+		for _, m := range page.Messages {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	// The first page is the latest one; prev_cursor walks back in time.
+	latest := fetch("&limit=2")
+	assert.Equal(t, sent[3:], ids(latest))
+	assert.True(t, latest.HasMore)
+	assert.Equal(t, sent[4], latest.NextCursor)
+
+	older := fetch("&limit=2&before=" + latest.PrevCursor)
+	assert.Equal(t, sent[1:3], ids(older))
+	assert.True(t, older.HasMore)
+
+	oldest := fetch("&limit=2&before=" + older.PrevCursor)
+	assert.Equal(t, sent[:1], ids(oldest))
+	assert.False(t, oldest.HasMore)
+	assert.Empty(t, oldest.PrevCursor)
 
-	// Ожидание и нажатие кнопки отправки формы
-	submitButton := waitForElement(".main__form-submit")
-	if err := submitButton.Click(); err != nil {
-		t.Fatalf("Failed to click submit button: %v", err)
+	// next_cursor picks up messages sent after the page was loaded.
+	newer := fetch("&after=" + latest.NextCursor)
+	assert.Empty(t, newer.Messages)
+	assert.Equal(t, latest.NextCursor, newer.NextCursor)
+	m, err := sendMessage(chatID, customer, "one more")
+	require.NoError(t, err)
+	newer = fetch("&after=" + newer.NextCursor)
+	assert.Equal(t, []string{m.ID}, ids(newer))
+
+	// Pages follow the order messages were stored in, which IDs from
+	// several servers need not share.
+	stored, err := store.Messages.List(context.Background(), chatID, db.MessagePage{})
+	require.NoError(t, err)
+	for i, m := range stored {
+		assert.Equal(t, int64(i+1), m.Seq)
 	}
 
-	// Ожидание редиректа
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-	timeout := time.After(30 * time.Second)
+	for _, query := range []string{"&limit=0", "&limit=201", "&before=nope", "&after=0123456789abcdef01234567", "&before=" + sent[0] + "&after=" + sent[1]} {
+		rec := getWithCookie(t, "/api/chat-history?chat_id="+chatID+query, cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
 
-	for {
-		select {
-		case <-timeout:
-			pageSource, _ := driver.PageSource()
-			t.Fatalf("Timed out waiting for page redirect. Page source:\n%s", pageSource)
-		case <-ticker.C:
-			currentURL, err := driver.CurrentURL()
-			if err != nil {
-				t.Fatalf("Failed to get current URL: %v", err)
-			}
+func TestGetActiveChat(t *testing.T) {
+	setupTestStore(t)
+	customer, cookie := chatUser(t, "customer", "user")
 
-			fmt.Println("Current URL:", currentURL)
+	rec := getWithCookie(t, "/api/active-chat", cookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"active": false}`, rec.Body.String())
 
-			if currentURL == "http://localhost:8080/verify" {
-				fmt.Println("Successfully redirected to verification page!")
-				return
-			}
+	chatID, err := createChat(customer.ID)
+	require.NoError(t, err)
+	rec = getWithCookie(t, "/api/active-chat", cookie)
+	assert.JSONEq(t, `{"active": true, "chat_id": "`+chatID+`"}`, rec.Body.String())
+}
+
+func TestSendEmailHandler(t *testing.T) {
+	setupTestStore(t)
+
+	payload := EmailPayload{To: "ann@example.com", Subject: "New cheeses", Body: "Comté is back in stock."}
+	payload.File.Filename = "menu.txt"
+	payload.File.Content = base64.StdEncoding.EncodeToString([]byte("Comté 24 months"))
+
+	rec := doJSON(t, sendEmailHandler, http.MethodPost, "/send_email", payload)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	entries, err := store.Outbox.List(context.Background(), models.OutboxPending, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the email is queued, not sent inline")
+
+	capture := mailer.NewCapture(cfg.Mail.From)
+	_, err = outbox.NewWorker(store.Outbox, capture, cfg.Outbox).ProcessDue(context.Background())
+	require.NoError(t, err)
+
+	sent := capture.Last()
+	require.NotNil(t, sent)
+	assert.Equal(t, []string{"ann@example.com"}, sent.To)
+	assert.Equal(t, "shop@example.com", sent.From)
+	require.Len(t, sent.Attachments, 1)
+	assert.Equal(t, "menu.txt", sent.Attachments[0].Filename)
+	assert.Equal(t, "Comté 24 months", string(sent.Attachments[0].Data))
+}
+
+func TestOutboxEndpoints(t *testing.T) {
+	setupTestStore(t)
+	ctx := context.Background()
+
+	require.NoError(t, sendEmail(ctx, "ann@example.com", "Hello", "Welcome!", nil, ""))
+	entries, err := store.Outbox.List(ctx, "", 1)
+	require.NoError(t, err)
+	id := entries[0].ID
+
+	rec := doJSON(t, retryOutboxEntry, http.MethodPost, "/api/outbox/retry", map[string]string{"id": id})
+	assert.Equal(t, http.StatusNotFound, rec.Code, "only dead entries can be retried")
+
+	require.NoError(t, store.Outbox.MarkFailed(ctx, id, 8, "mailbox unavailable", time.Now(), true))
+
+	rec = doJSON(t, getOutbox, http.MethodGet, "/api/outbox?status=dead", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Counts  map[string]int64     `json:"counts"`
+		Entries []models.OutboxEntry `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.EqualValues(t, 1, resp.Counts[models.OutboxDead])
+	require.Len(t, resp.Entries, 1)
+	assert.Equal(t, "mailbox unavailable", resp.Entries[0].LastError)
+	assert.Empty(t, resp.Entries[0].Message.Text, "bodies may hold reset links")
+
+	rec = doJSON(t, retryOutboxEntry, http.MethodPost, "/api/outbox/retry", map[string]string{"id": id})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	entries, err = store.Outbox.List(ctx, models.OutboxPending, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Zero(t, entries[0].Attempts)
+
+	rec = doJSON(t, getOutbox, http.MethodGet, "/api/outbox?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	setupTestStore(t)
+	router := routes()
+
+	serve := func(method, target string, cookie *http.Cookie) int {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(`{}`))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	admin := tokenCookie(t, "ann", "admin")
+	user := tokenCookie(t, "bob", "user")
+
+	for _, route := range []struct{ method, target string }{
+		{http.MethodPost, "/products"},
+		{http.MethodPut, "/products"},
+		{http.MethodDelete, "/products"},
+		{http.MethodGet, "/users"},
+		{http.MethodPut, "/api/users/0123456789abcdef01234567/role"},
+		{http.MethodPost, "/send_email"},
+		{http.MethodGet, "/get_users_email_list"},
+		{http.MethodGet, "/api/active-chats"},
+		{http.MethodGet, "/api/outbox"},
+	} {
+		name := route.method + " " + route.target
+		assert.Equal(t, http.StatusUnauthorized, serve(route.method, route.target, nil), name)
+		assert.Equal(t, http.StatusForbidden, serve(route.method, route.target, user), name)
+		assert.NotContains(t, []int{http.StatusUnauthorized, http.StatusForbidden}, serve(route.method, route.target, admin), name)
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/products", nil), "the catalogue stays public")
+}
+
+func TestUpdateUserRoleRevokesSessions(t *testing.T) {
+	setupTestStore(t)
+	router := routes()
+
+	admin := tokenCookie(t, "ann", "admin")
+	bob := tokenCookie(t, "bob", "user")
+	bobUser, err := store.Users.FindByUsername(context.Background(), "bob")
+	require.NoError(t, err)
+
+	serve := func(method, target string, cookie *http.Cookie, body string) int {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/me", bob, ""))
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, "/api/users/"+bobUser.ID+"/role", admin, `{"role":"admin"}`))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api/me", bob, ""), "a role change ends the user's sessions")
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/api/users/"+bobUser.ID+"/sessions", admin, ""))
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/api/users/0123456789abcdef01234567/sessions", admin, ""))
+}
+
+// startChat runs a fresh hub behind a test server and returns its /ws URL.
+func startChat(t *testing.T) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub = chat.NewHub(chat.NewLocalBus())
+	assigner = chat.NewAssigner(chat.AssignManual)
+	require.NoError(t, hub.Start(ctx))
+
+	// Hijacked connections outlive srv.Close, so wait for their handlers
+	// before the next test replaces the globals they use.
+	var handlers sync.WaitGroup
+	mux := routes()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+		handlers.Wait()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func dialChat(t *testing.T, url string, cookie *http.Cookie) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Cookie": {cookie.String()}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func chatEvent(t *testing.T, conn *websocket.Conn) map[string]string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event map[string]interface{}
+	require.NoError(t, conn.ReadJSON(&event))
+
+	out := map[string]string{}
+	for k, v := range event {
+		if s, ok := v.(string); ok {
+			out[k] = s
+		}
+	}
+	return out
+}
+
+func TestChatMessagesStayInTheirRoom(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+
+	_, adminCookie := chatUser(t, "boss", "admin")
+	admin := dialChat(t, url, adminCookie)
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "subscribe_lobby"}))
+	// Messages from one connection are handled in order, so this reply
+	// means the admin is in the lobby.
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "check_chat", "chat_id": "none"}))
+	require.Equal(t, "chat_status", chatEvent(t, admin)["type"])
+
+	open := func(user string) (*websocket.Conn, string) {
+		_, cookie := chatUser(t, user, "user")
+		conn := dialChat(t, url, cookie)
+		require.NoError(t, conn.WriteJSON(map[string]string{"type": "create_chat"}))
+		created := chatEvent(t, conn)
+		require.Equal(t, "chat_created", created["type"])
+
+		lobby := chatEvent(t, admin)
+		assert.Equal(t, "new_chat", lobby["type"])
+		assert.Equal(t, created["chat_id"], lobby["chat_id"])
+		return conn, created["chat_id"]
+	}
+	alice, aliceChat := open("alice")
+	bob, bobChat := open("bob")
+
+	say := func(conn *websocket.Conn, chatID, content string) {
+		require.NoError(t, conn.WriteJSON(map[string]string{
+			"type": "send_message", "chat_id": chatID, "content": content,
+		}))
+	}
+	say(alice, aliceChat, "for alice's chat")
+	assert.Equal(t, "for alice's chat", chatEvent(t, alice)["content"])
+	say(bob, bobChat, "for bob's chat")
+	assert.Equal(t, "for bob's chat", chatEvent(t, bob)["content"], "bob must not receive alice's messages")
+
+	// The lobby hears about the close but not about the messages before it.
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "close_chat", "chat_id": aliceChat}))
+	closed := chatEvent(t, admin)
+	assert.Equal(t, "chat_closed", closed["type"])
+	assert.Equal(t, aliceChat, closed["chat_id"])
+	assert.Equal(t, "chat_closed", chatEvent(t, alice)["type"])
+}
+
+func TestChatIdentityComesFromSession(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	alice, aliceCookie := chatUser(t, "alice", "user")
+	_, bobCookie := chatUser(t, "bob", "user")
+
+	conn := dialChat(t, url, aliceCookie)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "create_chat", "user_id": "someone-else"}))
+	chatID := chatEvent(t, conn)["chat_id"]
+
+	created, err := store.Chats.Get(context.Background(), chatID)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, created.UserID, "user_id from the page is ignored")
+
+	// Claiming to be an admin changes nothing.
+	require.NoError(t, conn.WriteJSON(map[string]string{
+		"type": "send_message", "chat_id": chatID, "sender": "admin", "content": "refund me",
+	}))
+	event := chatEvent(t, conn)
+	assert.Equal(t, "user", event["sender"])
+	assert.Equal(t, alice.ID, event["sender_id"])
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe_lobby"}))
+	assert.Equal(t, "error", chatEvent(t, conn)["type"])
+
+	// Bob can neither post into nor close Alice's chat.
+	bob := dialChat(t, url, bobCookie)
+	for _, typ := range []string{"send_message", "close_chat", "join_chat"} {
+		require.NoError(t, bob.WriteJSON(map[string]string{"type": typ, "chat_id": chatID, "content": "hi"}))
+		assert.Equal(t, "error", chatEvent(t, bob)["type"], typ)
+	}
+	require.NoError(t, bob.WriteJSON(map[string]string{"type": "check_chat", "chat_id": chatID}))
+	status := map[string]interface{}{}
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, bob.ReadJSON(&status))
+	assert.Equal(t, false, status["exists"])
+
+	stored, err := store.Chats.Get(context.Background(), chatID)
+	require.NoError(t, err)
+	assert.Equal(t, "active", stored.Status)
+	messages, err := store.Messages.List(context.Background(), chatID, db.MessagePage{})
+	require.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func TestChatHandshake(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	_, cookie := chatUser(t, "alice", "user")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	header := http.Header{"Cookie": {cookie.String()}, "Origin": {"https://evil.example"}}
+	_, resp, err = websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	cfg.Chat.AllowedOrigins = []string{"https://shop.example"}
+	header.Set("Origin", "https://shop.example")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+// watchLobby connects an admin and waits until it is in the lobby.
+func watchLobby(t *testing.T, url string, cookie *http.Cookie) *websocket.Conn {
+	t.Helper()
+	conn := dialChat(t, url, cookie)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe_lobby"}))
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "check_chat", "chat_id": "none"}))
+	require.Equal(t, "chat_status", chatEvent(t, conn)["type"])
+	return conn
+}
+
+func TestChatClaimAndTransfer(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	anna, annaCookie := chatUser(t, "anna", "admin")
+	boris, borisCookie := chatUser(t, "boris", "admin")
+	customerUser, customerCookie := chatUser(t, "customer", "user")
+
+	annaConn := watchLobby(t, url, annaCookie)
+	borisConn := dialChat(t, url, borisCookie)
+	customer := dialChat(t, url, customerCookie)
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "create_chat"}))
+	chatID := chatEvent(t, customer)["chat_id"]
+	require.Equal(t, "new_chat", chatEvent(t, annaConn)["type"])
+
+	require.NoError(t, annaConn.WriteJSON(map[string]string{"type": "claim_chat", "chat_id": chatID}))
+	claimed := chatEvent(t, annaConn)
+	assert.Equal(t, "chat_assigned", claimed["type"])
+	assert.Equal(t, anna.ID, claimed["admin_id"])
+	assert.Equal(t, "claimed", claimed["reason"])
+	assert.Equal(t, anna.ID, chatEvent(t, customer)["admin_id"], "the customer sees who took the chat")
+
+	require.NoError(t, borisConn.WriteJSON(map[string]string{"type": "claim_chat", "chat_id": chatID}))
+	assert.Equal(t, "error", chatEvent(t, borisConn)["type"], "a chat can only be claimed once")
+
+	require.NoError(t, annaConn.WriteJSON(map[string]string{"type": "transfer_chat", "chat_id": chatID, "admin_id": customerUser.ID}))
+	assert.Equal(t, "error", chatEvent(t, annaConn)["type"], "chats only go to admins")
+
+	require.NoError(t, annaConn.WriteJSON(map[string]string{"type": "transfer_chat", "chat_id": chatID, "admin_id": boris.ID}))
+	transferred := chatEvent(t, annaConn)
+	assert.Equal(t, boris.ID, transferred["admin_id"])
+	assert.Equal(t, anna.ID, transferred["previous_admin_id"])
+	assert.Equal(t, "transferred", transferred["reason"])
+
+	stored, err := store.Chats.Get(context.Background(), chatID)
+	require.NoError(t, err)
+	assert.Equal(t, boris.ID, stored.AdminID)
+	assert.NotNil(t, stored.AssignedAt)
+
+	// Customers cannot claim chats.
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "claim_chat", "chat_id": chatID}))
+	for event := chatEvent(t, customer); event["type"] != "error"; event = chatEvent(t, customer) {
+		assert.Equal(t, "chat_assigned", event["type"])
+	}
+}
+
+func TestChatAutoAssign(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	assigner = chat.NewAssigner(chat.AssignRoundRobin)
+	anna, annaCookie := chatUser(t, "anna", "admin")
+	boris, borisCookie := chatUser(t, "boris", "admin")
+	watchLobby(t, url, annaCookie)
+	watchLobby(t, url, borisCookie)
+
+	var assigned []string
+	for _, name := range []string{"c1", "c2", "c3"} {
+		_, cookie := chatUser(t, name, "user")
+		conn := dialChat(t, url, cookie)
+		require.NoError(t, conn.WriteJSON(map[string]string{"type": "create_chat"}))
+		require.Equal(t, "chat_created", chatEvent(t, conn)["type"])
+
+		event := chatEvent(t, conn)
+		require.Equal(t, "chat_assigned", event["type"])
+		assert.Equal(t, "auto", event["reason"])
+		assigned = append(assigned, event["admin_id"])
+	}
+	assert.Equal(t, []string{anna.ID, boris.ID, anna.ID}, assigned)
+
+	queue, err := store.Chats.ListUnassigned(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+}
+
+func TestGetChatQueue(t *testing.T) {
+	setupTestStore(t)
+	_, adminCookie := chatUser(t, "boss", "admin")
+	ctx := context.Background()
+
+	now := time.Now()
+	for i, id := range []string{"newer", "taken", "oldest"} {
+		require.NoError(t, store.Chats.Create(ctx, &models.Chat{
+			ChatID: id, UserID: "u" + id, Status: "active", CreatedAt: now.Add(-time.Duration(i+1) * time.Minute),
+		}))
+	}
+	require.NoError(t, store.Chats.Assign(ctx, "taken", "", "someone", now))
+
+	rec := getWithCookie(t, "/api/chat-queue", adminCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var queue []struct {
+		ChatID         string `json:"chat_id"`
+		WaitingSeconds int64  `json:"waiting_seconds"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&queue))
+	require.Len(t, queue, 2)
+	assert.Equal(t, "oldest", queue[0].ChatID)
+	assert.Equal(t, "newer", queue[1].ChatID)
+	assert.InDelta(t, 180, queue[0].WaitingSeconds, 5)
+
+	assert.ErrorIs(t, store.Chats.Assign(ctx, "taken", "", "me", now), db.ErrNotFound)
+}
+
+func expectEvent(t *testing.T, conn *websocket.Conn, typ string) map[string]string {
+	t.Helper()
+	event := chatEvent(t, conn)
+	require.Equal(t, typ, event["type"], "got %v", event)
+	return event
+}
+
+func TestChatTypingAndReceipts(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	admin, adminCookie := chatUser(t, "boss", "admin")
+	customerUser, customerCookie := chatUser(t, "customer", "user")
+
+	customer := dialChat(t, url, customerCookie)
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "create_chat"}))
+	chatID := expectEvent(t, customer, "chat_created")["chat_id"]
+
+	adminConn := dialChat(t, url, adminCookie)
+	require.NoError(t, adminConn.WriteJSON(map[string]string{"type": "claim_chat", "chat_id": chatID}))
+	require.NoError(t, adminConn.WriteJSON(map[string]string{"type": "check_chat", "chat_id": chatID}))
+	expectEvent(t, adminConn, "chat_status")
+	expectEvent(t, customer, "chat_assigned")
+
+	// Typing is relayed to the room.
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "typing_start", "chat_id": chatID}))
+	expectEvent(t, customer, "typing")
+	typing := map[string]interface{}{}
+	adminConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, adminConn.ReadJSON(&typing))
+	assert.Equal(t, "typing", typing["type"])
+	assert.Equal(t, true, typing["typing"])
+	assert.Equal(t, customerUser.ID, typing["user_id"])
+
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "send_message", "chat_id": chatID, "content": "Is Roquefort in stock?"}))
+	messageID := expectEvent(t, customer, "new_message")["message_id"]
+	require.NotEmpty(t, messageID)
+	assert.Equal(t, messageID, expectEvent(t, adminConn, "new_message")["message_id"])
+
+	unread := func() int {
+		t.Helper()
+		rec := getWithCookie(t, "/api/active-chats", adminCookie)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var chats []struct {
+			ChatID string `json:"chat_id"`
+			Unread int    `json:"unread"`
 		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&chats))
+		require.Len(t, chats, 1)
+		return chats[0].Unread
+	}
+	assert.Equal(t, 1, unread())
+
+	require.NoError(t, adminConn.WriteJSON(map[string]string{"type": "delivered", "chat_id": chatID, "message_id": messageID}))
+	receipt := expectEvent(t, customer, "receipt")
+	assert.Equal(t, "delivered", receipt["status"])
+	assert.Equal(t, admin.ID, receipt["user_id"])
+	expectEvent(t, adminConn, "receipt")
+	assert.Equal(t, 1, unread(), "delivered is not read")
+
+	require.NoError(t, adminConn.WriteJSON(map[string]string{"type": "read", "chat_id": chatID, "message_id": messageID}))
+	assert.Equal(t, "read", expectEvent(t, customer, "receipt")["status"])
+	expectEvent(t, adminConn, "receipt")
+	assert.Equal(t, 0, unread())
+
+	stored, err := store.Chats.Get(context.Background(), chatID)
+	require.NoError(t, err)
+	messages, err := store.Messages.List(context.Background(), chatID, db.MessagePage{})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.NotNil(t, messages[0].DeliveredAt)
+	assert.NotNil(t, messages[0].ReadAt)
+	assert.Equal(t, messageID, stored.LastRead[admin.ID])
+	assert.Equal(t, messageID, stored.LastRead[customerUser.ID], "senders have read their own messages")
+
+	require.NoError(t, adminConn.WriteJSON(map[string]string{"type": "read", "chat_id": chatID, "message_id": "nope"}))
+	expectEvent(t, adminConn, "error")
+}
+
+func TestChatResumeReplaysMissedMessages(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	admin, _ := chatUser(t, "boss", "admin")
+	customerUser, customerCookie := chatUser(t, "customer", "user")
+	_, otherCookie := chatUser(t, "other", "user")
+
+	chatID, err := createChat(customerUser.ID)
+	require.NoError(t, err)
+	seen, err := sendMessage(chatID, customerUser, "hello?")
+	require.NoError(t, err)
+
+	// The customer's phone drops off while support answers.
+	var missed []string
+	for _, content := range []string{"Hi!", "How can I help?"} {
+		m, err := sendMessage(chatID, admin, content)
+		require.NoError(t, err)
+		missed = append(missed, m.ID)
+	}
+
+	resume := func(conn *websocket.Conn, lastID string) map[string]interface{} {
+		t.Helper()
+		require.NoError(t, conn.WriteJSON(map[string]string{"type": "resume", "chat_id": chatID, "last_message_id": lastID}))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		event := map[string]interface{}{}
+		require.NoError(t, conn.ReadJSON(&event))
+		return event
+	}
+
+	customer := dialChat(t, url, customerCookie)
+	resumed := resume(customer, seen.ID)
+	require.Equal(t, "resumed", resumed["type"])
+	assert.Equal(t, false, resumed["has_more"])
+	events := resumed["messages"].([]interface{})
+	require.Len(t, events, 2)
+	for i, e := range events {
+		event := e.(map[string]interface{})
+		assert.Equal(t, "new_message", event["type"])
+		assert.Equal(t, missed[i], event["message_id"])
+		assert.Equal(t, admin.ID, event["sender_id"])
 	}
-}
\ No newline at end of file
+
+	// Resuming joined the room again, so live messages follow.
+	m, err := sendMessage(chatID, admin, "Still there?")
+	require.NoError(t, err)
+	publishMessage(m)
+	assert.Equal(t, m.ID, expectEvent(t, customer, "new_message")["message_id"])
+
+	// Up to date: nothing to replay.
+	resumed = resume(customer, m.ID)
+	assert.Empty(t, resumed["messages"])
+
+	other := dialChat(t, url, otherCookie)
+	assert.Equal(t, "error", resume(other, seen.ID)["type"], "only the chat's members can resume it")
+	assert.Equal(t, "error", resume(customer, "nope")["type"])
+}
+
+func TestStoredMessageEvent(t *testing.T) {
+	oid := primitive.NewObjectID()
+	sent := time.Now().UTC().Truncate(time.Millisecond)
+	doc, err := bson.Marshal(bson.M{
+		"_id":       oid,
+		"chat_id":   "chat-1",
+		"sender":    "admin",
+		"sender_id": "admin-1",
+		"content":   "Hello",
+		"timestamp": sent,
+	})
+	require.NoError(t, err)
+
+	room, msg, err := storedMessageEvent(doc)
+	require.NoError(t, err)
+	assert.Equal(t, "chat-1", room)
+	want, err := json.Marshal(messageEvent(models.Message{
+		ID: oid.Hex(), ChatID: "chat-1", Sender: "admin", SenderID: "admin-1", Content: "Hello", Timestamp: sent,
+	}))
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want), string(msg), "the change stream sends what a local publish would")
+}
+
+func TestChatTranscript(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	admin, adminCookie := chatUser(t, "boss", "admin")
+	customerUser, customerCookie := chatUser(t, "customer", "user")
+
+	customer := dialChat(t, url, customerCookie)
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "create_chat"}))
+	chatID := expectEvent(t, customer, "chat_created")["chat_id"]
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "email_transcript", "chat_id": chatID, "enabled": "true"}))
+	expectEvent(t, customer, "email_transcript")
+
+	_, err := sendMessage(chatID, customerUser, "Is the Comté in stock?")
+	require.NoError(t, err)
+	_, err = sendMessage(chatID, admin, "Yes, 24 months.")
+	require.NoError(t, err)
+
+	// Admins can download the chat while it is open.
+	rec := getWithCookie(t, "/api/chat-transcript?chat_id="+chatID+"&format=csv", adminCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "chat_"+chatID+".csv")
+	assert.Contains(t, rec.Body.String(), "customer,"+customerUser.ID+",Is the Comté in stock?")
+
+	rec = getWithCookie(t, "/api/chat-transcript?chat_id="+chatID+"&format=pdf", adminCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "%PDF-"))
+
+	assert.Equal(t, http.StatusForbidden, getWithCookie(t, "/api/chat-transcript?chat_id="+chatID, customerCookie).Code)
+	assert.Equal(t, http.StatusBadRequest, getWithCookie(t, "/api/chat-transcript?chat_id="+chatID+"&format=xml", adminCookie).Code)
+	assert.Equal(t, http.StatusNotFound, getWithCookie(t, "/api/chat-transcript?chat_id=missing", adminCookie).Code)
+
+	// Closing the chat mails the transcript the customer asked for.
+	require.NoError(t, closeChat(chatID))
+	entries, err := store.Outbox.List(context.Background(), models.OutboxPending, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	capture := mailer.NewCapture(cfg.Mail.From)
+	_, err = outbox.NewWorker(store.Outbox, capture, cfg.Outbox).ProcessDue(context.Background())
+	require.NoError(t, err)
+	msg := capture.Last()
+	require.NotNil(t, msg)
+	assert.Equal(t, []string{"customer@example.com"}, msg.To)
+	assert.Contains(t, msg.Text, "Support: Yes, 24 months.")
+	assert.Contains(t, msg.HTML, "Is the Comté in stock?")
+
+	// The transcript is still there after closing.
+	rec = getWithCookie(t, "/api/chat-transcript?chat_id="+chatID, adminCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var exported struct {
+		Chat     models.Chat      `json:"chat"`
+		Messages []models.Message `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&exported))
+	assert.Equal(t, "inactive", exported.Chat.Status)
+	assert.NotNil(t, exported.Chat.ClosedAt)
+	assert.Len(t, exported.Messages, 2)
+}
+
+func TestClosingChatWithoutTranscriptSendsNothing(t *testing.T) {
+	setupTestStore(t)
+	customer, _ := chatUser(t, "customer", "user")
+	chatID, err := createChat(customer.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, closeChat(chatID))
+	entries, err := store.Outbox.List(context.Background(), "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCannedResponsesAPI(t *testing.T) {
+	setupTestStore(t)
+
+	rec := doJSON(t, handleCannedResponses, http.MethodPost, "/api/canned-responses", models.CannedResponse{
+		Shortcut: "/Shipping",
+		Title:    "Shipping times",
+		Content:  "We ship within three days.",
+		Keywords: []string{" Shipping ", "", "DELIVERY"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var created models.CannedResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, "shipping", created.Shortcut)
+	assert.Equal(t, []string{"shipping", "delivery"}, created.Keywords)
+
+	rec = doJSON(t, handleCannedResponses, http.MethodPost, "/api/canned-responses", models.CannedResponse{Shortcut: "shipping", Content: "Again"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doJSON(t, handleCannedResponses, http.MethodPost, "/api/canned-responses", models.CannedResponse{Shortcut: "two words", Content: "x"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doJSON(t, handleCannedResponses, http.MethodPost, "/api/canned-responses", models.CannedResponse{Shortcut: "empty"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	created.Content = "We ship within two days."
+	rec = doJSON(t, handleCannedResponses, http.MethodPut, "/api/canned-responses", created)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = doJSON(t, handleCannedResponses, http.MethodGet, "/api/canned-responses", nil)
+	var listed []models.CannedResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "We ship within two days.", listed[0].Content)
+
+	rec = doJSON(t, handleCannedResponses, http.MethodDelete, "/api/canned-responses", map[string]string{"id": created.ID})
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doJSON(t, handleCannedResponses, http.MethodDelete, "/api/canned-responses", map[string]string{"id": created.ID})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestChatBotAndCannedResponses(t *testing.T) {
+	setupTestStore(t)
+	url := startChat(t)
+	_, adminCookie := chatUser(t, "boss", "admin")
+	_, customerCookie := chatUser(t, "customer", "user")
+	require.NoError(t, store.Canned.Create(context.Background(), &models.CannedResponse{
+		Shortcut: "storage",
+		Content:  "Keep cheese in the fridge, wrapped in wax paper.",
+		Keywords: []string{"store", "storage"},
+	}))
+
+	customer := dialChat(t, url, customerCookie)
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "create_chat"}))
+	chatID := expectEvent(t, customer, "chat_created")["chat_id"]
+	say := func(content string) {
+		t.Helper()
+		require.NoError(t, customer.WriteJSON(map[string]string{"type": "send_message", "chat_id": chatID, "content": content}))
+		assert.Equal(t, content, expectEvent(t, customer, "new_message")["content"])
+	}
+
+	// Nobody has claimed the chat, so the bot answers.
+	say("How should I store Brie?")
+	reply := expectEvent(t, customer, "new_message")
+	assert.Equal(t, "bot", reply["sender"])
+	assert.Empty(t, reply["sender_id"])
+	assert.Equal(t, "Keep cheese in the fridge, wrapped in wax paper.", reply["content"])
+
+	// It does not repeat itself; the next event is the customer's own.
+	say("And how do I store Comté?")
+	say("marker")
+
+	// Once an admin has the chat, the bot stays quiet.
+	admin := dialChat(t, url, adminCookie)
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "claim_chat", "chat_id": chatID}))
+	expectEvent(t, customer, "chat_assigned")
+	say("What about storage of Roquefort?")
+	say("marker")
+
+	// Admins send canned responses by shortcut; customers cannot.
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "send_canned", "chat_id": chatID, "shortcut": "/storage"}))
+	event := expectEvent(t, customer, "new_message")
+	assert.Equal(t, "admin", event["sender"])
+	assert.Equal(t, "Keep cheese in the fridge, wrapped in wax paper.", event["content"])
+
+	require.NoError(t, customer.WriteJSON(map[string]string{"type": "send_canned", "chat_id": chatID, "shortcut": "storage"}))
+	expectEvent(t, customer, "error")
+	require.NoError(t, admin.WriteJSON(map[string]string{"type": "send_canned", "chat_id": chatID, "shortcut": "missing"}))
+	for {
+		if e := chatEvent(t, admin); e["type"] == "error" {
+			break
+		}
+	}
+}
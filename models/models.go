@@ -0,0 +1,352 @@
+// Package models holds the documents shared by the HTTP handlers, the auth
+// package and the storage layer.
+package models
+
+import (
+	"cheese_market/mailer"
+	"math"
+	"time"
+)
+
+type Product struct {
+	ID       string  `json:"id" bson:"_id,omitempty"`
+	Name     string  `json:"name" bson:"name"`
+	Price    float64 `json:"price" bson:"price"`
+	Category string  `json:"category" bson:"category"`
+
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	// Language is the language of Name and Description, "english" or
+	// "russian", which decides how search stems their words. Empty means
+	// English.
+	Language string `json:"language,omitempty" bson:"language,omitempty"`
+	// NameWords are the lower-case words of Name, stored and indexed for
+	// name suggestions.
+	NameWords []string `json:"-" bson:"name_words,omitempty"`
+
+	MilkType MilkType `json:"milk_type,omitempty" bson:"milk_type,omitempty"`
+	Country  string   `json:"country,omitempty" bson:"country,omitempty"`
+	Region   string   `json:"region,omitempty" bson:"region,omitempty"`
+	// AgeMonths is how long the cheese was matured; 0 for fresh cheese.
+	AgeMonths int     `json:"age_months" bson:"age_months"`
+	Texture   Texture `json:"texture,omitempty" bson:"texture,omitempty"`
+	// FatPercent is the fat content in dry matter.
+	FatPercent float64 `json:"fat_percent" bson:"fat_percent"`
+	// Protected marks a protected designation of origin (PDO, AOC, DOP).
+	Protected bool `json:"protected" bson:"protected"`
+	// Pasteurized is nil when unknown and false for raw-milk cheese.
+	Pasteurized *bool `json:"pasteurized,omitempty" bson:"pasteurized,omitempty"`
+
+	// Stock is how many units are on hand. Reserved of them are held by
+	// orders waiting for payment and cannot be sold again. Products sold
+	// in variants keep their stock on the variants instead.
+	Stock    int `json:"stock" bson:"stock"`
+	Reserved int `json:"-" bson:"reserved"`
+	// OutOfStock is filled in for API responses and never stored.
+	OutOfStock bool `json:"out_of_stock" bson:"-"`
+
+	Variants []Variant `json:"variants,omitempty" bson:"variants,omitempty"`
+	// VariantReserved maps variant IDs to their reserved units. It lives
+	// outside Variants so that replacing the variants keeps reservations.
+	VariantReserved map[string]int `json:"-" bson:"variant_reserved,omitempty"`
+}
+
+// Available is how many units can still be ordered.
+func (p Product) Available() int {
+	return p.Stock - p.Reserved
+}
+
+// Variant returns the variant with the given ID, or nil.
+func (p Product) Variant(id string) *Variant {
+	for i := range p.Variants {
+		if p.Variants[i].ID == id {
+			return &p.Variants[i]
+		}
+	}
+	return nil
+}
+
+// VariantAvailable is how many units of a variant can still be ordered.
+func (p Product) VariantAvailable(id string) int {
+	v := p.Variant(id)
+	if v == nil {
+		return 0
+	}
+	return v.Stock - p.VariantReserved[id]
+}
+
+// Units of measure of a variant.
+const (
+	UnitGram     = "g"
+	UnitKilogram = "kg"
+	UnitPiece    = "piece"
+)
+
+// Variant is one way a product is sold: a wedge, a pack of a given weight
+// or a whole wheel, with its own price and stock.
+type Variant struct {
+	ID   string `json:"id" bson:"id"`
+	SKU  string `json:"sku" bson:"sku"`
+	Name string `json:"name" bson:"name"`
+	// Price is the price of one item of Size Units.
+	Price float64 `json:"price" bson:"price"`
+	Unit  string  `json:"unit" bson:"unit"`
+	// Size is how many Units one item holds: 250 for a 250 g pack, 1 for a
+	// wheel.
+	Size float64 `json:"size" bson:"size"`
+	// WeightGrams is the approximate weight of a piece, for price per kg.
+	WeightGrams float64 `json:"weight_grams,omitempty" bson:"weight_grams,omitempty"`
+	Stock       int     `json:"stock" bson:"stock"`
+
+	// OutOfStock and PricePerKg are filled in for API responses and never
+	// stored.
+	OutOfStock bool    `json:"out_of_stock" bson:"-"`
+	PricePerKg float64 `json:"price_per_kg,omitempty" bson:"-"`
+}
+
+// Grams is the weight of one item, 0 for pieces of unknown weight.
+func (v Variant) Grams() float64 {
+	switch v.Unit {
+	case UnitGram:
+		return v.Size
+	case UnitKilogram:
+		return v.Size * 1000
+	case UnitPiece:
+		return v.Size * v.WeightGrams
+	}
+	return 0
+}
+
+// PerKg is the variant's price for a kilogram, rounded to cents, or 0 if
+// its weight is unknown.
+func (v Variant) PerKg() float64 {
+	grams := v.Grams()
+	if grams <= 0 {
+		return 0
+	}
+	return math.Round(v.Price/grams*1000*100) / 100
+}
+
+type MilkType string
+
+const (
+	MilkCow     MilkType = "cow"
+	MilkGoat    MilkType = "goat"
+	MilkSheep   MilkType = "sheep"
+	MilkBuffalo MilkType = "buffalo"
+	MilkMixed   MilkType = "mixed"
+)
+
+func (m MilkType) Valid() bool {
+	switch m {
+	case "", MilkCow, MilkGoat, MilkSheep, MilkBuffalo, MilkMixed:
+		return true
+	}
+	return false
+}
+
+type Texture string
+
+const (
+	TextureFresh    Texture = "fresh"
+	TextureSoft     Texture = "soft"
+	TextureSemiSoft Texture = "semi-soft"
+	TextureSemiHard Texture = "semi-hard"
+	TextureHard     Texture = "hard"
+)
+
+func (t Texture) Valid() bool {
+	switch t {
+	case "", TextureFresh, TextureSoft, TextureSemiSoft, TextureSemiHard, TextureHard:
+		return true
+	}
+	return false
+}
+
+type User struct {
+	ID               string `bson:"_id,omitempty" json:"id"`
+	Email            string `bson:"email" json:"email"`
+	Username         string `bson:"username" json:"username"`
+	Password         string `bson:"password,omitempty" json:"-"`
+	Role             string `bson:"role" json:"role"`
+	Verified         bool   `bson:"verified" json:"verified"`
+	VerificationCode string `bson:"verificationCode,omitempty" json:"-"`
+	// VerificationExpiresAt is when VerificationCode stops being accepted.
+	VerificationExpiresAt time.Time `bson:"verificationExpiresAt,omitempty" json:"-"`
+	// VerificationSentAt is when the current code was emailed; resends are
+	// throttled from it.
+	VerificationSentAt time.Time `bson:"verificationSentAt,omitempty" json:"-"`
+	// VerificationAttempts counts wrong guesses of the current code.
+	VerificationAttempts int  `bson:"verificationAttempts,omitempty" json:"-"`
+	TOTP                 TOTP `bson:"totp,omitempty" json:"-"`
+}
+
+// TOTP holds a user's authenticator app enrollment.
+type TOTP struct {
+	Enabled bool   `bson:"enabled,omitempty"`
+	Secret  string `bson:"secret,omitempty"`
+	// PendingSecret is shown during enrollment and becomes Secret once the
+	// user proves their app generates matching codes.
+	PendingSecret string `bson:"pendingSecret,omitempty"`
+	// RecoveryCodes are SHA-256 hashes of the unused one-time recovery codes.
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
+	// LastCounter is the time step of the last accepted code; codes from
+	// that step or earlier are refused so a code cannot be replayed.
+	LastCounter int64 `bson:"lastCounter,omitempty"`
+}
+
+type Chat struct {
+	ChatID    string    `bson:"chat_id" json:"chat_id"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	AdminID   string    `bson:"admin_id,omitempty" json:"admin_id,omitempty"`
+	Status    string    `bson:"status" json:"status"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// AssignedAt is when AdminID last changed.
+	AssignedAt *time.Time `bson:"assigned_at,omitempty" json:"assigned_at,omitempty"`
+	// LastRead maps each participant's user ID to the ID of the last
+	// message they have read, and LastReadSeq to its Seq.
+	LastRead    map[string]string `bson:"last_read,omitempty" json:"last_read,omitempty"`
+	LastReadSeq map[string]int64  `bson:"last_read_seq,omitempty" json:"-"`
+	// EmailTranscript asks for the conversation to be emailed to the
+	// customer when the chat is closed.
+	EmailTranscript bool       `bson:"email_transcript,omitempty" json:"email_transcript,omitempty"`
+	ClosedAt        *time.Time `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+}
+
+// CannedResponse is a prepared answer admins send by its shortcut. The
+// support bot also sends it, while nobody has claimed a chat, to customers
+// whose message contains one of its keywords.
+type CannedResponse struct {
+	ID       string   `json:"id" bson:"_id,omitempty"`
+	Shortcut string   `json:"shortcut" bson:"shortcut"`
+	Title    string   `json:"title" bson:"title"`
+	Content  string   `json:"content" bson:"content"`
+	Keywords []string `json:"keywords,omitempty" bson:"keywords,omitempty"`
+}
+
+// Message is one entry of a chat, stored in its own collection so chats can
+// grow without limit.
+type Message struct {
+	// ID identifies the message and serves as a pagination cursor. IDs
+	// made by different servers in the same second are not in insert
+	// order, so messages are ordered by Seq instead.
+	ID     string `json:"id" bson:"_id,omitempty"`
+	ChatID string `json:"chat_id" bson:"chat_id"`
+	// Seq numbers the chat's messages in the order they were stored,
+	// starting at 1.
+	Seq int64 `json:"-" bson:"seq,omitempty"`
+	// Sender is "admin", "user" or "bot"; SenderID is the account that
+	// wrote it and empty for the bot.
+	Sender    string    `json:"sender" bson:"sender"`
+	SenderID  string    `json:"sender_id,omitempty" bson:"sender_id,omitempty"`
+	Content   string    `json:"content" bson:"content"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+	// DeliveredAt and ReadAt record when the other side of the chat first
+	// received and read the message.
+	DeliveredAt *time.Time `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty" bson:"read_at,omitempty"`
+}
+
+// Order payment statuses.
+const (
+	PaymentPending = "pending"
+	PaymentPaid    = "paid"
+	PaymentFailed  = "failed"
+	// PaymentExpired orders were not paid within checkout.reservation_ttl.
+	PaymentExpired = "expired"
+)
+
+// Stock reservation states of an order.
+const (
+	// ReservationHeld stock waits for the order to be paid.
+	ReservationHeld = "held"
+	// ReservationCommitted stock was paid for and has left the shelf.
+	ReservationCommitted = "committed"
+	// ReservationReleased stock went back on sale.
+	ReservationReleased = "released"
+)
+
+type Order struct {
+	ID            string      `json:"id" bson:"_id,omitempty"`
+	CustomerName  string      `json:"customer_name" bson:"customerName"`
+	Email         string      `json:"email" bson:"email"`
+	Items         []OrderItem `json:"items" bson:"items"`
+	CreatedAt     time.Time   `json:"created_at" bson:"createdAt"`
+	TotalAmount   float64     `json:"total_amount" bson:"totalAmount"`
+	Currency      string      `json:"currency" bson:"currency"`
+	PaymentStatus string      `json:"payment_status" bson:"paymentStatus"`
+	Reservation   string      `json:"reservation,omitempty" bson:"reservation,omitempty"`
+	// ReservedUntil is when held stock is released if the order is unpaid.
+	ReservedUntil time.Time `json:"reserved_until,omitempty" bson:"reservedUntil,omitempty"`
+}
+
+// Total is what the order costs: the sum of its items' prices.
+func (o Order) Total() float64 {
+	total := 0.0
+	for _, item := range o.Items {
+		total += item.Price * float64(item.Quantity)
+	}
+	return total
+}
+
+type OrderItem struct {
+	ID string `json:"id" bson:"id"`
+	// VariantID is the variant of product ID that was ordered, if it has
+	// variants.
+	VariantID string  `json:"variant_id,omitempty" bson:"variantId,omitempty"`
+	Name      string  `json:"name" bson:"name"`
+	Price     float64 `json:"price" bson:"price"`
+	Quantity  int     `json:"quantity" bson:"quantity"`
+}
+
+// Session is a signed-in device. Access tokens name their session, so
+// revoking it logs the device out even before the token expires.
+type Session struct {
+	ID     string `json:"id" bson:"_id,omitempty"`
+	UserID string `json:"user_id" bson:"user_id"`
+	// RefreshHash is the SHA-256 of the current refresh token; it changes
+	// on every refresh.
+	RefreshHash string     `json:"-" bson:"refresh_hash"`
+	UserAgent   string     `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	IP          string     `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt  time.Time  `json:"last_used_at" bson:"last_used_at"`
+	ExpiresAt   time.Time  `json:"expires_at" bson:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session may still be used at now.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// PasswordReset is an outstanding "forgot password" link. Only a hash of
+// the token in the link is stored.
+type PasswordReset struct {
+	ID        string     `json:"id" bson:"_id,omitempty"`
+	UserID    string     `json:"user_id" bson:"user_id"`
+	TokenHash string     `json:"-" bson:"token_hash"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" bson:"used_at,omitempty"`
+}
+
+// Outbox entry states.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxEntry is an email waiting in the durable outbox.
+type OutboxEntry struct {
+	ID            string         `json:"id" bson:"_id,omitempty"`
+	Message       mailer.Message `json:"message" bson:"message"`
+	Status        string         `json:"status" bson:"status"`
+	Attempts      int            `json:"attempts" bson:"attempts"`
+	LastError     string         `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	NextAttemptAt time.Time      `json:"next_attempt_at" bson:"next_attempt_at"`
+	LockedUntil   time.Time      `json:"-" bson:"locked_until,omitempty"`
+	CreatedAt     time.Time      `json:"created_at" bson:"created_at"`
+	SentAt        *time.Time     `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+}
@@ -0,0 +1,118 @@
+// Package outbox delivers email asynchronously. Handlers enqueue messages in
+// the same transaction as the change that triggered them, and a Worker sends
+// them in the background, retrying with exponential backoff until the entry
+// is delivered or moved to the dead letters.
+package outbox
+
+import (
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Enqueue stores msg for delivery as soon as a worker picks it up.
+func Enqueue(ctx context.Context, repo db.OutboxRepository, msg mailer.Message) error {
+	now := time.Now()
+	return repo.Enqueue(ctx, &models.OutboxEntry{
+		Message:       msg,
+		Status:        models.OutboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// Worker polls the outbox and hands due entries to a Mailer.
+type Worker struct {
+	repo   db.OutboxRepository
+	mailer mailer.Mailer
+	cfg    config.Outbox
+
+	// now is the worker's clock; tests replace it to step through backoffs.
+	now func() time.Time
+}
+
+func NewWorker(repo db.OutboxRepository, m mailer.Mailer, cfg config.Outbox) *Worker {
+	return &Worker{repo: repo, mailer: m, cfg: cfg, now: time.Now}
+}
+
+// Run processes the outbox every poll interval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.PollInterval.Std())
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.ProcessDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("outbox: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue sends every entry that is due now and returns how many were
+// attempted. Delivery failures are recorded on the entries, not returned.
+func (w *Worker) ProcessDue(ctx context.Context) (int, error) {
+	processed := 0
+	for ctx.Err() == nil {
+		entry, err := w.repo.ClaimDue(ctx, w.now(), w.cfg.Lease.Std())
+		if errors.Is(err, db.ErrNotFound) {
+			return processed, nil
+		}
+		if err != nil {
+			return processed, err
+		}
+		processed++
+
+		if entry.Attempts > w.cfg.MaxAttempts {
+			// Its lease ran out without a verdict too often: the worker
+			// handling it crashed every time.
+			log.Printf("outbox: giving up on %s to %v after %d abandoned attempts", entry.ID, entry.Message.To, entry.Attempts-1)
+			if err := w.repo.MarkFailed(ctx, entry.ID, entry.Attempts-1, "lease expired", w.now(), true); err != nil {
+				return processed, err
+			}
+			continue
+		}
+		if err := w.deliver(ctx, entry); err != nil {
+			return processed, err
+		}
+	}
+	return processed, ctx.Err()
+}
+
+func (w *Worker) deliver(ctx context.Context, entry *models.OutboxEntry) error {
+	sendErr := w.mailer.Send(ctx, &entry.Message)
+	if sendErr == nil {
+		return w.repo.MarkSent(ctx, entry.ID, w.now())
+	}
+
+	attempts := entry.Attempts
+	dead := attempts >= w.cfg.MaxAttempts
+	next := w.now().Add(w.backoff(attempts))
+	if dead {
+		log.Printf("outbox: giving up on %s to %v after %d attempts: %v", entry.ID, entry.Message.To, attempts, sendErr)
+	} else {
+		log.Printf("outbox: attempt %d for %s failed, retrying at %s: %v", attempts, entry.ID, next.Format(time.RFC3339), sendErr)
+	}
+	return w.repo.MarkFailed(ctx, entry.ID, attempts, sendErr.Error(), next, dead)
+}
+
+// backoff returns the delay after the given number of failed attempts:
+// BaseBackoff, doubling each time, capped at MaxBackoff.
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.cfg.BaseBackoff.Std()
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= w.cfg.MaxBackoff.Std() {
+			return w.cfg.MaxBackoff.Std()
+		}
+	}
+	return delay
+}
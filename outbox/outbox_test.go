@@ -0,0 +1,146 @@
+package outbox
+
+import (
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() config.Outbox {
+	return config.Outbox{
+		PollInterval: config.Duration(time.Second),
+		MaxAttempts:  3,
+		BaseBackoff:  config.Duration(time.Minute),
+		MaxBackoff:   config.Duration(3 * time.Minute),
+		Lease:        config.Duration(time.Minute),
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := NewWorker(nil, nil, testConfig())
+
+	assert.Equal(t, time.Minute, w.backoff(1))
+	assert.Equal(t, 2*time.Minute, w.backoff(2))
+	assert.Equal(t, 3*time.Minute, w.backoff(3), "capped at max_backoff")
+	assert.Equal(t, 3*time.Minute, w.backoff(40))
+}
+
+func TestWorkerDelivers(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	sent := mailer.NewCapture("shop@example.com")
+	w := NewWorker(store.Outbox, sent, testConfig())
+
+	require.NoError(t, Enqueue(ctx, store.Outbox, mailer.Message{To: []string{"ann@example.com"}, Subject: "Hi", Text: "Hello"}))
+
+	n, err := w.ProcessDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, sent.Messages(), 1)
+	assert.Equal(t, "shop@example.com", sent.Last().From)
+
+	entries, err := store.Outbox.List(ctx, models.OutboxSent, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.NotNil(t, entries[0].SentAt)
+
+	n, err = w.ProcessDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n, "sent entries are not delivered twice")
+}
+
+func TestWorkerRetriesThenDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	sent := mailer.NewCapture("shop@example.com")
+	sent.SetErr(errors.New("421 service not available"))
+
+	require.NoError(t, Enqueue(ctx, store.Outbox, mailer.Message{To: []string{"ann@example.com"}, Subject: "Hi", Text: "Hello"}))
+
+	now := time.Now()
+	w := NewWorker(store.Outbox, sent, testConfig())
+	w.now = func() time.Time { return now }
+
+	for attempt, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		n, err := w.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, n, "attempt %d", attempt+1)
+
+		n, err = w.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Zero(t, n, "nothing is due before the backoff elapses")
+
+		now = now.Add(wait)
+	}
+
+	_, err := w.ProcessDue(ctx)
+	require.NoError(t, err)
+
+	dead, err := store.Outbox.List(ctx, models.OutboxDead, 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, "421 service not available", dead[0].LastError)
+
+	sent.SetErr(nil)
+	require.NoError(t, store.Outbox.Retry(ctx, dead[0].ID, now))
+	_, err = w.ProcessDue(ctx)
+	require.NoError(t, err)
+	assert.Len(t, sent.Messages(), 1)
+}
+
+func TestExpiredLeaseIsReclaimed(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	require.NoError(t, Enqueue(ctx, store.Outbox, mailer.Message{To: []string{"ann@example.com"}, Subject: "Hi", Text: "Hello"}))
+
+	now := time.Now()
+	claimed, err := store.Outbox.ClaimDue(ctx, now, time.Minute)
+	require.NoError(t, err)
+
+	_, err = store.Outbox.ClaimDue(ctx, now, time.Minute)
+	assert.ErrorIs(t, err, db.ErrNotFound, "a leased entry is not handed out twice")
+
+	again, err := store.Outbox.ClaimDue(ctx, now.Add(2*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, claimed.ID, again.ID)
+}
+
+func TestWorkerCountsAbandonedAttempts(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	sent := mailer.NewCapture("shop@example.com")
+	cfg := testConfig()
+
+	require.NoError(t, Enqueue(ctx, store.Outbox, mailer.Message{To: []string{"ann@example.com"}, Subject: "Hi", Text: "Hello"}))
+
+	// A worker that crashes mid-send never reports back; its lease expires.
+	now := time.Now()
+	for i := 0; i < cfg.MaxAttempts; i++ {
+		_, err := store.Outbox.ClaimDue(ctx, now, cfg.Lease.Std())
+		require.NoError(t, err)
+		now = now.Add(cfg.Lease.Std())
+	}
+
+	w := NewWorker(store.Outbox, sent, cfg)
+	w.now = func() time.Time { return now }
+	n, err := w.ProcessDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, sent.Messages(), "an entry out of attempts is not sent again")
+
+	dead, err := store.Outbox.List(ctx, models.OutboxDead, 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, cfg.MaxAttempts, dead[0].Attempts)
+	assert.Empty(t, dead[0].Message.Text, "List leaves out message bodies")
+}
@@ -1,24 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/inventory"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"cheese_market/outbox"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"text/template"
 	"time"
 
 	"github.com/jung-kurt/gofpdf"
-	gomail "gopkg.in/gomail.v2"
 )
 
 var (
+	cfg           *config.Config
+	store         *db.Store
 	templateDir   string
 	staticDir     string
 	uploadTempDir string
 )
+
 // Payment Response Struct
 type PaymentResponse struct {
 	Status      string  `json:"status"`
@@ -26,22 +38,19 @@ type PaymentResponse struct {
 	Currency    string  `json:"currency"`
 }
 
-// Cart Item Struct
-type CartItem struct {
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Quantity int     `json:"quantity"`
-}
-
-// Payment Request Struct
+// Payment Request Struct. The items, prices and customer come from the
+// stored order, never from the request.
 type PaymentRequest struct {
-	Currency      string     `json:"currency"`
-	Items         []CartItem `json:"items"`
-	CustomerName  string     `json:"customer_name"`
-	Email         string     `json:"email"`
-	PaymentMethod string     `json:"payment_method"`
+	// OrderID is the order placed at /cart; its reserved stock is taken
+	// when the payment goes through.
+	OrderID       string `json:"order_id"`
+	PaymentMethod string `json:"payment_method"`
 }
 
+// errOrderExpired means the order no longer holds its stock, or never
+// existed; it has to be placed again.
+var errOrderExpired = errors.New("order has expired")
+
 // Logger Setup
 var logFile *os.File
 
@@ -64,10 +73,6 @@ func initPaths() {
 		}
 	}
 }
-func serveHTML(w http.ResponseWriter, r *http.Request, filename string) {
-	filePath := filepath.Join(templateDir, filename)
-	http.ServeFile(w, r, filePath)
-}
 
 func initLogger() {
 	var err error
@@ -80,7 +85,7 @@ func initLogger() {
 	log.Println("Logger initialized.")
 }
 
-func generatePDF(req PaymentRequest, transactionID string) (string, error) {
+func generatePDF(order *models.Order, paymentMethod, transactionID string) ([]byte, error) {
 	log.Printf("[INFO] Generating PDF receipt for transaction: %s", transactionID)
 
 	pdf := gofpdf.New("P", "mm", "A4", "")
@@ -94,49 +99,50 @@ func generatePDF(req PaymentRequest, transactionID string) (string, error) {
 	pdf.Ln(8)
 	pdf.Cell(40, 10, fmt.Sprintf("Date: %s", time.Now().Format("2006-01-02 15:04:05")))
 	pdf.Ln(8)
-	pdf.Cell(40, 10, fmt.Sprintf("Customer: %s", req.CustomerName))
+	pdf.Cell(40, 10, fmt.Sprintf("Customer: %s", order.CustomerName))
 	pdf.Ln(8)
-	pdf.Cell(40, 10, fmt.Sprintf("Payment Method: %s", req.PaymentMethod))
+	pdf.Cell(40, 10, fmt.Sprintf("Payment Method: %s", paymentMethod))
 	pdf.Ln(8)
 
-	totalAmount := 0.0
-	for _, item := range req.Items {
-		pdf.Cell(40, 10, fmt.Sprintf("%s - %d x %.2f %s", item.Name, item.Quantity, item.Price, req.Currency))
+	for _, item := range order.Items {
+		pdf.Cell(40, 10, fmt.Sprintf("%s - %d x %.2f %s", item.Name, item.Quantity, item.Price, order.Currency))
 		pdf.Ln(8)
-		totalAmount += item.Price * float64(item.Quantity)
 	}
 
 	pdf.Ln(10)
 	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(40, 10, fmt.Sprintf("Total Amount: %.2f %s", totalAmount, req.Currency))
+	pdf.Cell(40, 10, fmt.Sprintf("Total Amount: %.2f %s", order.Total(), order.Currency))
 
-	filename := fmt.Sprintf("receipt_%s.pdf", transactionID)
-	err := pdf.OutputFileAndClose(filename)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
 		log.Printf("[ERROR] Failed to generate PDF: %v", err)
+		return nil, err
 	}
-	log.Printf("[INFO] PDF receipt saved: %s", filename)
+	log.Printf("[INFO] PDF receipt generated for transaction: %s", transactionID)
 
-	return filename, err
+	return buf.Bytes(), nil
 }
 
-func sendEmail(to string, pdfPath string) error {
-	log.Printf("[INFO] Sending email receipt to: %s", to)
-
-	m := gomail.NewMessage()
-	m.SetHeader("From", "230047@astanait.edu.kz")
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", "Your Payment Receipt")
-	m.SetBody("text/plain", "Please find your receipt attached.")
-	m.Attach(pdfPath)
-
-	d := gomail.NewDialer("smtp.office365.com", 587, "230047@astanait.edu.kz", "aRBmKl1O0G0kw")
-	err := d.DialAndSend(m)
+// sendEmail queues the receipt in the outbox so a slow or unavailable SMTP
+// server cannot fail a payment that has already gone through.
+func sendEmail(ctx context.Context, to string, receipt []byte, transactionID string) error {
+	log.Printf("[INFO] Queueing email receipt to: %s", to)
+
+	err := outbox.Enqueue(ctx, store.Outbox, mailer.Message{
+		To:      []string{to},
+		Subject: "Your Payment Receipt",
+		Text:    "Please find your receipt attached.",
+		Attachments: []mailer.Attachment{{
+			Filename:    fmt.Sprintf("receipt_%s.pdf", transactionID),
+			ContentType: "application/pdf",
+			Data:        receipt,
+		}},
+	})
 
 	if err != nil {
-		log.Printf("[ERROR] Failed to send email: %v", err)
+		log.Printf("[ERROR] Failed to queue email: %v", err)
 	} else {
-		log.Printf("[INFO] Email sent successfully to %s", to)
+		log.Printf("[INFO] Email queued for %s", to)
 	}
 	return err
 }
@@ -152,47 +158,78 @@ func handlePayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.Currency == "" || len(req.Items) == 0 || req.CustomerName == "" || req.Email == "" {
+	if req.OrderID == "" {
+		log.Println("[ERROR] Payment request without an order")
+		http.Error(w, "Missing required field order_id", http.StatusBadRequest)
+		return
+	}
+	// A malformed request is not a failed payment: the order keeps its stock
+	// until it is paid or its reservation expires.
+	if req.PaymentMethod == "" {
 		log.Println("[ERROR] Missing required fields in request")
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
 
-	// Calculate total amount
-	totalAmount := 0.0
-	for _, item := range req.Items {
-		totalAmount += item.Price * float64(item.Quantity)
+	response, err := pay(r.Context(), req.OrderID, req.PaymentMethod)
+	if errors.Is(err, errOrderExpired) {
+		http.Error(w, "Order has expired, please place it again", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to process payment", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// pay charges the order and takes its reserved stock. The amount comes from
+// the stored order, whose prices the shop looked up when it was placed.
+func pay(ctx context.Context, orderID, paymentMethod string) (*PaymentResponse, error) {
+	order, err := store.Orders.Get(ctx, orderID)
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidID) {
+		log.Printf("[ERROR] Payment for unknown order %s", orderID)
+		return nil, errOrderExpired
+	} else if err != nil {
+		log.Printf("[ERROR] Failed to load order %s: %v", orderID, err)
+		return nil, err
+	}
+
+	totalAmount := order.Total()
 	transactionID := fmt.Sprintf("TXN%d", time.Now().Unix())
 
-	log.Printf("[INFO] Processing payment for %s | Total: %.2f %s", req.CustomerName, totalAmount, req.Currency)
+	log.Printf("[INFO] Processing payment for %s | Total: %.2f %s", order.CustomerName, totalAmount, order.Currency)
 
-	// Generate PDF
-	pdfPath, err := generatePDF(req, transactionID)
+	receipt, err := generatePDF(order, paymentMethod, transactionID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to generate receipt PDF: %v", err)
-		http.Error(w, "Failed to generate receipt", http.StatusInternalServerError)
-		return
+		log.Printf("[ERROR] Failed to generate receipt PDF for order %s: %v", orderID, err)
+		return nil, err
 	}
 
-	// Send email
-	err = sendEmail(req.Email, pdfPath)
-	if err != nil {
-		log.Printf("[ERROR] Failed to send receipt email: %v", err)
-		http.Error(w, "Failed to send receipt", http.StatusInternalServerError)
-		return
+	// The payment goes through only while the order still holds its
+	// cheese; an expired order may already have been sold to someone else.
+	// Its receipt is queued in the same transaction, so a paid order always
+	// gets one and an unpaid one never does.
+	err = store.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := inventory.Commit(ctx, store, orderID); err != nil {
+			return err
+		}
+		return sendEmail(ctx, order.Email, receipt, transactionID)
+	})
+	if errors.Is(err, inventory.ErrNotHeld) || errors.Is(err, db.ErrNotFound) {
+		log.Printf("[ERROR] Order %s no longer holds stock: %v", orderID, err)
+		return nil, errOrderExpired
+	} else if err != nil {
+		log.Printf("[ERROR] Failed to pay order %s: %v", orderID, err)
+		return nil, err
 	}
 
-	// Response
-	response := PaymentResponse{
+	log.Printf("[INFO] Payment completed | Transaction ID: %s | Customer: %s", transactionID, order.CustomerName)
+	return &PaymentResponse{
 		Status:      "Completed",
 		TotalAmount: totalAmount,
-		Currency:    req.Currency,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-
-	log.Printf("[INFO] Payment completed | Transaction ID: %s | Customer: %s", transactionID, req.CustomerName)
+		Currency:    order.Currency,
+	}, nil
 }
 
 func getTemplatePath(filename string) string {
@@ -200,19 +237,75 @@ func getTemplatePath(filename string) string {
 	return filepath.Join(basePath, "templates", filename)
 }
 
+// cardPage is what card.html shows.
+type cardPage struct {
+	Email        string
+	OrderID      string
+	ErrorMessage string
+	Message      string
+}
+
+// handleCardForm shows the card form for the order in the /card link that
+// the shop redirects to after checkout, and pays the order on submit.
 func handleCardForm(w http.ResponseWriter, r *http.Request) {
-		serveHTML(w, r, "card.html")
-	email := r.URL.Query().Get("email")
-	tmplPath := getTemplatePath("card.html")
-	tmpl, err := template.ParseFiles(tmplPath)
+	tmpl, err := template.ParseFiles(getTemplatePath("card.html"))
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	tmpl.Execute(w, struct{ Email string }{Email: email})
+
+	page := cardPage{Email: r.FormValue("email"), OrderID: r.FormValue("order_id")}
+	if page.OrderID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		page.ErrorMessage = "The payment link has no order, please check out again"
+		tmpl.Execute(w, page)
+		return
+	}
+	if r.Method != http.MethodPost {
+		tmpl.Execute(w, page)
+		return
+	}
+
+	response, err := pay(r.Context(), page.OrderID, "credit_card")
+	if errors.Is(err, errOrderExpired) {
+		w.WriteHeader(http.StatusConflict)
+		page.ErrorMessage = "Your order has expired, please place it again"
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		page.ErrorMessage = "Failed to process payment, please try again"
+	} else {
+		page.Message = fmt.Sprintf("Paid %.2f %s. The receipt is on its way to your email.", response.TotalAmount, response.Currency)
+	}
+	tmpl.Execute(w, page)
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML or JSON config file (overrides $"+config.EnvFile+")")
+	flag.Parse()
+
+	var err error
+	cfg, err = config.LoadPayment(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	store, err = db.Connect(context.Background(), cfg.Mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	mailSender, err := mailer.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Claims on outbox entries are atomic, so this worker can run next to
+	// the one in the main server.
+	if cfg.Outbox.Worker {
+		go outbox.NewWorker(store.Outbox, mailSender, cfg.Outbox).Run(context.Background())
+	}
+
 	initPaths()
 	initLogger()
 	defer logFile.Close()
@@ -222,6 +315,6 @@ func main() {
 	http.HandleFunc("/pay", handlePayment)
 	http.HandleFunc("/card", handleCardForm)
 
-	log.Println("[INFO] Payment service running on port 8082")
-	log.Fatal(http.ListenAndServe(":8082", nil))
+	log.Printf("[INFO] Payment service running on %s", cfg.Payment.Addr)
+	log.Fatal(http.ListenAndServe(cfg.Payment.Addr, nil))
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"cheese_market/config"
+	"cheese_market/db"
+	"cheese_market/inventory"
+	"cheese_market/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// placeOrder sets up a memory store holding one pending order for two
+// wheels of Gouda at 12.50.
+func placeOrder(t *testing.T) *models.Order {
+	t.Helper()
+	cfg = config.Default()
+	store = db.NewMemoryStore()
+
+	gouda := models.Product{Name: "Gouda", Price: 12.5, Stock: 5}
+	require.NoError(t, store.Products.Create(context.Background(), &gouda))
+	order := &models.Order{
+		CustomerName: "Ann",
+		Email:        "ann@example.com",
+		Currency:     "USD",
+		Items:        []models.OrderItem{{ID: gouda.ID, Name: "Gouda", Price: 12.5, Quantity: 2}},
+	}
+	require.NoError(t, inventory.PlaceOrder(context.Background(), store, order, time.Minute))
+	return order
+}
+
+func postPayment(t *testing.T, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, json.NewEncoder(&buf).Encode(body))
+	rec := httptest.NewRecorder()
+	handlePayment(rec, httptest.NewRequest(http.MethodPost, "/pay", &buf))
+	return rec
+}
+
+func TestHandlePaymentChargesTheStoredOrder(t *testing.T) {
+	order := placeOrder(t)
+
+	rec := postPayment(t, map[string]interface{}{"payment_method": "credit_card"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "order_id is required")
+
+	// Anyone can post an order ID; a request without a payment method must
+	// not cancel the order's reservation.
+	rec = postPayment(t, map[string]interface{}{"order_id": order.ID})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	held, err := store.Orders.Get(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ReservationHeld, held.Reservation)
+	assert.Equal(t, models.PaymentPending, held.PaymentStatus)
+
+	// Prices sent by the client are ignored.
+	rec = postPayment(t, map[string]interface{}{
+		"order_id":       order.ID,
+		"payment_method": "credit_card",
+		"items":          []map[string]interface{}{{"name": "Gouda", "price": 0.01, "quantity": 2}},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, 25.0, resp.TotalAmount)
+	assert.Equal(t, "USD", resp.Currency)
+
+	stored, err := store.Orders.Get(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentPaid, stored.PaymentStatus)
+
+	rec = postPayment(t, map[string]interface{}{"order_id": order.ID, "payment_method": "credit_card"})
+	assert.Equal(t, http.StatusConflict, rec.Code, "an order is paid once")
+
+	receipts, err := store.Outbox.List(context.Background(), models.OutboxPending, 10)
+	require.NoError(t, err)
+	require.Len(t, receipts, 1, "one receipt for one payment")
+	assert.Equal(t, []string{"ann@example.com"}, receipts[0].Message.To)
+}
+
+func TestCardFormPaysTheOrder(t *testing.T) {
+	order := placeOrder(t)
+
+	rec := httptest.NewRecorder()
+	handleCardForm(rec, httptest.NewRequest(http.MethodGet, "/card?email=ann@example.com&order_id="+order.ID, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `name="order_id" value="`+order.ID+`"`)
+
+	rec = httptest.NewRecorder()
+	handleCardForm(rec, httptest.NewRequest(http.MethodGet, "/card?email=ann@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	form := url.Values{"order_id": {order.ID}, "email": {"ann@example.com"}, "cardNumber": {"4242 4242 4242 4242"}}
+	req := httptest.NewRequest(http.MethodPost, "/card", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handleCardForm(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "Paid 25.00 USD")
+
+	stored, err := store.Orders.Get(context.Background(), order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ReservationCommitted, stored.Reservation)
+}
@@ -0,0 +1,138 @@
+// Package search holds the language handling behind product search:
+// splitting text into words, a light stemmer for English and Russian, and
+// typo correction against the words of the catalog.
+//
+// MongoDB's text index does the real stemming; Stem exists so the
+// in-memory store finds roughly what MongoDB would.
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Languages, named as MongoDB's text index names them.
+const (
+	English = "english"
+	Russian = "russian"
+)
+
+// ValidLanguage reports whether products may be indexed in language. The
+// empty language means English.
+func ValidLanguage(language string) bool {
+	switch language {
+	case "", English, Russian:
+		return true
+	}
+	return false
+}
+
+// Language guesses the language of a query: Russian if it has any Cyrillic
+// letter, English otherwise.
+func Language(text string) string {
+	for _, r := range text {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return Russian
+		}
+	}
+	return English
+}
+
+// Words splits text into lower-case words of letters and digits.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+var suffixes = map[string][]string{
+	English: {"ing", "ed", "s"},
+	Russian: {
+		"ами", "ями", "ого", "его", "ому", "ему", "ыми", "ими",
+		"ая", "яя", "ое", "ее", "ой", "ый", "ий", "ых", "их", "ым", "им",
+		"ам", "ям", "ах", "ях", "ом", "ем", "ов", "ев",
+		"а", "я", "ы", "и", "о", "е", "у", "ю", "ь", "й",
+	},
+}
+
+// Stem strips the most common inflections from a lower-case word, keeping
+// at least three letters.
+func Stem(word, language string) string {
+	if language == "" {
+		language = English
+	}
+	runes := []rune(word)
+	for _, suffix := range suffixes[language] {
+		n := len([]rune(suffix))
+		if len(runes)-n >= 3 && strings.HasSuffix(word, suffix) {
+			if language == English && suffix == "s" && strings.HasSuffix(word, "ss") {
+				continue
+			}
+			return string(runes[:len(runes)-n])
+		}
+	}
+	return word
+}
+
+// Distance is the Levenshtein distance between a and b: how many letters
+// must be inserted, deleted or replaced to turn one into the other.
+func Distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// MaxEdits is how many typos a word may have and still be corrected:
+// none for words under three letters, one up to five and two beyond.
+func MaxEdits(word string) int {
+	switch n := len([]rune(word)); {
+	case n < 3:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+// Correct replaces every word of query that is not in vocabulary with the
+// closest word that is, within MaxEdits. Ties go to the word that comes
+// first in vocabulary. The result is lower case; it equals the lower-cased
+// query when nothing needed correcting.
+func Correct(query string, vocabulary []string) string {
+	known := make(map[string]bool, len(vocabulary))
+	for _, w := range vocabulary {
+		known[w] = true
+	}
+
+	words := Words(query)
+	for i, word := range words {
+		if known[word] {
+			continue
+		}
+		best, bestDistance := "", MaxEdits(word)+1
+		for _, candidate := range vocabulary {
+			if d := Distance(word, candidate); d < bestDistance {
+				best, bestDistance = candidate, d
+			}
+		}
+		if best != "" {
+			words[i] = best
+		}
+	}
+	return strings.Join(words, " ")
+}
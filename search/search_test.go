@@ -0,0 +1,42 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguage(t *testing.T) {
+	assert.Equal(t, English, Language("aged gouda"))
+	assert.Equal(t, Russian, Language("выдержанный gouda"))
+}
+
+func TestStem(t *testing.T) {
+	for word, stem := range map[string]string{
+		"cheeses": "cheese",
+		"smoked":  "smok",
+		"swiss":   "swiss",
+		"brie":    "brie",
+	} {
+		assert.Equal(t, stem, Stem(word, English), word)
+	}
+	assert.Equal(t, Stem("сыр", Russian), Stem("сыры", Russian))
+	assert.Equal(t, Stem("сыр", Russian), Stem("сыра", Russian))
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, Distance("brie", "brie"))
+	assert.Equal(t, 2, Distance("camembar", "camembert"))
+	assert.Equal(t, 1, Distance("сир", "сыр"))
+	assert.Equal(t, 4, Distance("", "feta"))
+}
+
+func TestCorrect(t *testing.T) {
+	vocabulary := []string{"brie", "camembert", "feta", "normandy"}
+
+	assert.Equal(t, "camembert", Correct("Camembar", vocabulary))
+	assert.Equal(t, "brie normandy", Correct("bree normandie", vocabulary))
+	// Too far off, or too short to guess: left alone.
+	assert.Equal(t, "cheddar", Correct("cheddar", vocabulary))
+	assert.Equal(t, "fe", Correct("fe", vocabulary))
+}
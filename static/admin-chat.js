@@ -1,18 +1,107 @@
 let activeChats = [];
 let currentChatID = null;
-const socket = new WebSocket('ws://localhost:8080/ws');
+let me = null;
+let admins = [];
+let socket = null;
+let reconnectDelay = 1000;
+let olderCursor = ''; // where the next page of older messages starts
+
+// The server knows who we are from the session cookie sent with the handshake.
+function connect(reconnecting = false) {
+    socket = new WebSocket(`${location.protocol === "https:" ? "wss" : "ws"}://${location.host}/ws`);
+
+    // Listen for chats being opened and closed
+    socket.onopen = function () {
+        reconnectDelay = 1000;
+        socket.send(JSON.stringify({ type: "subscribe_lobby" }));
+        if (!reconnecting) return;
+
+        // Anything may have happened while we were away: reload.
+        loadActiveChats();
+        if (currentChatID) {
+            socket.send(JSON.stringify({ type: "join_chat", chat_id: currentChatID }));
+            loadChatHistory();
+        }
+    };
+
+    socket.onclose = function () {
+        console.warn(`WebSocket connection closed, reconnecting in ${reconnectDelay} ms.`);
+        setTimeout(() => connect(true), reconnectDelay);
+        reconnectDelay = Math.min(reconnectDelay * 2, 30000);
+    };
+
+    socket.onmessage = handleSocketMessage;
+}
 
 // Load active chats on startup
 window.onload = function () {
     loadActiveChats();
+    loadAdmins();
+    loadCannedResponses();
 };
 
+// Fill the canned response picker; the API manages the list.
+async function loadCannedResponses() {
+    try {
+        const responses = await (await fetch('/api/canned-responses')).json();
+        const select = document.getElementById('cannedResponses');
+        select.innerHTML = '';
+        responses.forEach(response => {
+            const option = document.createElement('option');
+            option.value = response.shortcut;
+            option.textContent = `/${response.shortcut} ${response.title || ''}`;
+            select.appendChild(option);
+        });
+    } catch (error) {
+        console.error("Error loading canned responses:", error);
+    }
+}
+
+// Send the picked canned response to the open chat
+function sendCanned() {
+    const shortcut = document.getElementById('cannedResponses').value;
+    if (!shortcut || !currentChatID) return;
+    socket.send(JSON.stringify({ type: "send_canned", chat_id: currentChatID, shortcut: shortcut }));
+}
+
+// Find out who we are and who chats can be transferred to
+async function loadAdmins() {
+    try {
+        me = await (await fetch('/api/me')).json();
+        const users = await (await fetch('/users')).json();
+        admins = users.filter(user => user.role === 'admin' && user.id !== me.user_id);
+
+        const select = document.getElementById('transferTo');
+        select.innerHTML = '';
+        admins.forEach(admin => {
+            const option = document.createElement('option');
+            option.value = admin.id;
+            option.textContent = admin.username;
+            select.appendChild(option);
+        });
+    } catch (error) {
+        console.error("Error loading admins:", error);
+    }
+}
+
+function adminName(adminID) {
+    if (!adminID) return 'nobody';
+    if (me && adminID === me.user_id) return 'you';
+    const admin = admins.find(admin => admin.id === adminID);
+    return admin ? admin.username : adminID;
+}
+
+function waitingFor(createdAt) {
+    const minutes = Math.floor((Date.now() - new Date(createdAt)) / 60000);
+    return minutes < 1 ? 'just now' : `${minutes} min`;
+}
+
 // Fetch the list of active chats
 async function loadActiveChats() {
     try {
         const response = await fetch('/api/active-chats');
         const data = await response.json();
-        activeChats = data;
+        activeChats = data || [];
         renderActiveChats();
     } catch (error) {
         console.error("Error loading active chats:", error);
@@ -27,7 +116,11 @@ function renderActiveChats() {
     activeChats.forEach(chat => {
         const chatItem = document.createElement('div');
         chatItem.className = 'chat-item';
-        chatItem.textContent = `Chat #${chat.chat_id}`;
+        // Chats arrive longest waiting first
+        chatItem.textContent = chat.admin_id
+            ? `Chat #${chat.chat_id} (${adminName(chat.admin_id)})`
+            : `Chat #${chat.chat_id} (waiting ${waitingFor(chat.created_at)})`;
+        if (chat.unread) chatItem.textContent += ` [${chat.unread} unread]`;
         chatItem.onclick = () => openChat(chat.chat_id);
         chatListDiv.appendChild(chatItem);
     });
@@ -35,12 +128,41 @@ function renderActiveChats() {
 
 // Open a chat
 function openChat(chatID) {
+    if (currentChatID && currentChatID !== chatID) {
+        socket.send(JSON.stringify({ type: "leave_chat", chat_id: currentChatID }));
+    }
+    socket.send(JSON.stringify({ type: "join_chat", chat_id: chatID }));
+
     currentChatID = chatID;
+    const chat = activeChats.find(chat => chat.chat_id === chatID);
+    updateAssignee(chat ? chat.admin_id : null);
+    for (const format of ['JSON', 'CSV', 'PDF']) {
+        document.getElementById(`export${format}`).href =
+            `/api/chat-transcript?chat_id=${chatID}&format=${format.toLowerCase()}`;
+    }
     document.getElementById('chatBox').style.display = 'block';
     document.getElementById('chatMessages').innerHTML = '';
+    setOlderCursor({});
     loadChatHistory();
 }
 
+function updateAssignee(adminID) {
+    document.getElementById('chatAssignee').textContent = adminName(adminID);
+    document.getElementById('claimChatBtn').style.display = adminID ? 'none' : 'inline';
+}
+
+// Take an unassigned chat from the queue
+function claimChat() {
+    socket.send(JSON.stringify({ type: "claim_chat", chat_id: currentChatID }));
+}
+
+// Hand the open chat to another admin
+function transferChat() {
+    const adminID = document.getElementById('transferTo').value;
+    if (!adminID) return;
+    socket.send(JSON.stringify({ type: "transfer_chat", chat_id: currentChatID, admin_id: adminID }));
+}
+
 // Send a message as an admin
 function sendMessage() {
     const input = document.getElementById('chatInput');
@@ -49,7 +171,6 @@ function sendMessage() {
     const messageData = {
         type: "send_message",
         chat_id: currentChatID,
-        sender: "admin",
         content: input.value.trim()
     };
 
@@ -61,7 +182,7 @@ function sendMessage() {
 }
 
 // Handle incoming WebSocket messages
-socket.onmessage = function (event) {
+function handleSocketMessage(event) {
     console.log("Received WebSocket message:", event.data);
     const data = JSON.parse(event.data);
 
@@ -74,14 +195,69 @@ socket.onmessage = function (event) {
             document.getElementById('chatControl').style.display = 'none';
             break;
 
+        case 'new_chat':
+            if (!activeChats.some(chat => chat.chat_id === data.chat_id)) {
+                activeChats.push({ chat_id: data.chat_id, user_id: data.user_id, created_at: new Date().toISOString() });
+                renderActiveChats();
+            }
+            break;
+
+        case 'chat_assigned': {
+            const chat = activeChats.find(chat => chat.chat_id === data.chat_id);
+            if (chat) chat.admin_id = data.admin_id;
+            renderActiveChats();
+
+            if (data.chat_id === currentChatID) updateAssignee(data.admin_id);
+            if (me && data.admin_id === me.user_id && data.chat_id !== currentChatID) {
+                alert(`Chat #${data.chat_id} was assigned to you.`);
+                openChat(data.chat_id);
+            }
+            break;
+        }
+
+        case 'error':
+            alert(data.error);
+            break;
+
+        case 'chat_closed':
+            activeChats = activeChats.filter(chat => chat.chat_id !== data.chat_id);
+            renderActiveChats();
+            if (data.chat_id === currentChatID) {
+                document.getElementById("chatBox").style.display = "none";
+                currentChatID = null;
+            }
+            break;
+
         case 'new_message':
             console.log("New message received:", data);
+            if (me && data.sender_id !== me.user_id) {
+                socket.send(JSON.stringify({ type: "delivered", chat_id: data.chat_id, message_id: data.message_id }));
+            }
             if (data.chat_id === currentChatID) {
+                document.getElementById('typingIndicator').style.display = 'none';
+                loadChatHistory();
+            } else {
+                const chat = activeChats.find(chat => chat.chat_id === data.chat_id);
+                if (chat) {
+                    chat.unread = (chat.unread || 0) + 1;
+                    renderActiveChats();
+                }
+            }
+            break;
+
+        case 'typing':
+            if (data.chat_id === currentChatID && (!me || data.user_id !== me.user_id)) {
+                document.getElementById('typingIndicator').style.display = data.typing ? 'block' : 'none';
+            }
+            break;
+
+        case 'receipt':
+            if (data.chat_id === currentChatID && data.status === 'read' && (!me || data.user_id !== me.user_id)) {
                 loadChatHistory();
             }
             break;
     }
-};
+}
 
 // Load chat history
 async function loadChatHistory() {
@@ -92,12 +268,25 @@ async function loadChatHistory() {
 
     try {
         const response = await fetch(`/api/chat-history?chat_id=${currentChatID}`);
-        const data = await response.json();
+        const page = await response.json();
+        const data = page.messages;
 
         if (Array.isArray(data)) {
             const messagesDiv = document.getElementById('chatMessages');
             messagesDiv.innerHTML = '';
-            data.forEach(msg => addMessageToUI(msg.sender, msg.content));
+            data.forEach(msg => addMessageToUI(msg.sender, msg.content, msg.sender === 'admin' && msg.read_at));
+            setOlderCursor(page);
+
+            // Opening the chat reads it.
+            const last = data[data.length - 1];
+            if (last && last.id && me && last.sender_id !== me.user_id) {
+                socket.send(JSON.stringify({ type: "read", chat_id: currentChatID, message_id: last.id }));
+            }
+            const chat = activeChats.find(chat => chat.chat_id === currentChatID);
+            if (chat && chat.unread) {
+                chat.unread = 0;
+                renderActiveChats();
+            }
         } else {
             console.error("Error: Expected an array, received:", data);
         }
@@ -106,14 +295,44 @@ async function loadChatHistory() {
     }
 }
 
-// Add messages to the UI
-function addMessageToUI(sender, message) {
-    const messagesDiv = document.getElementById('chatMessages');
+// Remember where older messages continue and offer to load them
+function setOlderCursor(page) {
+    olderCursor = page.has_more ? page.prev_cursor : '';
+    document.getElementById('loadOlderBtn').style.display = olderCursor ? 'inline' : 'none';
+}
 
+// Prepend the page of messages before the oldest one shown
+async function loadOlderMessages() {
+    if (!currentChatID || !olderCursor) return;
+    const chatID = currentChatID;
+
+    try {
+        const response = await fetch(`/api/chat-history?chat_id=${chatID}&before=${olderCursor}`);
+        const page = await response.json();
+        if (chatID !== currentChatID || !Array.isArray(page.messages)) return;
+
+        const messagesDiv = document.getElementById('chatMessages');
+        const first = messagesDiv.firstChild;
+        page.messages.forEach(msg => {
+            messagesDiv.insertBefore(messageElement(msg.sender, msg.content, msg.sender === 'admin' && msg.read_at), first);
+        });
+        setOlderCursor(page);
+    } catch (error) {
+        console.error("Error loading older messages:", error);
+    }
+}
+
+function messageElement(sender, message, read = false) {
     const messageDiv = document.createElement('div');
     messageDiv.className = `message ${sender}`;
-    messageDiv.innerHTML = `<strong>${sender}:</strong> ${message}`;
-    messagesDiv.appendChild(messageDiv);
+    const label = sender === 'bot' ? 'bot (auto-reply)' : sender;
+    messageDiv.innerHTML = `<strong>${label}:</strong> ${message}${read ? ' ✓✓' : ''}`;
+    return messageDiv;
+}
+
+// Add messages to the UI
+function addMessageToUI(sender, message, read = false) {
+    document.getElementById('chatMessages').appendChild(messageElement(sender, message, read));
 }
 
 // Close chat
@@ -148,3 +367,5 @@ async function closeChat() {
     setTimeout(() => location.reload(), 500);
 
 }
+
+connect();
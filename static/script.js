@@ -6,7 +6,7 @@ let category = ""; // Default category filter
 let cart = [];
 
 function addToCart(product) {
-    const existingProduct = cart.find((item) => item.id === product.id);
+    const existingProduct = cart.find((item) => item.id === product.id && item.variant_id === product.variant_id);
     if (existingProduct) {
         existingProduct.quantity += 1;
     } else {
@@ -26,7 +26,7 @@ function renderCart() {
         const removeButton = document.createElement("button");
         removeButton.textContent = "Delete";
         removeButton.onclick = () => {
-            cart = cart.filter((cartItem) => cartItem.id !== item.id);
+            cart = cart.filter((cartItem) => cartItem !== item);
             renderCart();
         };
 
@@ -99,13 +99,44 @@ async function fetchProducts() {
 
         item.appendChild(updateButton);
         item.appendChild(deleteButton);
-        item.appendChild(AddToCartButton);
+        // Products sold by weight or cut are added to the cart per variant.
+        if (product.variants && product.variants.length > 0) {
+            item.appendChild(renderVariants(product));
+        } else {
+            item.appendChild(AddToCartButton);
+        }
         productsList.appendChild(item);
     });
 
     renderPagination(total);
 }
 
+function renderVariants(product) {
+    const variantsList = document.createElement("ul");
+    product.variants.forEach((variant) => {
+        const variantItem = document.createElement("li");
+        variantItem.textContent = `${variant.name} - $${variant.price}`;
+        if (variant.price_per_kg) {
+            variantItem.textContent += ` ($${variant.price_per_kg}/kg)`;
+        }
+
+        const addButton = document.createElement("button");
+        addButton.textContent = "Add";
+        addButton.classList = "add";
+        addButton.disabled = variant.out_of_stock;
+        addButton.onclick = () => addToCart({
+            id: product.id,
+            variant_id: variant.id,
+            name: `${product.name}, ${variant.name}`,
+            price: variant.price,
+        });
+
+        variantItem.appendChild(addButton);
+        variantsList.appendChild(variantItem);
+    });
+    return variantsList;
+}
+
 function renderPagination(total) {
     const totalPages = Math.ceil(total / pageSize);
     const paginationContainer = document.getElementById("pagination");
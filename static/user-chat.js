@@ -1,23 +1,51 @@
 let currentChatID = localStorage.getItem("currentChatID") || null;
-const socket = new WebSocket('ws://localhost:8080/ws');
+let myUserID = null;
+let typingTimer = null;
+
+fetch("/api/me", { credentials: "include" })
+    .then(response => response.ok ? response.json() : null)
+    .then(me => { if (me) myUserID = me.user_id; });
+let socket = null;
+let reconnectDelay = 1000;
+
+// The server knows who we are from the session cookie sent with the handshake.
+function connect() {
+    socket = new WebSocket(`${location.protocol === "https:" ? "wss" : "ws"}://${location.host}/ws`);
+
+    socket.onopen = function () {
+        console.log("✅ WebSocket connection established.");
+        reconnectDelay = 1000;
+
+        const chatID = localStorage.getItem("currentChatID");
+        const lastID = lastMessageID();
+        if (chatID && lastID) {
+            // We were here before the connection dropped: catch up.
+            sendWebSocketMessage({ type: "resume", chat_id: chatID, last_message_id: lastID });
+        } else if (chatID) {
+            sendWebSocketMessage({ type: "check_chat", chat_id: chatID });
+        }
+    };
 
-socket.onopen = function () {
-    console.log("✅ WebSocket connection established.");
+    socket.onerror = function (event) {
+        console.error("❌ WebSocket error:", event);
+    };
 
-    if (currentChatID) {
-        sendWebSocketMessage({ type: "check_chat", chat_id: currentChatID });
-    } else {
-        showCreateChatButton();
-    }
-};
+    // Flaky connections come back on their own, backing off up to 30 seconds.
+    socket.onclose = function () {
+        console.warn(`⚠️ WebSocket connection closed, reconnecting in ${reconnectDelay} ms.`);
+        setTimeout(connect, reconnectDelay);
+        reconnectDelay = Math.min(reconnectDelay * 2, 30000);
+    };
 
-socket.onerror = function (event) {
-    console.error("❌ WebSocket error:", event);
-};
+    socket.onmessage = handleSocketMessage;
+}
 
-socket.onclose = function () {
-    console.warn("⚠️ WebSocket connection closed.");
-};
+// lastMessageID is the newest message on the page. Messages are shown in
+// the order the server stored them; their IDs need not sort that way.
+function lastMessageID() {
+    const stored = document.querySelectorAll("#messages .message[data-id]");
+    return stored.length ? stored[stored.length - 1].dataset.id : null;
+}
 
 function sendWebSocketMessage(data) {
     if (socket.readyState === WebSocket.OPEN) {
@@ -55,7 +83,7 @@ async function checkActiveChat() {
     }
 
     try {
-        const response = await fetch("/api/get-active-chat");
+        const response = await fetch("/api/active-chat");
         const data = await response.json();
 
         console.log("API response (active-chat):", data);
@@ -73,17 +101,9 @@ async function checkActiveChat() {
     }
 }
 
-async function createNewChat() {
+function createNewChat() {
     console.log("Create New Chat button clicked");
-
-    const userID = await getUserIDFromToken();
-    if (!userID) {
-        console.error("Error: user_id is missing!");
-        return;
-    }
-
-    const chatData = { type: "create_chat", user_id: userID };
-    sendWebSocketMessage(chatData);
+    sendWebSocketMessage({ type: "create_chat" });
 }
 
 function updateUIForActiveChat(chatID) {
@@ -99,18 +119,29 @@ function updateUIForNewChat() {
 
 
 
-async function loadChatHistory(chatID) {
+// loadChatHistory shows the latest messages of the chat or, given after,
+// every message newer than that one.
+async function loadChatHistory(chatID, after = null) {
     if (!chatID) {
         console.error("Error: chatID is missing!");
         return;
     }
 
     try {
-        const response = await fetch(`/api/chat-history?chat_id=${chatID}`);
-        const data = await response.json();
+        const query = after ? `&after=${after}` : "";
+        const response = await fetch(`/api/chat-history?chat_id=${chatID}${query}`);
+        const page = await response.json();
+        const data = page.messages;
 
         if (Array.isArray(data)) {
-            data.forEach(msg => addMessageToUI(msg.sender, msg.content));
+            data.forEach(msg => {
+                addMessageToUI(msg.sender, msg.content, msg.id);
+                if (msg.read_at) setReceipt(msg.id, "read");
+                else if (msg.delivered_at) setReceipt(msg.id, "delivered");
+            });
+            const last = data[data.length - 1];
+            if (last && last.id) sendWebSocketMessage({ type: "read", chat_id: chatID, message_id: last.id });
+            if (after && page.has_more) loadChatHistory(chatID, page.next_cursor);
         } else {
             console.error("Error: Expected an array, received:", data);
         }
@@ -126,7 +157,6 @@ function sendMessage() {
     const messageData = {
         type: "send_message",
         chat_id: localStorage.getItem("currentChatID"),
-        sender: "user",
         content: input.value.trim()
     };
 
@@ -137,15 +167,59 @@ function sendMessage() {
 
     socket.send(JSON.stringify(messageData)); 
     input.value = ''; // Очищаем поле ввода
+    stopTyping();
+}
+
+// Tell support we are typing; the indicator stops after 3 seconds of quiet.
+function startTyping() {
+    const chatID = localStorage.getItem("currentChatID");
+    if (!chatID) return;
+    if (!typingTimer) sendWebSocketMessage({ type: "typing_start", chat_id: chatID });
+    clearTimeout(typingTimer);
+    typingTimer = setTimeout(stopTyping, 3000);
+}
+
+function stopTyping() {
+    if (!typingTimer) return;
+    clearTimeout(typingTimer);
+    typingTimer = null;
+    sendWebSocketMessage({ type: "typing_stop", chat_id: localStorage.getItem("currentChatID") });
+}
+
+document.getElementById("messageInput").addEventListener("input", startTyping);
+
+document.getElementById("emailTranscript").addEventListener("change", (event) => {
+    sendWebSocketMessage({
+        type: "email_transcript",
+        chat_id: localStorage.getItem("currentChatID"),
+        enabled: String(event.target.checked)
+    });
+});
+
+// Show ✓ once support received our message and ✓✓ once they read it.
+function setReceipt(messageID, status) {
+    const div = document.querySelector(`#messages .message.user[data-id="${messageID}"]`);
+    if (!div) return;
+    let mark = div.querySelector(".receipt");
+    if (!mark) {
+        mark = document.createElement("span");
+        mark.className = "receipt";
+        div.appendChild(mark);
+    }
+    if (status === "read" || mark.dataset.status !== "read") {
+        mark.dataset.status = status;
+        mark.textContent = status === "read" ? " ✓✓" : " ✓";
+    }
 }
 
-socket.onmessage = function (event) {
+function handleSocketMessage(event) {
     const data = JSON.parse(event.data);
     console.log("WebSocket received message:", data);
 
     if (data.type === "chat_status") {
         if (data.exists) {
             console.log("Chat found, loading history...");
+            document.getElementById("emailTranscript").checked = data.email_transcript;
             loadChatHistory(data.chat_id);
         } else {
             console.log("Chat not found, showing create button.");
@@ -174,46 +248,68 @@ socket.onmessage = function (event) {
     }
 
     if (data.type === "new_message") {
-        if (document.querySelector(`#messages .message[data-id="${data.message_id}"]`)) {
-            console.warn("Duplicate message detected, skipping:", data.message_id);
-            return;
+        showNewMessage(data);
+    }
+
+    if (data.type === "resumed") {
+        data.messages.forEach(showNewMessage);
+        // More was missed than the server replays: fetch the rest.
+        if (data.has_more) loadChatHistory(data.chat_id, lastMessageID());
+    }
+
+    if (data.type === "email_transcript") {
+        document.getElementById("emailTranscript").checked = data.enabled;
+    }
+
+    if (data.type === "typing" && data.user_id !== myUserID) {
+        document.getElementById("typingIndicator").style.display = data.typing ? "block" : "none";
+    }
+
+    if (data.type === "receipt" && data.user_id !== myUserID) {
+        if (data.status === "delivered") {
+            setReceipt(data.message_id, "delivered");
+        } else {
+            // A read receipt covers every message up to message_id.
+            document.querySelectorAll("#messages .message.user[data-id]").forEach(div => {
+                if (div.dataset.id <= data.message_id) setReceipt(div.dataset.id, "read");
+            });
         }
+    }
+}
 
-        addMessageToUI(data.sender, data.content, data.message_id);
+function showNewMessage(data) {
+    if (document.querySelector(`#messages .message[data-id="${data.message_id}"]`)) {
+        console.warn("Duplicate message detected, skipping:", data.message_id);
+        return;
     }
-};
+
+    addMessageToUI(data.sender, data.content, data.message_id);
+    document.getElementById("typingIndicator").style.display = "none";
+
+    if (data.sender_id !== myUserID) {
+        sendWebSocketMessage({ type: "delivered", chat_id: data.chat_id, message_id: data.message_id });
+        if (document.getElementById("chatWindow").style.display === "block" && !document.hidden) {
+            sendWebSocketMessage({ type: "read", chat_id: data.chat_id, message_id: data.message_id });
+        }
+    }
+}
 
 function addMessageToUI(sender, message, messageID = null) {
     const messagesDiv = document.getElementById("messages");
+    if (messageID && messagesDiv.querySelector(`.message[data-id="${messageID}"]`)) return;
+
     const messageDiv = document.createElement("div");
 
     messageDiv.className = `message ${sender}`;
-    messageDiv.innerHTML = `<strong>${sender}:</strong> ${message}`;
+    // Bot answers are automatic; say so.
+    const label = sender === "bot" ? "bot (auto-reply)" : sender;
+    messageDiv.innerHTML = `<strong>${label}:</strong> ${message}`;
     if (messageID) messageDiv.setAttribute("data-id", messageID);
 
     messagesDiv.appendChild(messageDiv);
 }
 
 
-async function getUserIDFromToken() {
-    try {
-        const response = await fetch("/login", { method: "POST", credentials: "include" });
-        const token = response.headers.get("Authorization")?.split(" ")[1] || getCookie("token");
-        if (!token) throw new Error("Token not found!");
-
-        const payload = JSON.parse(atob(token.split(".")[1]));
-        console.log("user_id from token:", payload.user_id);
-        return payload.user_id;
-    } catch (error) {
-        console.error("Error getting user_id:", error);
-        return null;
-    }
-}
-
-function getCookie(name) {
-    const match = document.cookie.match(new RegExp(`(^| )${name}=([^;]+)`));
-    return match ? match[2] : null;
-}
 document.getElementById("activeChatLink").addEventListener("click", (event) => {
     event.preventDefault();
     
@@ -238,3 +334,5 @@ document.getElementById("logout-button").addEventListener("click", () => {
     localStorage.removeItem("currentChatID");
     console.log("Chat removed from localStorage");
 });
+
+connect();
@@ -0,0 +1,152 @@
+// Package transcript renders a support chat for the customer's email and
+// for admins to download as JSON, CSV or PDF.
+package transcript
+
+import (
+	"bytes"
+	"cheese_market/mailer"
+	"cheese_market/models"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+// Transcript is a chat with its messages, oldest first.
+type Transcript struct {
+	Chat models.Chat `json:"chat"`
+	// Customer is the username of the customer who opened the chat.
+	Customer string           `json:"customer"`
+	Messages []models.Message `json:"messages"`
+}
+
+// Formats lists the formats Write understands.
+var Formats = map[string]string{
+	"json": "application/json",
+	"csv":  "text/csv; charset=utf-8",
+	"pdf":  "application/pdf",
+}
+
+// Write renders t to w in format, one of the keys of Formats.
+func Write(w io.Writer, t *Transcript, format string) error {
+	switch format {
+	case "json":
+		return writeJSON(w, t)
+	case "csv":
+		return writeCSV(w, t)
+	case "pdf":
+		return writePDF(w, t)
+	default:
+		return fmt.Errorf("unknown transcript format %q", format)
+	}
+}
+
+// From names the author of m as the customer sees it.
+func (t *Transcript) From(m models.Message) string {
+	switch m.Sender {
+	case "admin":
+		return "Support"
+	case "bot":
+		// Labelled as in the chat widgets, so nobody mistakes an automatic
+		// answer for one from the customer or from staff.
+		return "bot (auto-reply)"
+	}
+	return t.Customer
+}
+
+func writeJSON(w io.Writer, t *Transcript) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+func writeCSV(w io.Writer, t *Transcript) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "sender", "sender_id", "content"})
+	for _, m := range t.Messages {
+		cw.Write([]string{m.Timestamp.UTC().Format(time.RFC3339), t.From(m), m.SenderID, m.Content})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePDF(w io.Writer, t *Transcript) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	// The core fonts only cover Windows-1252; other characters print as
+	// question marks.
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 16)
+	pdf.Cell(40, 10, "Support chat "+t.Chat.ChatID)
+	pdf.Ln(10)
+
+	pdf.SetFont("Arial", "", 11)
+	pdf.Cell(40, 7, tr("Customer: "+t.Customer))
+	pdf.Ln(7)
+	pdf.Cell(40, 7, "Opened: "+t.Chat.CreatedAt.Format(timeLayout))
+	pdf.Ln(7)
+	if t.Chat.ClosedAt != nil {
+		pdf.Cell(40, 7, "Closed: "+t.Chat.ClosedAt.Format(timeLayout))
+		pdf.Ln(7)
+	}
+	pdf.Ln(5)
+
+	for _, m := range t.Messages {
+		pdf.SetFont("Arial", "B", 10)
+		pdf.Cell(40, 6, tr(fmt.Sprintf("%s, %s", t.From(m), m.Timestamp.Format(timeLayout))))
+		pdf.Ln(6)
+		pdf.SetFont("Arial", "", 10)
+		pdf.MultiCell(0, 5, tr(m.Content), "", "L", false)
+		pdf.Ln(3)
+	}
+	return pdf.Output(w)
+}
+
+var emailHTML = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format(timeLayout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif;">
+<h2>Your support chat</h2>
+<p>Here is a copy of your conversation with Cheese Market support.</p>
+<table cellpadding="6" style="border-collapse: collapse;">
+{{- range .Messages}}
+<tr>
+<td style="vertical-align: top; color: #666; white-space: nowrap;">{{time .Timestamp}}</td>
+<td style="vertical-align: top;"><strong>{{$.From .}}</strong></td>
+<td style="vertical-align: top;">{{.Content}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// Email is the message sending t to the customer at to, in both HTML and
+// plain text.
+func Email(t *Transcript, to string) (mailer.Message, error) {
+	var html bytes.Buffer
+	if err := emailHTML.Execute(&html, t); err != nil {
+		return mailer.Message{}, err
+	}
+
+	var text strings.Builder
+	text.WriteString("Here is a copy of your conversation with Cheese Market support.\n\n")
+	for _, m := range t.Messages {
+		fmt.Fprintf(&text, "[%s] %s: %s\n", m.Timestamp.Format(timeLayout), t.From(m), m.Content)
+	}
+
+	return mailer.Message{
+		To:      []string{to},
+		Subject: "Your support chat transcript",
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
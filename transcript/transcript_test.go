@@ -0,0 +1,59 @@
+package transcript
+
+import (
+	"bytes"
+	"cheese_market/models"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sample() *Transcript {
+	at := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	return &Transcript{
+		Chat:     models.Chat{ChatID: "c1", UserID: "u1", CreatedAt: at},
+		Customer: "ann",
+		Messages: []models.Message{
+			{ID: "m1", ChatID: "c1", Sender: "user", SenderID: "u1", Content: "Is the <b>Comté</b> in stock?", Timestamp: at},
+			{ID: "m2", ChatID: "c1", Sender: "admin", SenderID: "a1", Content: "Yes, 24 months, \"extra\" aged", Timestamp: at.Add(time.Minute)},
+			{ID: "m3", ChatID: "c1", Sender: "bot", Content: "Orders ship within two days.", Timestamp: at.Add(2 * time.Minute)},
+		},
+	}
+}
+
+func TestWriteFormats(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, sample(), "json"))
+	var decoded Transcript
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "ann", decoded.Customer)
+	assert.Len(t, decoded.Messages, 3)
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, sample(), "csv"))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"2025-03-01T10:01:00Z", "Support", "a1", `Yes, 24 months, "extra" aged`}, rows[2])
+	assert.Equal(t, []string{"2025-03-01T10:02:00Z", "bot (auto-reply)", "", "Orders ship within two days."}, rows[3])
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, sample(), "pdf"))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")))
+
+	assert.Error(t, Write(&buf, sample(), "xml"))
+}
+
+func TestEmail(t *testing.T) {
+	msg, err := Email(sample(), "ann@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ann@example.com"}, msg.To)
+	assert.Contains(t, msg.Text, "[2025-03-01 10:00:00] ann: Is the <b>Comté</b> in stock?")
+	assert.Contains(t, msg.HTML, "Is the &lt;b&gt;Comté&lt;/b&gt; in stock?", "content is escaped")
+	assert.Contains(t, msg.HTML, "<strong>Support</strong>")
+	assert.Contains(t, msg.Text, "[2025-03-01 10:02:00] bot (auto-reply): Orders ship within two days.", "bot answers are not the customer's")
+}